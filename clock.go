@@ -0,0 +1,91 @@
+package sham
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock 是模拟的「时钟」，决定模拟中的一个时钟周期在现实中要走多久。
+// OS 每个时钟周期调用一次 Tick，调度器空等时调用 After。
+//
+// 有两种时钟：
+//   - RealClock 实时时钟：每个周期真的等待一段时间，适合慢慢看演示；
+//   - VirtualClock 虚拟时钟：不做任何等待，时间瞬间、确定地前进，适合跑测试和批量实验。
+type Clock interface {
+	// Tick 走过一个时钟周期
+	Tick()
+	// Now 返回从开机到现在走过的时钟周期数
+	Now() uint
+	// After 返回一个信道，n 个时钟周期的时长过后，该信道会收到当时的时间。
+	// After 只是等待，不会让 Now 前进。
+	After(n uint) <-chan time.Time
+}
+
+// DefaultTickDuration 是实时时钟默认的时钟周期时长
+const DefaultTickDuration = time.Second
+
+// RealClock 实时时钟：每个时钟周期真的 time.Sleep(TickDuration)
+type RealClock struct {
+	sync.Mutex
+	// TickDuration 一个时钟周期的时长
+	TickDuration time.Duration
+
+	ticks uint
+}
+
+// NewRealClock 新建一个时钟周期为 tickDuration 的实时时钟，
+// tickDuration 为 0 时使用 DefaultTickDuration。
+func NewRealClock(tickDuration time.Duration) *RealClock {
+	if tickDuration == 0 {
+		tickDuration = DefaultTickDuration
+	}
+	return &RealClock{TickDuration: tickDuration}
+}
+
+func (c *RealClock) Tick() {
+	time.Sleep(c.TickDuration)
+
+	c.Lock()
+	defer c.Unlock()
+	c.ticks += 1
+}
+
+func (c *RealClock) Now() uint {
+	c.Lock()
+	defer c.Unlock()
+	return c.ticks
+}
+
+func (c *RealClock) After(n uint) <-chan time.Time {
+	return time.After(time.Duration(n) * c.TickDuration)
+}
+
+// VirtualClock 虚拟时钟：时间只是一个计数，Tick 立即返回，After 立即到期
+type VirtualClock struct {
+	sync.Mutex
+
+	ticks uint
+}
+
+// NewVirtualClock 新建一个虚拟时钟
+func NewVirtualClock() *VirtualClock {
+	return &VirtualClock{}
+}
+
+func (c *VirtualClock) Tick() {
+	c.Lock()
+	defer c.Unlock()
+	c.ticks += 1
+}
+
+func (c *VirtualClock) Now() uint {
+	c.Lock()
+	defer c.Unlock()
+	return c.ticks
+}
+
+func (c *VirtualClock) After(n uint) <-chan time.Time {
+	ch := make(chan time.Time, 1)
+	ch <- time.Now()
+	return ch
+}
@@ -18,29 +18,82 @@ type CPU struct {
 	cancel  context.CancelFunc
 
 	Clock uint
+
+	// Synchronous 同步模式：CPU 不在单独的协程中运行线程，
+	// 而是等调度器调用 Wait 时，在调度器的协程里一步步跑。见 OS.SetDeterministic
+	Synchronous bool
+	pending     func()
+
+	// stateMutex 保护 Thread、Done、cancel、pending：Wait 在调度器的协程里调用，
+	// Cancel 却可能在线程的协程里调用（时钟中断、发出中断请求）。内嵌的 Mutex 表示 CPU 被占用，管不了这些
+	stateMutex sync.Mutex
+
+	// Tracer 记录 CPU 发出的事件，为 nil 则不记录
+	Tracer *Tracer
 }
 
 // Run 让 CPU 运行任务
+// 同步模式下只是把任务装上 CPU，调用 Wait 时才真正运行
 func (c *CPU) Run() {
+	c.stateMutex.Lock()
+	defer c.stateMutex.Unlock()
+
+	c.run()
+}
+
+// run 见 Run，调用时要持有 c.stateMutex
+func (c *CPU) run() {
+	if c.Synchronous {
+		c.Done, c.cancel, c.pending = c.Thread.Prepare()
+		return
+	}
 	c.Done, c.cancel = c.Thread.Run()
 }
 
+// Wait 返回一个信道，CPU 上的任务停下时，会从中收到其状态。
+// 同步模式下，Wait 会先在调用者的协程里把任务跑到停下（阻塞｜退出｜被取消）。
+func (c *CPU) Wait() chan int {
+	c.stateMutex.Lock()
+	done := c.Done // 任务停下前可能会 Cancel 掉 c.Done，所以先拿出来
+	exec := c.pending
+	c.pending = nil
+	c.stateMutex.Unlock()
+
+	if exec != nil { // 任务会 Cancel，不能持有 c.stateMutex 跑
+		exec()
+	}
+	return done
+}
+
 // Cancel 取消 CPU 当前的任务
 func (c *CPU) Cancel(status int) {
+	c.stateMutex.Lock()
+	defer c.stateMutex.Unlock()
+
+	c.cancelThread(status)
+}
+
+// cancelThread 见 Cancel，调用时要持有 c.stateMutex
+func (c *CPU) cancelThread(status int) {
 	if c.cancel != nil {
-		if c.Thread.contextual.Process.Status == StatusRunning {
-			c.Thread.contextual.Process.Status = status
+		if c.Thread.task.Status == StatusRunning {
+			c.Thread.task.Status = status
 		}
 		c.cancel()
 	}
 	c.Thread = nil
 	c.Done = nil
 	c.cancel = nil
+	c.pending = nil
 }
 
 // Switch 切换 CPU 任务
 func (c *CPU) Switch(newThread *Thread) {
-	c.Cancel(StatusReady)
+	c.stateMutex.Lock()
+	defer c.stateMutex.Unlock()
+
+	c.cancelThread(StatusReady)
 	c.Thread = newThread
-	c.Run()
+	c.Tracer.emit(Event{Type: EventCPUSwitch, Pid: newThread.contextual.Process.Id})
+	c.run()
 }
@@ -2,9 +2,12 @@ package sham
 
 import (
 	"bufio"
+	"encoding/gob"
 	"fmt"
 	log "github.com/sirupsen/logrus"
+	"net/url"
 	"os"
+	"path/filepath"
 	"sync"
 )
 
@@ -179,3 +182,146 @@ func (p *Pipe) Outputable() bool {
 
 	return p.used > 0
 }
+
+// Swap 是交换区：一个块存储设备，存放被换出内存的页。
+// 页的内容实际放在 Store 里，可以是内存（MemorySwapStore），也可以是磁盘上的文件（FileSwapStore）。
+// 换入、换出一页分别要花 InCost、OutCost 个时钟周期，这期间缺页的进程一直阻塞。
+type Swap struct {
+	device
+	Store SwapStore
+
+	InCost  uint
+	OutCost uint
+
+	// Ins、Outs 换入、换出的页数
+	Ins  uint
+	Outs uint
+}
+
+// DefaultSwapCost 是默认的换入、换出一页所需的时钟周期数
+const DefaultSwapCost uint = 2
+
+// NewSwap 新建一个交换区设备，页存放在 store 中
+func NewSwap(id string, store SwapStore) *Swap {
+	s := &Swap{
+		Store:   store,
+		InCost:  DefaultSwapCost,
+		OutCost: DefaultSwapCost,
+	}
+	s.Id = id
+	return s
+}
+
+// swapKey 是进程 pid 的第 page 页在交换区中的名字
+func swapKey(pid string, page uint) string {
+	return fmt.Sprintf("%s-%d", pid, page)
+}
+
+// SwapOut 把进程 pid 的第 page 页（内容为 data）写到交换区
+func (s *Swap) SwapOut(pid string, page uint, data []interface{}) error {
+	s.Lock()
+	defer s.Unlock()
+
+	log.WithFields(log.Fields{"device": s.Id, "pid": pid, "page": page}).Info("[Swap] swap out")
+	s.Outs += 1
+	return s.Store.Save(swapKey(pid, page), data)
+}
+
+// SwapIn 从交换区读回进程 pid 的第 page 页
+func (s *Swap) SwapIn(pid string, page uint) ([]interface{}, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	log.WithFields(log.Fields{"device": s.Id, "pid": pid, "page": page}).Info("[Swap] swap in")
+	s.Ins += 1
+	return s.Store.Load(swapKey(pid, page))
+}
+
+// Discard 丢掉交换区中进程 pid 的第 page 页
+func (s *Swap) Discard(pid string, page uint) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.Store.Delete(swapKey(pid, page))
+}
+
+// SwapStore 是交换区的存储后端
+type SwapStore interface {
+	Save(key string, data []interface{}) error
+	Load(key string) ([]interface{}, error)
+	Delete(key string)
+}
+
+// MemorySwapStore 把页放在内存里的交换区后端
+type MemorySwapStore struct {
+	pages map[string][]interface{}
+}
+
+// NewMemorySwapStore 新建一个内存交换区后端
+func NewMemorySwapStore() *MemorySwapStore {
+	return &MemorySwapStore{pages: map[string][]interface{}{}}
+}
+
+func (m *MemorySwapStore) Save(key string, data []interface{}) error {
+	m.pages[key] = append([]interface{}{}, data...)
+	return nil
+}
+
+func (m *MemorySwapStore) Load(key string) ([]interface{}, error) {
+	data, ok := m.pages[key]
+	if !ok {
+		return nil, fmt.Errorf("swap: no such page: %s", key)
+	}
+	return append([]interface{}{}, data...), nil
+}
+
+func (m *MemorySwapStore) Delete(key string) {
+	delete(m.pages, key)
+}
+
+// FileSwapStore 把页放在磁盘上的交换区后端：目录 Dir 下每页一个文件，用 gob 编码。
+// 注意页里只能放 gob 能编码的值（基本类型可以，chan、func 之类的不行），
+// 自定义类型要先 gob.Register。
+type FileSwapStore struct {
+	Dir string
+}
+
+// NewFileSwapStore 新建一个磁盘交换区后端，页文件放在目录 dir 下（不存在会新建）
+func NewFileSwapStore(dir string) (*FileSwapStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &FileSwapStore{Dir: dir}, nil
+}
+
+// path 是名字为 key 的页的文件路径。key 里有进程的 pid，可能带 "/"、".." 之类的字符，
+// 要先转义，保证文件一定在 Dir 下，不同的 key 也不会对应同一个文件
+func (f *FileSwapStore) path(key string) string {
+	return filepath.Join(f.Dir, url.PathEscape(key)+".page")
+}
+
+func (f *FileSwapStore) Save(key string, data []interface{}) error {
+	file, err := os.Create(f.path(key))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return gob.NewEncoder(file).Encode(data)
+}
+
+func (f *FileSwapStore) Load(key string) ([]interface{}, error) {
+	file, err := os.Open(f.path(key))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var data []interface{}
+	err = gob.NewDecoder(file).Decode(&data)
+	return data, err
+}
+
+func (f *FileSwapStore) Delete(key string) {
+	os.Remove(f.path(key))
+}
@@ -0,0 +1,154 @@
+package sham
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"sort"
+)
+
+// Fork 复制线程所在的进程，创建一个子进程：
+// 子进程有新的 pid，Parent 指向父进程，复制了父进程的变量池、内存、堆上的内存块、打开的设备、挂接的共享内存段和 PC，
+// 运行同一个 Runnable。堆上的内存块复制到子进程名下，子进程用父进程手里的句柄访问自己的那份（见 Heap.Fork）。
+//
+// 父子进程运行的是同一个 Runnable 闭包：闭包捕获的变量是父子进程共用的，不会复制。
+// 所以要在 fork 之后各自独立的状态，必须放在变量池、内存或者堆里，不能放在闭包的变量里。
+//
+// 父进程得到子进程的 pid，子进程得到 ""：
+// 子进程从父进程调用 Fork 的那条指令开始运行，这条指令会重新执行一遍，再调用 Fork 时直接返回 ""。
+// 所以 Fork 最好放在一条指令的开头。堆上放不下子进程的那份内存块时不会创建子进程，返回 "", false。
+//
+// 分页内存的复制由 ForkInterrupt 完成，父进程在这期间阻塞：
+// os.CopyOnWrite 为 true 时父子进程共用页框，谁先写再给谁复制；否则立即复制所有的页。
+func (os *OS) Fork(thread *Thread) (pid string, ok bool) {
+	c := thread.contextual
+	if c.forked { // 子进程重新执行 Fork
+		c.forked = false
+		return "", true
+	}
+
+	parent := c.Process
+	os.ProcsMutex.RLock()
+	pid = fmt.Sprintf("%s.%d", parent.Id, os.procSeq)
+	os.ProcsMutex.RUnlock()
+	if !os.Heap.Fork(parent.Id, pid) {
+		log.WithFields(log.Fields{"parent": parent.Id, "child": pid}).Error("[OS] Fork: out of heap memory")
+		return "", false
+	}
+
+	child := os.newProcess(parent.Id, pid, parent.Precedence, thread.remainingTime, parent.MemoryLimit, thread.runnable)
+	child.Program = parent.Program
+	child.Quantum = parent.Quantum
+	child.Threads[0].contextual.PC = c.PC // 子进程只有调用 Fork 的这一个线程
+	child.Threads[0].contextual.forked = true
+
+	if len(parent.Memory) > 0 {
+		child.Memory[0].Content = copyContent(parent.Memory[0].Content)
+	}
+	for id, dev := range parent.Devices {
+		child.Devices[id] = dev
+	}
+	os.ShmMutex.Lock()
+	for _, seg := range parent.Shm {
+		os.attach(child, seg)
+	}
+	os.ShmMutex.Unlock()
+	if os.MemoryModel == MemorySegmented {
+		os.copySegments(parent, child)
+	}
+
+	log.WithFields(log.Fields{
+		"parent": parent.Id,
+		"child":  pid,
+		"cow":    os.CopyOnWrite,
+	}).Info("[OS] Fork")
+
+	ch := make(chan interface{}, 1)
+	ch <- child
+	os.InterruptRequest(thread, ForkInterrupt, ch)
+
+	return pid, true
+}
+
+// copyContent 复制内存中的对象：变量池复制一份新的 map，其他的原样返回
+func copyContent(content interface{}) interface{} {
+	pool, ok := content.(map[string]interface{})
+	if !ok {
+		return content
+	}
+	copied := make(map[string]interface{}, len(pool))
+	for k, v := range pool {
+		copied[k] = v
+	}
+	return copied
+}
+
+// copySegments 把 parent 各段的内容复制到 child 的对应段中
+func (os *OS) copySegments(parent, child *Process) {
+	os.SegMem.Lock()
+	defer os.SegMem.Unlock()
+
+	for seg := range parent.Segments {
+		from, to := parent.Segments[seg], child.Segments[seg]
+		n := from.Limit
+		if to.Limit < n {
+			n = to.Limit
+		}
+		copy(os.SegMem.Cells[to.Base:to.Base+n], os.SegMem.Cells[from.Base:from.Base+n])
+	}
+}
+
+// forkPages 把 parent 的分页内存复制给 child，返回花费的时钟周期数。
+// 写时复制时，在内存中的页由父子进程共用，都标为 CopyOnWrite；
+// 否则每页都复制一份。交换区里的页总是要复制一份。
+func (os *OS) forkPages(parent, child *Process) (cost uint) {
+	var pages []uint
+	for page := range parent.PageTable {
+		pages = append(pages, page)
+	}
+	sort.Slice(pages, func(i, j int) bool { return pages[i] < pages[j] })
+
+	for _, page := range pages {
+		pte := parent.PageTable[page]
+		switch {
+		case pte.Present && os.CopyOnWrite:
+			os.PhysMem.Share(pte.Frame, FrameOwner{Pid: child.Id, Page: page})
+			pte.CopyOnWrite = true
+			child.PageTable[page] = &PageTableEntry{
+				Frame:       pte.Frame,
+				Present:     true,
+				Dirty:       pte.Dirty || pte.Swapped, // 子进程在交换区里还没有这一页
+				CopyOnWrite: true,
+			}
+		case pte.Present:
+			content := os.PhysMem.Page(pte.Frame) // 先读出来：分配页框时可能会把它换出
+			frame, c, ok := os.allocFrame(child, page)
+			cost += c
+			if !ok {
+				log.WithFields(log.Fields{"pid": child.Id, "page": page}).Error("[OS] fork: out of physical frames")
+				continue
+			}
+			os.PhysMem.SetPage(frame, content)
+			os.PageReplacer.loaded(frame)
+			child.PageTable[page] = &PageTableEntry{Frame: frame, Present: true, Dirty: true}
+			cost += os.PageCopyCost
+			os.Metrics.pageCopy()
+		case pte.Swapped:
+			swap := os.swap()
+			if swap == nil {
+				continue
+			}
+			content, err := swap.Store.Load(swapKey(parent.Id, page))
+			if err == nil {
+				err = swap.Store.Save(swapKey(child.Id, page), content)
+			}
+			if err != nil {
+				log.WithError(err).Error("[OS] fork: copy swapped page failed")
+				continue
+			}
+			child.PageTable[page] = &PageTableEntry{Swapped: true}
+			cost += os.PageCopyCost
+			os.Metrics.pageCopy()
+		}
+	}
+	return cost
+}
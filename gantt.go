@@ -0,0 +1,202 @@
+package sham
+
+import (
+	"encoding/csv"
+	"fmt"
+	"html"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Transition 是一次和 CPU 占用有关的进程状态转换：
+// ReadyToRunning、RunningToReady、RunningToBlocked、RunningToDone。
+type Transition struct {
+	// Time 转换发生的时刻（os.Clock.Now()）
+	Time uint
+	Pid  string
+	From int
+	To   int
+}
+
+// GanttSegment 是甘特图中的一段：进程 Pid 在 [Start, End) 这段时间里占用 CPU
+type GanttSegment struct {
+	Pid   string
+	Start uint
+	End   uint
+}
+
+// Gantt 记录 CPU 占用的变化，并可以导出成 ASCII、SVG、CSV 格式的甘特图。
+// OS 的状态转换函数会调用它，一般在 Boot 返回之后使用 os.Gantt 导出。
+type Gantt struct {
+	Transitions []Transition
+}
+
+// NewGantt 新建一个空的 Gantt
+func NewGantt() *Gantt {
+	return &Gantt{}
+}
+
+// record 记录一次状态转换
+func (g *Gantt) record(now uint, p *Process, from, to int) {
+	g.Transitions = append(g.Transitions, Transition{
+		Time: now,
+		Pid:  p.Id,
+		From: from,
+		To:   to,
+	})
+}
+
+// Segments 把状态转换整理成 CPU 占用的时间段，按时间先后排列。
+// 一直没离开 CPU 的进程，其时间段截止到最后一次转换。
+func (g *Gantt) Segments() []GanttSegment {
+	var segments []GanttSegment
+	var running *GanttSegment
+
+	for _, t := range g.Transitions {
+		switch {
+		case t.To == StatusRunning:
+			running = &GanttSegment{Pid: t.Pid, Start: t.Time}
+		case t.From == StatusRunning && running != nil:
+			running.End = t.Time
+			segments = append(segments, *running)
+			running = nil
+		}
+	}
+	if running != nil {
+		running.End = g.Transitions[len(g.Transitions)-1].Time
+		segments = append(segments, *running)
+	}
+
+	return segments
+}
+
+// lanes 按第一次上 CPU 的先后列出所有进程，以及总时长
+func (g *Gantt) lanes(segments []GanttSegment) (pids []string, end uint) {
+	seen := map[string]bool{}
+	for _, s := range segments {
+		if !seen[s.Pid] {
+			seen[s.Pid] = true
+			pids = append(pids, s.Pid)
+		}
+		if s.End > end {
+			end = s.End
+		}
+	}
+	return pids, end
+}
+
+// ASCII 把甘特图画成文本，每个进程一行，每个时钟周期一列，'#' 表示占用 CPU：
+//
+//	      0         1
+//	      0123456789012
+//	a     ###.......###
+//	b     ...#######...
+func (g *Gantt) ASCII() string {
+	segments := g.Segments()
+	pids, end := g.lanes(segments)
+
+	width := 0
+	for _, pid := range pids {
+		if len(pid) > width {
+			width = len(pid)
+		}
+	}
+	pad := strings.Repeat(" ", width+1)
+
+	var b strings.Builder
+
+	// 刻度：十位一行、个位一行
+	b.WriteString(pad)
+	for t := uint(0); t < end; t++ {
+		if t%10 == 0 {
+			b.WriteString(strconv.Itoa(int(t / 10 % 10)))
+		} else {
+			b.WriteByte(' ')
+		}
+	}
+	b.WriteString("\n" + pad)
+	for t := uint(0); t < end; t++ {
+		b.WriteString(strconv.Itoa(int(t % 10)))
+	}
+	b.WriteByte('\n')
+
+	for _, pid := range pids {
+		row := []byte(strings.Repeat(".", int(end)))
+		for _, s := range segments {
+			if s.Pid == pid {
+				for t := s.Start; t < s.End; t++ {
+					row[t] = '#'
+				}
+			}
+		}
+		fmt.Fprintf(&b, "%-*s %s\n", width, pid, row)
+	}
+
+	return b.String()
+}
+
+// 画 SVG 时的尺寸（像素）
+const (
+	ganttTickWidth  = 20
+	ganttLaneHeight = 24
+	ganttLabelWidth = 100
+)
+
+// WriteSVG 把甘特图画成 SVG 写到 w：每个进程一行，每段 CPU 占用一个矩形
+func (g *Gantt) WriteSVG(w io.Writer) error {
+	segments := g.Segments()
+	pids, end := g.lanes(segments)
+
+	lane := map[string]int{}
+	for i, pid := range pids {
+		lane[pid] = i
+	}
+
+	width := ganttLabelWidth + int(end)*ganttTickWidth + ganttTickWidth
+	height := (len(pids) + 1) * ganttLaneHeight
+
+	var b strings.Builder
+
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" font-family="monospace" font-size="12">`+"\n", width, height)
+	for i, pid := range pids {
+		fmt.Fprintf(&b, `  <text x="4" y="%d">%s</text>`+"\n", i*ganttLaneHeight+16, html.EscapeString(pid))
+	}
+	for _, s := range segments {
+		fmt.Fprintf(&b, `  <rect x="%d" y="%d" width="%d" height="%d" fill="steelblue" stroke="black"><title>%s [%d, %d)</title></rect>`+"\n",
+			ganttLabelWidth+int(s.Start)*ganttTickWidth, lane[s.Pid]*ganttLaneHeight+2,
+			int(s.End-s.Start)*ganttTickWidth, ganttLaneHeight-4,
+			html.EscapeString(s.Pid), s.Start, s.End)
+	}
+	axis := len(pids) * ganttLaneHeight
+	for t := uint(0); t <= end; t++ {
+		fmt.Fprintf(&b, `  <text x="%d" y="%d">%d</text>`+"\n", ganttLabelWidth+int(t)*ganttTickWidth, axis+16, t)
+	}
+	b.WriteString("</svg>\n")
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// WriteCSV 把甘特图的时间段写成 CSV：pid,start,end,duration
+func (g *Gantt) WriteCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+
+	if err := cw.Write([]string{"pid", "start", "end", "duration"}); err != nil {
+		return err
+	}
+	for _, s := range g.Segments() {
+		record := []string{
+			s.Pid,
+			strconv.Itoa(int(s.Start)),
+			strconv.Itoa(int(s.End)),
+			strconv.Itoa(int(s.End - s.Start)),
+		}
+		if err := cw.Write(record); err != nil {
+			return err
+		}
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
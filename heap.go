@@ -0,0 +1,492 @@
+package sham
+
+import (
+	"sort"
+	"sync"
+)
+
+// DefaultHeapSize 默认的堆大小（字）
+const DefaultHeapSize uint = 1024
+
+// Handle 是堆上一块内存的句柄，由 Alloc 系统调用返回，0 不是合法的句柄
+type Handle uint
+
+// HeapBlock 是堆上分配出去的一块内存
+type HeapBlock struct {
+	// Pid 申请这块内存的进程
+	Pid string
+	// Addr 块的起始地址，Size 实际分配的大小，Requested 程序申请的大小。
+	// Size 可能比 Requested 大（比如伙伴系统要凑成 2 的幂），多出来的就是内部碎片。
+	Addr      uint
+	Size      uint
+	Requested uint
+}
+
+// Heap 是模拟的堆：一块大小固定的内存，由 Allocator 决定每次分配放在哪里。
+// 进程通过 Alloc、Free 系统调用申请、释放内存，拿到的是句柄（Handle），
+// 再通过 Contextual.HeapLoad、Contextual.HeapStore 读写。
+type Heap struct {
+	sync.Mutex
+
+	Cells     []interface{}
+	Allocator HeapAllocator
+	Blocks    map[Handle]*HeapBlock
+
+	// aliases fork 出来的进程手里的句柄还是父进程的，这里记下它们对应的、属于子进程的那份拷贝：
+	// aliases[pid][父进程的句柄] = 子进程的块的句柄。见 Fork
+	aliases map[string]map[Handle]Handle
+
+	next     Handle
+	allocs   uint
+	failures uint
+}
+
+// NewHeap 新建一个大小为 size 的堆，使用 allocator 分配内存
+func NewHeap(size uint, allocator HeapAllocator) *Heap {
+	allocator.init(size)
+	return &Heap{
+		Cells:     make([]interface{}, size),
+		Allocator: allocator,
+		Blocks:    map[Handle]*HeapBlock{},
+		aliases:   map[string]map[Handle]Handle{},
+	}
+}
+
+// Alloc 给进程 pid 分配 size 个字的内存。放不下时返回 false。
+func (h *Heap) Alloc(pid string, size uint) (Handle, bool) {
+	h.Lock()
+	defer h.Unlock()
+
+	if size == 0 {
+		return 0, false
+	}
+	addr, got, ok := h.Allocator.alloc(size)
+	if !ok {
+		h.failures += 1
+		return 0, false
+	}
+	for i := addr; i < addr+got; i++ {
+		h.Cells[i] = nil
+	}
+
+	h.allocs += 1
+	h.next += 1
+	h.Blocks[h.next] = &HeapBlock{Pid: pid, Addr: addr, Size: got, Requested: size}
+	return h.next, true
+}
+
+// Free 释放进程 pid 的内存块 handle。handle 不存在或者不属于 pid 时返回 false。
+func (h *Heap) Free(pid string, handle Handle) bool {
+	h.Lock()
+	defer h.Unlock()
+
+	own := h.resolve(pid, handle)
+	b, ok := h.Blocks[own]
+	if !ok || b.Pid != pid {
+		return false
+	}
+	h.Allocator.free(b.Addr, b.Size)
+	delete(h.Blocks, own)
+	delete(h.aliases[pid], handle)
+	return true
+}
+
+// FreeAll 释放进程 pid 的所有内存块，返回释放的块数
+func (h *Heap) FreeAll(pid string) (n uint) {
+	h.Lock()
+	defer h.Unlock()
+
+	for handle, b := range h.Blocks {
+		if b.Pid == pid {
+			h.Allocator.free(b.Addr, b.Size)
+			delete(h.Blocks, handle)
+			n += 1
+		}
+	}
+	delete(h.aliases, pid)
+	return n
+}
+
+// Fork 把进程 parent 的所有内存块复制一份给进程 child（fork 时用）。
+// child 用 parent 手里的句柄就能访问到自己的那份拷贝，两边的读写互不影响。
+// 堆上放不下时什么也不复制，返回 false。
+func (h *Heap) Fork(parent, child string) bool {
+	h.Lock()
+	defer h.Unlock()
+
+	copied := map[Handle]Handle{}
+	for handle, own := range h.handles(parent) {
+		from := h.Blocks[own]
+		addr, got, ok := h.Allocator.alloc(from.Requested)
+		if !ok {
+			for _, c := range copied { // 放不下：把已经复制的还回去
+				h.Allocator.free(h.Blocks[c].Addr, h.Blocks[c].Size)
+				delete(h.Blocks, c)
+			}
+			h.failures += 1
+			return false
+		}
+		copy(h.Cells[addr:addr+from.Requested], h.Cells[from.Addr:from.Addr+from.Requested])
+
+		h.next += 1
+		h.Blocks[h.next] = &HeapBlock{Pid: child, Addr: addr, Size: got, Requested: from.Requested}
+		copied[handle] = h.next
+	}
+	h.allocs += uint(len(copied)) // 都复制成功了才算数，失败时回滚的块不计入统计
+	if len(copied) > 0 {
+		h.aliases[child] = copied
+	}
+	return true
+}
+
+// handles 返回进程 pid 手里的句柄（可能是 fork 时从父进程那里继承来的）到它的块的句柄的映射。调用时要持有 h 的锁。
+func (h *Heap) handles(pid string) map[Handle]Handle {
+	handles := map[Handle]Handle{}
+	aliased := map[Handle]bool{}
+	for handle, own := range h.aliases[pid] {
+		handles[handle] = own
+		aliased[own] = true
+	}
+	for handle, b := range h.Blocks {
+		if b.Pid == pid && !aliased[handle] {
+			handles[handle] = handle
+		}
+	}
+	return handles
+}
+
+// resolve 把进程 pid 手里的句柄 handle 换成它的块的句柄。调用时要持有 h 的锁。
+func (h *Heap) resolve(pid string, handle Handle) Handle {
+	if own, ok := h.aliases[pid][handle]; ok {
+		return own
+	}
+	return handle
+}
+
+// Usage 返回进程 pid 在堆上占用的内存（字）
+func (h *Heap) Usage(pid string) (n uint) {
+	h.Lock()
+	defer h.Unlock()
+
+	for _, b := range h.Blocks {
+		if b.Pid == pid {
+			n += b.Size
+		}
+	}
+	return n
+}
+
+// Load 读取进程 pid 的内存块 handle 中第 offset 个字
+func (h *Heap) Load(pid string, handle Handle, offset uint) (interface{}, bool) {
+	h.Lock()
+	defer h.Unlock()
+
+	addr, ok := h.addr(pid, handle, offset)
+	if !ok {
+		return nil, false
+	}
+	return h.Cells[addr], true
+}
+
+// Store 把 value 写到进程 pid 的内存块 handle 中第 offset 个字
+func (h *Heap) Store(pid string, handle Handle, offset uint, value interface{}) bool {
+	h.Lock()
+	defer h.Unlock()
+
+	addr, ok := h.addr(pid, handle, offset)
+	if !ok {
+		return false
+	}
+	h.Cells[addr] = value
+	return true
+}
+
+// addr 检查 handle 属于 pid 且 offset 没有越界，返回对应的地址
+func (h *Heap) addr(pid string, handle Handle, offset uint) (uint, bool) {
+	b, ok := h.Blocks[h.resolve(pid, handle)]
+	if !ok || b.Pid != pid || offset >= b.Requested {
+		return 0, false
+	}
+	return b.Addr + offset, true
+}
+
+// HeapStats 是堆的使用和碎片统计
+type HeapStats struct {
+	Size uint
+	// Allocated 已分配块的总大小，Requested 其中程序实际申请的大小
+	Allocated uint
+	Requested uint
+	// Free 空闲内存的总大小，分散在 Holes 个空洞里，最大的空洞有 LargestHole 个字
+	Free        uint
+	Holes       uint
+	LargestHole uint
+
+	// Allocs 成功分配的次数，Failures 因为放不下而失败的次数
+	Allocs   uint
+	Failures uint
+
+	// ExternalFragmentation 外部碎片：空闲内存中不在最大空洞里的比例，1 - LargestHole / Free
+	ExternalFragmentation float64
+	// InternalFragmentation 内部碎片：已分配内存中程序没有申请的比例，1 - Requested / Allocated
+	InternalFragmentation float64
+}
+
+// Stats 统计堆当前的使用情况和碎片
+func (h *Heap) Stats() HeapStats {
+	h.Lock()
+	defer h.Unlock()
+
+	s := HeapStats{
+		Size:     uint(len(h.Cells)),
+		Allocs:   h.allocs,
+		Failures: h.failures,
+	}
+	for _, b := range h.Blocks {
+		s.Allocated += b.Size
+		s.Requested += b.Requested
+	}
+	for _, size := range h.Allocator.holes() {
+		s.Free += size
+		s.Holes += 1
+		if size > s.LargestHole {
+			s.LargestHole = size
+		}
+	}
+
+	if s.Free > 0 {
+		s.ExternalFragmentation = 1 - float64(s.LargestHole)/float64(s.Free)
+	}
+	if s.Allocated > 0 {
+		s.InternalFragmentation = 1 - float64(s.Requested)/float64(s.Allocated)
+	}
+	return s
+}
+
+// HeapAllocator 是堆的分配算法：决定一块内存放在堆的什么位置
+type HeapAllocator interface {
+	// init 管理大小为 size 的一整块空闲内存
+	init(size uint)
+	// alloc 分配至少 size 个字，返回起始地址和实际分配的大小
+	alloc(size uint) (addr uint, got uint, ok bool)
+	// free 释放之前 alloc 出去的、从 addr 开始大小为 size 的块
+	free(addr uint, size uint)
+	// holes 返回所有空洞（连续的空闲内存）的大小
+	holes() []uint
+}
+
+// hole 是一段连续的空闲内存
+type hole struct {
+	addr uint
+	size uint
+}
+
+// holeList 是按地址排列的空洞链表，FirstFit、BestFit、WorstFit、NextFit 共用。
+// 它们的区别只在于从哪个空洞里分配。
+type holeList struct {
+	list []hole
+}
+
+func (l *holeList) init(size uint) {
+	l.list = []hole{{addr: 0, size: size}}
+}
+
+// take 从第 i 个空洞的开头切出 size 个字
+func (l *holeList) take(i int, size uint) (addr uint, got uint, ok bool) {
+	addr = l.list[i].addr
+	l.list[i].addr += size
+	l.list[i].size -= size
+	if l.list[i].size == 0 {
+		l.list = append(l.list[:i:i], l.list[i+1:]...)
+	}
+	return addr, size, true
+}
+
+// free 把释放的块放回空洞链表，和前后相邻的空洞合并
+func (l *holeList) free(addr uint, size uint) {
+	i := sort.Search(len(l.list), func(i int) bool {
+		return l.list[i].addr > addr
+	})
+	l.list = append(l.list[:i], append([]hole{{addr: addr, size: size}}, l.list[i:]...)...)
+
+	if i+1 < len(l.list) && l.list[i].addr+l.list[i].size == l.list[i+1].addr {
+		l.list[i].size += l.list[i+1].size
+		l.list = append(l.list[:i+1], l.list[i+2:]...)
+	}
+	if i > 0 && l.list[i-1].addr+l.list[i-1].size == l.list[i].addr {
+		l.list[i-1].size += l.list[i].size
+		l.list = append(l.list[:i], l.list[i+1:]...)
+	}
+}
+
+func (l *holeList) holes() []uint {
+	var sizes []uint
+	for _, h := range l.list {
+		sizes = append(sizes, h.size)
+	}
+	return sizes
+}
+
+// FirstFit 首次适应：从低地址找起，放进第一个够大的空洞
+type FirstFit struct {
+	holeList
+}
+
+func (f *FirstFit) alloc(size uint) (uint, uint, bool) {
+	for i, h := range f.list {
+		if h.size >= size {
+			return f.take(i, size)
+		}
+	}
+	return 0, 0, false
+}
+
+// BestFit 最佳适应：放进够大的空洞里最小的一个
+type BestFit struct {
+	holeList
+}
+
+func (f *BestFit) alloc(size uint) (uint, uint, bool) {
+	best := -1
+	for i, h := range f.list {
+		if h.size >= size && (best < 0 || h.size < f.list[best].size) {
+			best = i
+		}
+	}
+	if best < 0 {
+		return 0, 0, false
+	}
+	return f.take(best, size)
+}
+
+// WorstFit 最坏适应：放进最大的空洞
+type WorstFit struct {
+	holeList
+}
+
+func (f *WorstFit) alloc(size uint) (uint, uint, bool) {
+	worst := -1
+	for i, h := range f.list {
+		if h.size >= size && (worst < 0 || h.size > f.list[worst].size) {
+			worst = i
+		}
+	}
+	if worst < 0 {
+		return 0, 0, false
+	}
+	return f.take(worst, size)
+}
+
+// NextFit 循环首次适应：从上一次分配结束的地方找起，找到末尾再绕回开头
+type NextFit struct {
+	holeList
+
+	// rover 上一次分配结束的地址
+	rover uint
+}
+
+func (f *NextFit) alloc(size uint) (uint, uint, bool) {
+	start := sort.Search(len(f.list), func(i int) bool {
+		return f.list[i].addr >= f.rover
+	})
+	for n := 0; n < len(f.list); n++ {
+		i := (start + n) % len(f.list)
+		if f.list[i].size >= size {
+			addr, got, ok := f.take(i, size)
+			f.rover = addr + got
+			return addr, got, ok
+		}
+	}
+	return 0, 0, false
+}
+
+// BuddyAllocator 伙伴系统：块的大小都是 2 的幂。
+// 分配时把大块对半分，直到刚好够用；释放时如果「伙伴」也空闲，就合并回去。
+// 只管理堆中最大的 2 的幂那么大的部分，剩下的用不到。
+type BuddyAllocator struct {
+	size uint
+	// freeBlocks 每种大小的空闲块的起始地址
+	freeBlocks map[uint][]uint
+}
+
+func (b *BuddyAllocator) init(size uint) {
+	b.size = 1
+	for b.size*2 <= size {
+		b.size *= 2
+	}
+	b.freeBlocks = map[uint][]uint{}
+	if size > 0 {
+		b.freeBlocks[b.size] = []uint{0}
+	}
+}
+
+func (b *BuddyAllocator) alloc(size uint) (uint, uint, bool) {
+	want := uint(1)
+	for want < size {
+		want *= 2
+	}
+
+	for s := want; s <= b.size; s *= 2 {
+		if len(b.freeBlocks[s]) == 0 {
+			continue
+		}
+		addr := b.pop(s)
+		for s > want { // 对半分，后一半留着
+			s /= 2
+			b.push(s, addr+s)
+		}
+		return addr, want, true
+	}
+	return 0, 0, false
+}
+
+func (b *BuddyAllocator) free(addr uint, size uint) {
+	for size < b.size {
+		buddy := addr ^ size
+		if !b.remove(size, buddy) {
+			break
+		}
+		if buddy < addr {
+			addr = buddy
+		}
+		size *= 2
+	}
+	b.push(size, addr)
+}
+
+func (b *BuddyAllocator) holes() []uint {
+	var sizes []uint
+	for size, addrs := range b.freeBlocks {
+		for range addrs {
+			sizes = append(sizes, size)
+		}
+	}
+	return sizes
+}
+
+// pop 取出大小为 size 的空闲块中地址最低的一个
+func (b *BuddyAllocator) pop(size uint) uint {
+	addrs := b.freeBlocks[size]
+	addr := addrs[0]
+	b.freeBlocks[size] = addrs[1:]
+	return addr
+}
+
+// push 放回一个大小为 size 的空闲块，保持按地址排列
+func (b *BuddyAllocator) push(size uint, addr uint) {
+	addrs := b.freeBlocks[size]
+	i := sort.Search(len(addrs), func(i int) bool {
+		return addrs[i] > addr
+	})
+	b.freeBlocks[size] = append(addrs[:i:i], append([]uint{addr}, addrs[i:]...)...)
+}
+
+// remove 如果 addr 是大小为 size 的空闲块，把它取出来
+func (b *BuddyAllocator) remove(size uint, addr uint) bool {
+	for i, a := range b.freeBlocks[size] {
+		if a == addr {
+			b.freeBlocks[size] = append(b.freeBlocks[size][:i:i], b.freeBlocks[size][i+1:]...)
+			return true
+		}
+	}
+	return false
+}
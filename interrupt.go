@@ -1,6 +1,9 @@
 package sham
 
-import log "github.com/sirupsen/logrus"
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+)
 
 // Interrupt 是代表中断的对象
 type Interrupt struct {
@@ -25,22 +28,42 @@ type InterruptHandler func(os *OS, data InterruptData)
 
 // 所有支持的中断类型
 const (
-	ClockInterrupt       = "ClockInterrupt"
-	StdOutInterrupt      = "StdOutInterrupt"
-	StdInInterrupt       = "StdInInterrupt"
-	NewPipeInterrupt     = "NewPipeInterrupt"
-	GetPipeInterrupt     = "GetPipeInterrupt"
-	DestroyPipeInterrupt = "DestroyPipeInterrupt"
+	ClockInterrupt        = "ClockInterrupt"
+	StdOutInterrupt       = "StdOutInterrupt"
+	StdInInterrupt        = "StdInInterrupt"
+	NewPipeInterrupt      = "NewPipeInterrupt"
+	GetPipeInterrupt      = "GetPipeInterrupt"
+	DestroyPipeInterrupt  = "DestroyPipeInterrupt"
+	PageFaultInterrupt    = "PageFaultInterrupt"
+	SwapDoneInterrupt     = "SwapDoneInterrupt"
+	SegmentFaultInterrupt = "SegmentFaultInterrupt"
+	ForkInterrupt         = "ForkInterrupt"
+	WaitInterrupt         = "WaitInterrupt"
+	JoinInterrupt         = "JoinInterrupt"
+	SemWaitInterrupt      = "SemWaitInterrupt"
+	MutexInterrupt        = "MutexInterrupt"
+	CondWaitInterrupt     = "CondWaitInterrupt"
+	CondSignalInterrupt   = "CondSignalInterrupt"
 )
 
 // 中断类型与中断处理程序的映射
 var interrupts = map[string]InterruptHandler{
-	ClockInterrupt:       HandleClockInterrupt,
-	StdOutInterrupt:      HandleStdOutInterrupt,
-	StdInInterrupt:       HandleStdInInterrupt,
-	NewPipeInterrupt:     HandleNewPipeInterrupt,
-	GetPipeInterrupt:     HandleGetPipeInterrupt,
-	DestroyPipeInterrupt: HandleDestroyPipeInterrupt,
+	ClockInterrupt:        HandleClockInterrupt,
+	StdOutInterrupt:       HandleStdOutInterrupt,
+	StdInInterrupt:        HandleStdInInterrupt,
+	NewPipeInterrupt:      HandleNewPipeInterrupt,
+	GetPipeInterrupt:      HandleGetPipeInterrupt,
+	DestroyPipeInterrupt:  HandleDestroyPipeInterrupt,
+	PageFaultInterrupt:    HandlePageFaultInterrupt,
+	SwapDoneInterrupt:     HandleSwapDoneInterrupt,
+	SegmentFaultInterrupt: HandleSegmentFaultInterrupt,
+	ForkInterrupt:         HandleForkInterrupt,
+	WaitInterrupt:         HandleWaitInterrupt,
+	JoinInterrupt:         HandleJoinInterrupt,
+	SemWaitInterrupt:      HandleSemWaitInterrupt,
+	MutexInterrupt:        HandleMutexInterrupt,
+	CondWaitInterrupt:     HandleCondWaitInterrupt,
+	CondSignalInterrupt:   HandleCondSignalInterrupt,
 }
 
 // GetInterrupt 获取中断 —— Interrupt 对象
@@ -59,16 +82,19 @@ func GetInterrupt(pid string, typ string, channel chan interface{}) Interrupt {
 // 下面是各种「中断处理程序」，即 InterruptHandler 的具体实现
 // 这些「程序」打印的日志前面统一加 [INT] 标签
 
-// HandleClockInterrupt 处理时钟中断：时间片轮转
+// HandleClockInterrupt 处理时钟中断：时间片轮转。
+// 时间片用尽或者被抢占的进程在发出中断时已经离开 CPU，由调度器直接放回了就绪队列（见 OS.clockTick），
+// 没有经过阻塞状态，这样它等 CPU 的时间在 Metrics、甘特图里都算作就绪。这里只是记录一下。
 func HandleClockInterrupt(os *OS, data InterruptData) {
-	log.WithField("pid", data.Pid).Info("[INT] Handle ClockInterrupt: make process ready")
-	os.BlockedToReady(data.Pid)
+	log.WithField("pid", data.Pid).Info("[INT] Handle ClockInterrupt: process is back in the ready queue")
 }
 
 // HandleStdOutInterrupt 处理标准输出中断：打印从 data.Channel 读取数据打印到标准输出
 func HandleStdOutInterrupt(os *OS, data InterruptData) {
 	log.WithField("pid", data.Pid).Info("[INT] Handle StdOutInterrupt: send data to stdout")
-	os.Devs["stdout"].Output() <- <-data.Channel
+	content := <-data.Channel
+	os.Devs["stdout"].Output() <- content
+	os.Tracer.emit(Event{Type: EventDeviceIO, Pid: data.Pid, Device: "stdout", Data: fmt.Sprint(content)})
 	os.BlockedToReady(data.Pid)
 }
 
@@ -79,7 +105,9 @@ func HandleStdInInterrupt(os *OS, data InterruptData) {
 	//a := <- os.Devs["stdin"].Input()
 	//log.WithField("a", a).WithField("type(a)", fmt.Sprintf("%T", a)).Debug("a := <- os.Devs[stdin].Input()")
 	//data.Channel <- a
-	data.Channel <- <-os.Devs["stdin"].Input()
+	content := <-os.Devs["stdin"].Input()
+	data.Channel <- content
+	os.Tracer.emit(Event{Type: EventDeviceIO, Pid: data.Pid, Device: "stdin", Data: fmt.Sprint(content)})
 	//log.Debug("sent")
 	os.BlockedToReady(data.Pid)
 }
@@ -106,9 +134,10 @@ func HandleNewPipeInterrupt(os *OS, data InterruptData) {
 
 	pipe := NewPipe(pipeId, pipeBufferSize)
 	os.Devs[pipeId] = pipe
+	os.Tracer.emit(Event{Type: EventPipeCreated, Pid: data.Pid, Device: pipeId, Data: fmt.Sprint(pipeBufferSize)})
 
 	if p := os.FindProcess(data.Pid); p != nil {
-		p.Devices[pipeId] = pipe
+		p.owner().Devices[pipeId] = pipe
 	}
 
 	os.BlockedToReady(data.Pid)
@@ -134,7 +163,7 @@ func HandleGetPipeInterrupt(os *OS, data InterruptData) {
 			"pipe": pipe,
 		}).Info("[INT] Handle GetPipeInterrupt: success")
 
-		proc.Devices[pipeId] = pipe
+		proc.owner().Devices[pipeId] = pipe
 	}
 
 	os.BlockedToReady(data.Pid)
@@ -154,6 +183,328 @@ func HandleDestroyPipeInterrupt(os *OS, data InterruptData) {
 	}).Info("[INT] Handle DestroyPipeInterrupt")
 
 	delete(os.Devs, pipeId)
+	os.Tracer.emit(Event{Type: EventPipeDestroyed, Pid: data.Pid, Device: pipeId})
+
+	os.BlockedToReady(data.Pid)
+}
+
+// HandlePageFaultInterrupt 处理缺页中断：分配一个页框，装入缺的页（见 OS.allocFrame）。
+// 缺的页之前被换出到交换区的，要从交换区换入；
+// 写一个和别的进程共用的页（写时复制）也会缺页，这时要把页复制一份，改为私有的。
+// 换入、换出、复制页都要花时间，这期间进程保持阻塞，完成后由 SwapDoneInterrupt 唤醒。
+// 怎么也分配不到页框时杀掉进程（ExitOOMKilled）。
+// data.Channel 中应该是缺的虚拟页号
+func HandlePageFaultInterrupt(os *OS, data InterruptData) {
+	page, ok := (<-data.Channel).(uint)
+	if !ok {
+		log.Error("[INT] Handle PageFaultInterrupt: Arg 0 from data.Channel cannot be used as page")
+		return
+	}
+
+	proc := os.FindProcess(data.Pid)
+	if proc == nil {
+		log.WithField("pid", data.Pid).Error("[INT] Handle PageFaultInterrupt: no such process")
+		return
+	}
+	proc = proc.owner() // 缺页的是线程的话，页表是它所在进程的
+
+	var cost uint
+	// content 写时复制时要复制的页的内容
+	var content []interface{}
+
+	pte, exists := proc.PageTable[page]
+	if exists && pte.Present && pte.CopyOnWrite {
+		log.WithFields(log.Fields{
+			"pid":  data.Pid,
+			"page": page,
+		}).Info("[INT] Handle PageFaultInterrupt: copy on write")
+
+		content = os.PhysMem.Page(pte.Frame)
+		os.PhysMem.Unshare(pte.Frame, FrameOwner{Pid: proc.Id, Page: page})
+		pte.Present, pte.CopyOnWrite = false, false
+		cost += os.PageCopyCost
+		os.Metrics.pageCopy()
+	}
+
+	frame, c, ok := os.allocFrame(proc, page)
+	cost += c
+	if proc.Status == StatusDone || proc.Status == StatusZombie { // 因为内存配额被杀掉了
+		return
+	}
+	if !ok { // 换出、OOM killer 都腾不出页框：进程没法接着运行，唤醒它只会再缺页，杀掉
+		log.WithFields(log.Fields{
+			"pid":  data.Pid,
+			"page": page,
+		}).Error("[INT] Handle PageFaultInterrupt: out of physical frames, kill process")
+		os.kill(proc, ExitOOMKilled)
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"pid":   data.Pid,
+		"page":  page,
+		"frame": frame,
+	}).Info("[INT] Handle PageFaultInterrupt: page loaded")
+
+	if !exists {
+		pte = &PageTableEntry{}
+		proc.PageTable[page] = pte
+	}
+	dirty := false
+	if content != nil {
+		os.PhysMem.SetPage(frame, content)
+		dirty = true // 复制出来的页交换区里还没有
+	} else if swap := os.swap(); swap != nil && pte.Swapped {
+		if content, err := swap.SwapIn(proc.Id, page); err != nil {
+			log.WithError(err).Error("[INT] Handle PageFaultInterrupt: swap in failed")
+		} else {
+			os.PhysMem.SetPage(frame, content)
+			cost += swap.InCost
+		}
+	}
+	pte.Frame, pte.Present, pte.Referenced, pte.Dirty = frame, true, false, dirty
+	os.PageReplacer.loaded(frame)
 
+	os.pagingDone(data.Pid, cost)
+}
+
+// HandleSwapDoneInterrupt 分页 IO（换页、复制页）完成，唤醒等待的进程
+func HandleSwapDoneInterrupt(os *OS, data InterruptData) {
+	log.WithField("pid", data.Pid).Info("[INT] Handle SwapDoneInterrupt: paging IO done")
 	os.BlockedToReady(data.Pid)
 }
+
+// HandleSegmentFaultInterrupt 处理段错误中断：杀掉越界访问的进程。
+// data.Channel 中是出错的原因
+func HandleSegmentFaultInterrupt(os *OS, data InterruptData) {
+	reason := <-data.Channel
+	log.WithFields(log.Fields{
+		"pid":    data.Pid,
+		"reason": reason,
+	}).Warn("[INT] Handle SegmentFaultInterrupt: segmentation violation, kill process")
+
+	if proc := os.FindProcess(data.Pid); proc != nil {
+		os.kill(proc.owner(), ExitSegmentationFault)
+	}
+}
+
+// HandleForkInterrupt 为 fork 出来的子进程复制分页内存（见 OS.Fork），完成后唤醒父进程。
+// data.Channel 中应该是子进程 *Process
+func HandleForkInterrupt(os *OS, data InterruptData) {
+	child, ok := (<-data.Channel).(*Process)
+	if !ok {
+		log.Error("[INT] Handle ForkInterrupt: Arg 0 from data.Channel cannot be used as child process")
+		return
+	}
+	parent := os.FindProcess(data.Pid)
+	if parent == nil {
+		log.WithField("pid", data.Pid).Error("[INT] Handle ForkInterrupt: no such process")
+		return
+	}
+	parent = parent.owner()
+
+	cost := os.forkPages(parent, child)
+	log.WithFields(log.Fields{
+		"parent": parent.Id,
+		"child":  child.Id,
+		"cost":   cost,
+	}).Info("[INT] Handle ForkInterrupt: pages copied")
+
+	os.pagingDone(data.Pid, cost)
+}
+
+// HandleWaitInterrupt 让发起中断的进程等它的子进程结束（见 OS.WaitPid）：
+// 子进程已经结束了的话直接唤醒它，否则记下来，等子进程结束时（见 OS.exited）再唤醒。
+// data.Channel 中应该是要等的子进程的 pid，"" 表示任意一个
+func HandleWaitInterrupt(os *OS, data InterruptData) {
+	pid, ok := (<-data.Channel).(string)
+	if !ok {
+		log.Error("[INT] Handle WaitInterrupt: Arg 0 from data.Channel cannot be used as pid")
+		return
+	}
+
+	os.ProcsMutex.Lock()
+	defer os.ProcsMutex.Unlock()
+
+	var zombie *Process
+	exists := false
+	if p := os.lookup(data.Pid); p != nil {
+		zombie, exists = os.findChild(p.owner().Id, pid)
+	}
+	if zombie != nil || !exists {
+		log.WithFields(log.Fields{"pid": data.Pid, "child": pid}).Info("[INT] Handle WaitInterrupt: no need to wait")
+		os.blockedToReady(data.Pid)
+		return
+	}
+
+	log.WithFields(log.Fields{"pid": data.Pid, "child": pid}).Info("[INT] Handle WaitInterrupt: wait for child")
+	if os.waiting == nil {
+		os.waiting = map[string]string{}
+	}
+	os.waiting[data.Pid] = pid
+}
+
+// HandleJoinInterrupt 让发起中断的线程（1:1 模型下）等同一个进程里的另一个线程结束（见 OS.ThreadJoin）：
+// 那个线程已经结束了（或者没有这个线程）的话直接唤醒它，否则记下来，等那个线程结束时再唤醒。
+// data.Channel 中应该是要等的线程 id
+func HandleJoinInterrupt(os *OS, data InterruptData) {
+	tid, ok := (<-data.Channel).(string)
+	if !ok {
+		log.Error("[INT] Handle JoinInterrupt: Arg 0 from data.Channel cannot be used as tid")
+		return
+	}
+
+	os.ProcsMutex.Lock()
+	defer os.ProcsMutex.Unlock()
+
+	task := os.lookup(data.Pid)
+	if task == nil {
+		log.WithField("pid", data.Pid).Error("[INT] Handle JoinInterrupt: no such thread")
+		return
+	}
+	target := findThread(task.owner(), tid)
+	if target == nil || target.exited {
+		log.WithFields(log.Fields{"tid": data.Pid, "join": tid}).Info("[INT] Handle JoinInterrupt: no need to wait")
+		os.blockedToReady(data.Pid)
+		return
+	}
+
+	log.WithFields(log.Fields{"tid": data.Pid, "join": tid}).Info("[INT] Handle JoinInterrupt: wait for thread")
+	target.joiners = append(target.joiners, task.Thread)
+}
+
+// HandleSemWaitInterrupt 把发起中断的进程（线程）放进信号量的等待队列（见 OS.SemWait），等 SemSignal 唤醒它。
+// 信号量这时已经有值了的话直接拿走，唤醒它。
+// data.Channel 中应该是信号量的 key，以及发起中断的线程
+func HandleSemWaitInterrupt(os *OS, data InterruptData) {
+	key, thread, ok := syncArgs(SemWaitInterrupt, data)
+	if !ok {
+		return
+	}
+
+	os.ProcsMutex.Lock()
+	defer os.ProcsMutex.Unlock()
+
+	if syncThreadExited(SemWaitInterrupt, data, thread) {
+		return
+	}
+
+	sem, ok := os.Sems[key]
+	if !ok {
+		log.WithFields(log.Fields{"pid": data.Pid, "key": key}).Error("[INT] Handle SemWaitInterrupt: no such semaphore")
+		os.blockedToReady(data.Pid)
+		return
+	}
+	if sem.Value > 0 {
+		log.WithFields(log.Fields{"pid": data.Pid, "key": key}).Info("[INT] Handle SemWaitInterrupt: acquired")
+		sem.Value -= 1
+		os.blockedToReady(data.Pid)
+		return
+	}
+
+	log.WithFields(log.Fields{"pid": data.Pid, "key": key}).Info("[INT] Handle SemWaitInterrupt: wait in queue")
+	sem.Waiting = append(sem.Waiting, thread)
+}
+
+// syncArgs 从 data.Channel 中取出同步对象的 key 和发起中断的线程，见 HandleMutexInterrupt 等
+func syncArgs(typ string, data InterruptData) (key string, thread *Thread, ok bool) {
+	key, ok = (<-data.Channel).(string)
+	if !ok {
+		log.Errorf("[INT] Handle %s: Arg 0 from data.Channel cannot be used as key", typ)
+		return "", nil, false
+	}
+	thread, ok = (<-data.Channel).(*Thread)
+	if !ok {
+		log.Errorf("[INT] Handle %s: Arg 1 from data.Channel cannot be used as thread", typ)
+		return "", nil, false
+	}
+	return key, thread, true
+}
+
+// syncThreadExited 发起中断的线程在中断处理之前已经结束（或者被杀掉）的话返回 true，这个中断不用再处理了：
+// 它持有的锁已经释放了，也不该再排到等待队列上（见 OS.releaseMutexes）。调用时要持有 os.ProcsMutex。
+func syncThreadExited(typ string, data InterruptData, thread *Thread) bool {
+	if !thread.exited {
+		return false
+	}
+	log.WithFields(log.Fields{"pid": data.Pid, "tid": thread.Id}).Infof("[INT] Handle %s: thread already exited", typ)
+	return true
+}
+
+// HandleMutexInterrupt 把发起中断的线程放进互斥锁的等待队列（见 OS.Lock），等持有者 Unlock 把锁交给它。
+// 锁这时已经空闲了的话直接拿到，唤醒它。
+// data.Channel 中应该是互斥锁的 key，以及发起中断的线程
+func HandleMutexInterrupt(os *OS, data InterruptData) {
+	key, thread, ok := syncArgs(MutexInterrupt, data)
+	if !ok {
+		return
+	}
+
+	os.ProcsMutex.Lock()
+	defer os.ProcsMutex.Unlock()
+
+	if syncThreadExited(MutexInterrupt, data, thread) {
+		return
+	}
+	m := os.Mutexes[key]
+	if m.Owner == nil {
+		log.WithFields(log.Fields{"pid": data.Pid, "key": key}).Info("[INT] Handle MutexInterrupt: acquired")
+		m.Owner = thread
+		os.blockedToReady(data.Pid)
+		return
+	}
+
+	log.WithFields(log.Fields{"pid": data.Pid, "key": key}).Info("[INT] Handle MutexInterrupt: wait in queue")
+	m.Waiting = append(m.Waiting, thread)
+}
+
+// HandleCondWaitInterrupt 释放发起中断的线程持有的互斥锁，并把它放进条件变量的等待队列（见 OS.CondWait）。
+// data.Channel 中应该是条件变量的 key，以及发起中断的线程
+func HandleCondWaitInterrupt(os *OS, data InterruptData) {
+	key, thread, ok := syncArgs(CondWaitInterrupt, data)
+	if !ok {
+		return
+	}
+
+	os.ProcsMutex.Lock()
+	defer os.ProcsMutex.Unlock()
+
+	if syncThreadExited(CondWaitInterrupt, data, thread) {
+		return
+	}
+	c := os.Conds[key]
+	log.WithFields(log.Fields{"pid": data.Pid, "cond": key, "mutex": c.Mutex}).Info("[INT] Handle CondWaitInterrupt: wait in queue")
+	c.Waiting = append(c.Waiting, thread)
+	os.release(os.Mutexes[c.Mutex])
+}
+
+// HandleCondSignalInterrupt Hoare 语义下的 CondSignal（见 OS.CondSignal）：把发起中断的线程持有的互斥锁交给
+// 条件变量上等待最久的线程并唤醒它，发起中断的线程排到锁的 urgent 队列上，等着优先拿回锁。
+// 这时已经没有线程在等的话，发起中断的线程留着锁，接着运行。
+// data.Channel 中应该是条件变量的 key，以及发起中断的线程
+func HandleCondSignalInterrupt(os *OS, data InterruptData) {
+	key, thread, ok := syncArgs(CondSignalInterrupt, data)
+	if !ok {
+		return
+	}
+
+	os.ProcsMutex.Lock()
+	defer os.ProcsMutex.Unlock()
+
+	if syncThreadExited(CondSignalInterrupt, data, thread) {
+		return
+	}
+	c := os.Conds[key]
+	m := os.Mutexes[c.Mutex]
+	w := os.popWaiter(&c.Waiting)
+	if w == nil {
+		log.WithFields(log.Fields{"pid": data.Pid, "cond": key}).Info("[INT] Handle CondSignalInterrupt: no waiter")
+		os.blockedToReady(data.Pid)
+		return
+	}
+
+	log.WithFields(log.Fields{"pid": data.Pid, "cond": key, "wake": w.Id}).Info("[INT] Handle CondSignalInterrupt: hand the mutex over")
+	m.Owner = w
+	m.urgent = append(m.urgent, thread)
+	os.blockedToReady(w.task.Id)
+}
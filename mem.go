@@ -1,7 +1,8 @@
 package sham
 
 // Memory 是模拟的「内存」
-// 这里认为「内存」就是一堆对象的集合（切片）
+// 这里认为「内存」就是一堆对象的集合（切片），容量无限，变量池就放在这里。
+// 需要按地址访问、容量有限的内存，见分页的 PhysicalMemory。
 type Memory []Object
 
 // Object 是「内存」中保存的「对象」，具体是啥都行。
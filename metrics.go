@@ -0,0 +1,324 @@
+package sham
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+// ProcessStats 是一个进程的调度统计数据，时间的单位都是时钟周期（os.Clock.Now()）
+type ProcessStats struct {
+	Pid string
+
+	// Arrival 进入就绪队列（创建）的时刻
+	Arrival uint
+	// FirstRun 第一次上 CPU 的时刻，Started 为 false 时无意义
+	FirstRun uint
+	Started  bool
+	// Completion 运行结束的时刻，Completed 为 false 时无意义
+	Completion uint
+	Completed  bool
+
+	// Running、Ready、Blocked、Stopped 分别是在运行、就绪、阻塞、停止状态下待过的总时间，
+	// New 是新建后等待接纳的时间，Suspended 是挂起（就绪挂起、阻塞挂起）的时间
+	Running   uint
+	Ready     uint
+	Blocked   uint
+	Stopped   uint
+	New       uint
+	Suspended uint
+	// Dispatches 被调度上 CPU 的次数
+	Dispatches uint
+
+	// References 访存次数，PageFaults 缺页次数
+	References uint
+	PageFaults uint
+
+	// ExitReason 进程结束的原因，见 Process.ExitReason；ExitCode 退出码
+	ExitReason string
+	ExitCode   int
+
+	// since 进入当前状态的时刻
+	since uint
+}
+
+// Turnaround 周转时间：从到达到运行结束
+func (s ProcessStats) Turnaround() uint {
+	return s.Completion - s.Arrival
+}
+
+// Waiting 等待时间：在就绪队列里待过的总时间
+func (s ProcessStats) Waiting() uint {
+	return s.Ready
+}
+
+// Response 响应时间：从到达到第一次上 CPU。没上过 CPU 就结束了的（被杀掉了）没有响应时间，为 0
+func (s ProcessStats) Response() uint {
+	if !s.Started {
+		return 0
+	}
+	return s.FirstRun - s.Arrival
+}
+
+// HitRatio 访存的命中率：没有缺页的访存占比
+func (s ProcessStats) HitRatio() float64 {
+	return hitRatio(s.References, s.PageFaults)
+}
+
+// hitRatio references 次访存、faults 次缺页的命中率。
+// references 只记完成了的访存，一次访存可能缺页好几次（页刚装入又被换出去了），也可能缺页后进程被杀掉，
+// 所以 faults 可能比 references 多，这时命中率为 0。
+func hitRatio(references, faults uint) float64 {
+	if references == 0 {
+		return 0
+	}
+	return math.Max(0, float64(references)-float64(faults)) / float64(references)
+}
+
+// Metrics 在进程状态转换时记录调度数据，用来评价调度器的表现。
+// OS 的各个状态转换函数会调用它，调用 OS.Report 获取结果。
+// Noop 不算作进程，它运行的时间计为 CPU 空闲时间。
+type Metrics struct {
+	procs   []*ProcessStats // 按到达的先后排列
+	stats   map[*Process]*ProcessStats
+	lastRun *Process
+
+	contextSwitches uint
+	pageCopies      uint
+	idle            uint
+	idleSince       uint
+}
+
+// NewMetrics 新建一个空的 Metrics
+func NewMetrics() *Metrics {
+	return &Metrics{
+		stats: map[*Process]*ProcessStats{},
+	}
+}
+
+// of 获取进程 p 的统计数据，没有就新建一个（以 now 为到达时刻）
+func (m *Metrics) of(p *Process, now uint) *ProcessStats {
+	s, ok := m.stats[p]
+	if !ok {
+		s = &ProcessStats{Pid: p.Id, Arrival: now, since: now}
+		m.stats[p] = s
+		m.procs = append(m.procs, s)
+	}
+	return s
+}
+
+// arrive 进程 p 到达（进入就绪队列）
+func (m *Metrics) arrive(p *Process, now uint) {
+	if !p.idle {
+		m.of(p, now)
+	}
+}
+
+// dispatch 进程 p 从就绪变为运行
+func (m *Metrics) dispatch(p *Process, now uint) {
+	if m.lastRun != nil && m.lastRun != p {
+		m.contextSwitches += 1
+	}
+	m.lastRun = p
+
+	if p.idle {
+		m.idleSince = now
+		return
+	}
+
+	s := m.of(p, now)
+	if !s.Started {
+		s.FirstRun, s.Started = now, true
+	}
+	s.Ready += now - s.since
+	s.Dispatches += 1
+	s.since = now
+}
+
+// stop 进程 p 离开 CPU，变为 status 状态（就绪｜阻塞｜结束｜停止｜就绪挂起）
+func (m *Metrics) stop(p *Process, status int, now uint) {
+	if p.idle {
+		m.idle += now - m.idleSince
+		return
+	}
+
+	s := m.of(p, now)
+	s.Running += now - s.since
+	s.since = now
+	if status == StatusDone {
+		s.Completion, s.Completed = now, true
+	}
+}
+
+// kill 进程 p 在 status 状态（不在 CPU 上）下被杀掉，没有经过 CPU 就结束了
+func (m *Metrics) kill(p *Process, status int, now uint) {
+	m.leave(p, status, now)
+	s := m.of(p, now)
+	s.Completion, s.Completed = now, true
+}
+
+// leave 进程 p 离开 from 状态（一次不经过 CPU 的转换，如挂起、激活、接纳），记下在 from 状态下待过的时间
+func (m *Metrics) leave(p *Process, from int, now uint) {
+	if p.idle {
+		return
+	}
+
+	s := m.of(p, now)
+	d := now - s.since
+	switch from {
+	case StatusReady:
+		s.Ready += d
+	case StatusBlocked:
+		s.Blocked += d
+	case StatusStopped:
+		s.Stopped += d
+	case StatusNew:
+		s.New += d
+	case StatusSuspendedReady, StatusSuspendedBlocked:
+		s.Suspended += d
+	}
+	s.since = now
+}
+
+// exit 记录进程 p 结束的原因和退出码
+func (m *Metrics) exit(p *Process, now uint) {
+	if !p.idle {
+		s := m.of(p, now)
+		s.ExitReason, s.ExitCode = p.ExitReason, p.ExitCode
+	}
+}
+
+// wake 进程 p 从阻塞变为就绪
+func (m *Metrics) wake(p *Process, now uint) {
+	if p.idle {
+		return
+	}
+
+	s := m.of(p, now)
+	s.Blocked += now - s.since
+	s.since = now
+}
+
+// pageReference 进程 p 完成了一次访存
+func (m *Metrics) pageReference(p *Process, now uint) {
+	m.of(p, now).References += 1
+}
+
+// pageFault 进程 p 访存时缺页（缺页处理完后，这次访存会重新执行，再记一次 pageReference）
+func (m *Metrics) pageFault(p *Process, now uint) {
+	m.of(p, now).PageFaults += 1
+}
+
+// pageCopy 复制了一页（fork 或者写时复制）
+func (m *Metrics) pageCopy() {
+	m.pageCopies += 1
+}
+
+// Report 是一次运行的调度报告，时间的单位都是时钟周期
+type Report struct {
+	Processes []ProcessStats
+
+	// 已完成进程的平均周转时间、等待时间、响应时间（响应时间只算上过 CPU 的进程）
+	AvgTurnaround float64
+	AvgWaiting    float64
+	AvgResponse   float64
+
+	ContextSwitches uint
+
+	// TotalTime 总时间，BusyTime 进程（不含 Noop）在 CPU 上运行的时间，
+	// IdleTime Noop 运行的时间。剩下的是操作系统处理中断等花掉的时间。
+	TotalTime uint
+	BusyTime  uint
+	IdleTime  uint
+	// Utilization CPU 利用率：BusyTime / TotalTime
+	Utilization float64
+	// Throughput 吞吐量：每个时钟周期完成的进程数
+	Throughput float64
+
+	// 所有进程的访存次数、缺页次数和命中率
+	References uint
+	PageFaults uint
+	HitRatio   float64
+	// PageCopies fork 和写时复制复制的页数
+	PageCopies uint
+
+	// Heap 运行结束时堆的使用和碎片情况，由 OS.Report 填写
+	Heap HeapStats
+}
+
+// report 以 now 为结束时刻生成调度报告
+func (m *Metrics) report(now uint) Report {
+	r := Report{
+		ContextSwitches: m.contextSwitches,
+		PageCopies:      m.pageCopies,
+		TotalTime:       now,
+		IdleTime:        m.idle,
+	}
+
+	completed, started := 0, 0
+	for _, s := range m.procs {
+		r.Processes = append(r.Processes, *s)
+		r.BusyTime += s.Running
+		r.References += s.References
+		r.PageFaults += s.PageFaults
+
+		if s.Completed {
+			completed += 1
+			r.AvgTurnaround += float64(s.Turnaround())
+			r.AvgWaiting += float64(s.Waiting())
+		}
+		if s.Completed && s.Started { // 没上过 CPU 的进程没有响应时间，不计入平均
+			started += 1
+			r.AvgResponse += float64(s.Response())
+		}
+	}
+
+	if completed > 0 {
+		r.AvgTurnaround /= float64(completed)
+		r.AvgWaiting /= float64(completed)
+	}
+	if started > 0 {
+		r.AvgResponse /= float64(started)
+	}
+	r.HitRatio = hitRatio(r.References, r.PageFaults)
+	if now > 0 {
+		r.Utilization = float64(r.BusyTime) / float64(now)
+		r.Throughput = float64(completed) / float64(now)
+	}
+
+	return r
+}
+
+// String 把报告打印成表格
+func (r Report) String() string {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "%-16s %8s %8s %10s %10s %8s %8s %8s\n",
+		"PID", "ARRIVAL", "FIRST", "COMPLETE", "TURNAROUND", "WAITING", "RESPONSE", "BLOCKED")
+	for _, s := range r.Processes {
+		if !s.Completed {
+			fmt.Fprintf(&b, "%-16s %8d %8s %10s %10s %8d %8s %8d\n",
+				s.Pid, s.Arrival, "-", "-", "-", s.Waiting(), "-", s.Blocked)
+			continue
+		}
+		if !s.Started {
+			fmt.Fprintf(&b, "%-16s %8d %8s %10d %10d %8d %8s %8d\n",
+				s.Pid, s.Arrival, "-", s.Completion, s.Turnaround(), s.Waiting(), "-", s.Blocked)
+			continue
+		}
+		fmt.Fprintf(&b, "%-16s %8d %8d %10d %10d %8d %8d %8d\n",
+			s.Pid, s.Arrival, s.FirstRun, s.Completion, s.Turnaround(), s.Waiting(), s.Response(), s.Blocked)
+	}
+
+	fmt.Fprintf(&b, "average turnaround: %.2f, waiting: %.2f, response: %.2f\n",
+		r.AvgTurnaround, r.AvgWaiting, r.AvgResponse)
+	fmt.Fprintf(&b, "memory references: %d, page faults: %d, hit ratio: %.2f%%, page copies: %d\n",
+		r.References, r.PageFaults, r.HitRatio*100, r.PageCopies)
+	fmt.Fprintf(&b, "heap: %d/%d allocated (%d requested), %d allocs, %d failures, fragmentation: external %.2f%%, internal %.2f%%\n",
+		r.Heap.Allocated, r.Heap.Size, r.Heap.Requested, r.Heap.Allocs, r.Heap.Failures,
+		r.Heap.ExternalFragmentation*100, r.Heap.InternalFragmentation*100)
+	fmt.Fprintf(&b, "context switches: %d, CPU utilization: %.2f%% (busy %d, idle %d, total %d), throughput: %.4f/tick\n",
+		r.ContextSwitches, r.Utilization*100, r.BusyTime, r.IdleTime, r.TotalTime, r.Throughput)
+
+	return b.String()
+}
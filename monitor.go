@@ -0,0 +1,314 @@
+package sham
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"sort"
+)
+
+// 管程的唤醒语义：CondSignal 唤醒等待的线程后，谁接着在管程里（持有互斥锁）运行
+const (
+	// MonitorMesa Mesa 语义（默认）：发信号的线程接着运行，被唤醒的线程去排队抢互斥锁，
+	// 拿到锁时条件可能又不成立了，所以要重新检查条件（CondWait 所在的指令会重新执行，相当于 while 循环）。
+	MonitorMesa = "mesa"
+	// MonitorHoare Hoare 语义：发信号的线程把互斥锁直接交给被唤醒的线程，自己阻塞，
+	// 等那个线程释放锁（Unlock 或者又 CondWait）后优先拿回锁。被唤醒的线程拿到锁时条件一定成立。
+	MonitorHoare = "hoare"
+)
+
+// Mutex 是互斥锁：同一时间只能有一个线程持有（Owner），别的线程 Lock 时阻塞在等待队列上。
+// 只有持有者能 Unlock，Unlock 时锁直接交给等待最久的线程。由 os.ProcsMutex 保护。
+// 持有锁的线程结束（或者它的进程结束、被杀掉）时，锁会被释放，交给等着的线程（见 releaseMutexes）。
+type Mutex struct {
+	Key string
+	// Owner 持有锁的线程，没有的话为 nil
+	Owner *Thread
+	// Waiting 等待队列：阻塞在 Lock 上的线程，先来先服务
+	Waiting []*Thread
+	// urgent Hoare 语义下发了信号、在等着拿回锁的线程，比 Waiting 里的线程优先
+	urgent []*Thread
+}
+
+// CondVar 是条件变量：线程在持有互斥锁时 CondWait，释放锁并阻塞，等别的线程 CondSignal、CondBroadcast 唤醒。
+// 由 os.ProcsMutex 保护。
+type CondVar struct {
+	Key string
+	// Mutex 和条件变量一起用的互斥锁的 key，第一次 CondWait 时确定
+	Mutex string
+	// Waiting 等待队列：阻塞在 CondWait 上的线程，先来先服务
+	Waiting []*Thread
+}
+
+// Mutexget 获取键为 key 的互斥锁，不存在就新建一个没有被持有的
+func (os *OS) Mutexget(thread *Thread, key string) bool {
+	os.ProcsMutex.Lock()
+	defer os.ProcsMutex.Unlock()
+
+	if _, ok := os.Mutexes[key]; ok {
+		return true
+	}
+
+	log.WithFields(log.Fields{"tid": thread.Id, "key": key}).Info("[OS] Mutexget: create a mutex")
+	if os.Mutexes == nil {
+		os.Mutexes = map[string]*Mutex{}
+	}
+	os.Mutexes[key] = &Mutex{Key: key}
+	os.Tracer.emit(Event{Type: EventMutexCreated, Pid: thread.contextual.Process.Id, Data: fmt.Sprintf("key=%s", key)})
+	return true
+}
+
+// Condget 获取键为 key 的条件变量，不存在就新建一个
+func (os *OS) Condget(thread *Thread, key string) bool {
+	os.ProcsMutex.Lock()
+	defer os.ProcsMutex.Unlock()
+
+	if _, ok := os.Conds[key]; ok {
+		return true
+	}
+
+	log.WithFields(log.Fields{"tid": thread.Id, "key": key}).Info("[OS] Condget: create a condition variable")
+	if os.Conds == nil {
+		os.Conds = map[string]*CondVar{}
+	}
+	os.Conds[key] = &CondVar{Key: key}
+	os.Tracer.emit(Event{Type: EventCondCreated, Pid: thread.contextual.Process.Id, Data: fmt.Sprintf("key=%s", key)})
+	return true
+}
+
+// Lock 给互斥锁 key 加锁：锁没被持有时直接拿到，接着运行；
+// 否则发出 MutexInterrupt，线程阻塞在锁的等待队列上，直到持有者 Unlock 把锁交给它，从下一条指令接着运行。
+// 所以 Lock 应该是一条指令里的最后一个操作。
+// 没有这个锁，或者锁已经被自己持有（不可重入）时返回 false。
+// M:1 模型下阻塞的是整个进程：等同一个进程里别的线程持有的锁会死锁。
+func (os *OS) Lock(thread *Thread, key string) bool {
+	os.ProcsMutex.Lock()
+	m, ok := os.Mutexes[key]
+	held := ok && m.Owner == thread
+	acquired := ok && m.Owner == nil
+	if acquired {
+		m.Owner = thread
+	}
+	os.ProcsMutex.Unlock()
+
+	switch {
+	case !ok:
+		log.WithFields(log.Fields{"tid": thread.Id, "key": key}).Warn("[OS] Lock: no such mutex")
+		return false
+	case held:
+		log.WithFields(log.Fields{"tid": thread.Id, "key": key}).Error("[OS] Lock: mutex already held by the thread")
+		return false
+	case acquired:
+		log.WithFields(log.Fields{"tid": thread.Id, "key": key}).Info("[OS] Lock: acquired")
+		return true
+	}
+
+	ch := make(chan interface{}, 2)
+	ch <- key
+	ch <- thread
+	os.InterruptRequest(thread, MutexInterrupt, ch)
+	return true
+}
+
+// Unlock 释放互斥锁 key，锁交给等着的线程（见 release）。不会阻塞。
+// 没有这个锁，或者锁不是这个线程持有的时返回 false，锁保持原样。
+func (os *OS) Unlock(thread *Thread, key string) bool {
+	os.ProcsMutex.Lock()
+	defer os.ProcsMutex.Unlock()
+
+	m, ok := os.Mutexes[key]
+	if !ok {
+		log.WithFields(log.Fields{"tid": thread.Id, "key": key}).Warn("[OS] Unlock: no such mutex")
+		return false
+	}
+	if m.Owner != thread {
+		log.WithFields(log.Fields{
+			"tid":   thread.Id,
+			"key":   key,
+			"owner": ownerId(m),
+		}).Error("[OS] Unlock: mutex not held by the thread")
+		return false
+	}
+
+	log.WithFields(log.Fields{"tid": thread.Id, "key": key}).Info("[OS] Unlock")
+	os.release(m)
+	return true
+}
+
+// CondWait 在条件变量 cond 上等待：释放线程持有的互斥锁 mutex，阻塞在 cond 的等待队列上（由 CondWaitInterrupt 完成，
+// 释放锁和进入等待队列是一起做的，不会丢失唤醒），被唤醒并重新拿到 mutex 后，这条指令会重新执行（和 WaitPid 一样），
+// 正好重新检查等待的条件。
+// 没有这个条件变量或者锁，没有持有 mutex，或者 cond 已经和别的锁一起用了时返回 false，不会等。
+func (os *OS) CondWait(thread *Thread, cond string, mutex string) bool {
+	os.ProcsMutex.Lock()
+	c, okc := os.Conds[cond]
+	m, okm := os.Mutexes[mutex]
+	held := okm && m.Owner == thread
+	bound := okc && (c.Mutex == "" || c.Mutex == mutex)
+	if okc && held && bound {
+		c.Mutex = mutex
+	}
+	os.ProcsMutex.Unlock()
+
+	fields := log.Fields{"tid": thread.Id, "cond": cond, "mutex": mutex}
+	switch {
+	case !okc || !okm:
+		log.WithFields(fields).Warn("[OS] CondWait: no such condition variable or mutex")
+		return false
+	case !held:
+		log.WithFields(fields).Error("[OS] CondWait: mutex not held by the thread")
+		return false
+	case !bound:
+		log.WithFields(fields).Error("[OS] CondWait: condition variable used with another mutex")
+		return false
+	}
+
+	log.WithFields(fields).Info("[OS] CondWait")
+	ch := make(chan interface{}, 2)
+	ch <- cond
+	ch <- thread
+	os.InterruptRequest(thread, CondWaitInterrupt, ch)
+	thread.contextual.restart = true
+	return true
+}
+
+// CondSignal 唤醒在条件变量 cond 上等待最久的线程，没有线程在等的话什么也不做。
+//   - Mesa 语义：被唤醒的线程去排队抢 cond 的互斥锁，发信号的线程接着运行，不用持有锁；
+//   - Hoare 语义：发信号的线程要持有 cond 的互斥锁，把锁直接交给被唤醒的线程，
+//     自己发出 CondSignalInterrupt 阻塞，拿回锁后从下一条指令接着运行，所以 CondSignal 应该是一条指令里的最后一个操作。
+//
+// 没有这个条件变量，或者 Hoare 语义下没有持有 cond 的互斥锁时返回 false。
+func (os *OS) CondSignal(thread *Thread, cond string) bool {
+	os.ProcsMutex.Lock()
+	c, ok := os.Conds[cond]
+	if !ok {
+		os.ProcsMutex.Unlock()
+		log.WithFields(log.Fields{"tid": thread.Id, "cond": cond}).Warn("[OS] CondSignal: no such condition variable")
+		return false
+	}
+	if os.MonitorSemantics != MonitorHoare {
+		if t := os.popWaiter(&c.Waiting); t != nil {
+			log.WithFields(log.Fields{"tid": thread.Id, "cond": cond, "wake": t.Id}).Info("[OS] CondSignal")
+			os.reacquire(os.Mutexes[c.Mutex], t)
+		}
+		os.ProcsMutex.Unlock()
+		return true
+	}
+
+	waiting := len(c.Waiting) > 0
+	held := c.Mutex != "" && os.Mutexes[c.Mutex].Owner == thread
+	os.ProcsMutex.Unlock()
+
+	if !waiting {
+		return true
+	}
+	if !held {
+		log.WithFields(log.Fields{"tid": thread.Id, "cond": cond, "mutex": c.Mutex}).Error("[OS] CondSignal: mutex not held by the thread")
+		return false
+	}
+
+	log.WithFields(log.Fields{"tid": thread.Id, "cond": cond}).Info("[OS] CondSignal: hand the mutex over")
+	ch := make(chan interface{}, 2)
+	ch <- cond
+	ch <- thread
+	os.InterruptRequest(thread, CondSignalInterrupt, ch)
+	return true
+}
+
+// CondBroadcast 唤醒在条件变量 cond 上等待的所有线程，它们都去排队抢 cond 的互斥锁，发信号的线程接着运行。
+// Hoare 语义下也是这样（一次只能把锁交给一个线程），被唤醒的线程拿到锁时条件不一定成立。
+// 没有这个条件变量时返回 false。
+func (os *OS) CondBroadcast(thread *Thread, cond string) bool {
+	os.ProcsMutex.Lock()
+	defer os.ProcsMutex.Unlock()
+
+	c, ok := os.Conds[cond]
+	if !ok {
+		log.WithFields(log.Fields{"tid": thread.Id, "cond": cond}).Warn("[OS] CondBroadcast: no such condition variable")
+		return false
+	}
+
+	log.WithFields(log.Fields{"tid": thread.Id, "cond": cond, "waiting": len(c.Waiting)}).Info("[OS] CondBroadcast")
+	for t := os.popWaiter(&c.Waiting); t != nil; t = os.popWaiter(&c.Waiting) {
+		os.reacquire(os.Mutexes[c.Mutex], t)
+	}
+	return true
+}
+
+// release 释放互斥锁 m：有 Hoare 语义下等着拿回锁的线程的话交给它，否则交给等待队列里最早来的线程，并唤醒它；
+// 都没有的话锁空闲。调用时要持有 os.ProcsMutex。
+func (os *OS) release(m *Mutex) {
+	t := os.popWaiter(&m.urgent)
+	if t == nil {
+		t = os.popWaiter(&m.Waiting)
+	}
+	m.Owner = t
+	if t != nil {
+		log.WithFields(log.Fields{"key": m.Key, "owner": t.Id}).Info("[OS] mutex handed over")
+		os.blockedToReady(t.task.Id)
+	}
+}
+
+// reacquire 条件变量上被唤醒的线程 t 重新拿互斥锁 m：锁空闲的话直接拿到并唤醒，否则继续阻塞，排到锁的等待队列上。
+// 调用时要持有 os.ProcsMutex。
+func (os *OS) reacquire(m *Mutex, t *Thread) {
+	if m.Owner == nil {
+		m.Owner = t
+		os.blockedToReady(t.task.Id)
+		return
+	}
+	m.Waiting = append(m.Waiting, t)
+}
+
+// popWaiter 从等待队列 queue 里取出最早来的、还活着的线程，没有的话返回 nil。调用时要持有 os.ProcsMutex。
+func (os *OS) popWaiter(queue *[]*Thread) *Thread {
+	for len(*queue) > 0 {
+		t := (*queue)[0]
+		*queue = (*queue)[1:]
+		if !t.exited && os.lookup(t.task.Id) != nil { // 等的线程可能已经结束或者被杀掉了
+			return t
+		}
+	}
+	return nil
+}
+
+// releaseMutexes 有线程结束后清理互斥锁和条件变量：把结束了的线程从等待队列里去掉；
+// 结束的线程还持有的锁释放掉（见 release），不然等这把锁的线程永远等不到。调用时要持有 os.ProcsMutex。
+func (os *OS) releaseMutexes() {
+	keys := make([]string, 0, len(os.Mutexes))
+	for key := range os.Mutexes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys) // 按 key 的顺序交出锁，确定性运行时结果可以复现
+
+	for _, key := range keys {
+		m := os.Mutexes[key]
+		m.Waiting = liveThreads(m.Waiting)
+		m.urgent = liveThreads(m.urgent)
+		if m.Owner != nil && m.Owner.exited {
+			log.WithFields(log.Fields{"key": key, "owner": m.Owner.Id}).Warn("[OS] mutex owner exited, release it")
+			os.release(m)
+		}
+	}
+	for _, c := range os.Conds {
+		c.Waiting = liveThreads(c.Waiting)
+	}
+}
+
+// liveThreads 返回 threads 里还没结束的线程
+func liveThreads(threads []*Thread) []*Thread {
+	var live []*Thread
+	for _, t := range threads {
+		if !t.exited {
+			live = append(live, t)
+		}
+	}
+	return live
+}
+
+// ownerId 返回互斥锁 m 的持有者的线程 id，没有的话为 ""
+func ownerId(m *Mutex) string {
+	if m.Owner == nil {
+		return ""
+	}
+	return m.Owner.Id
+}
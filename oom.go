@@ -0,0 +1,231 @@
+package sham
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"sort"
+)
+
+// 耗尽了的内存资源：OOM killer 只会杀掉占着这种资源的进程，杀别的进程腾不出需要的内存
+const (
+	// OOMFrames 物理内存的页框：缺页时分配不到页框，又没有交换区可以换出
+	OOMFrames = "frames"
+	// OOMHeap 堆：Malloc 时堆上放不下
+	OOMHeap = "heap"
+	// OOMSegments 分段模式下的段内存：创建进程（或者 Exec）时 SegMem 放不下它的段
+	OOMSegments = "segments"
+)
+
+// OOMPolicy 是 OOM killer 选择牺牲者的策略：资源 resource（OOMFrames｜OOMHeap｜OOMSegments）耗尽时，从 candidates 中选出一个要杀掉的进程。
+// candidates 不会为空，都占着 resource，按就绪队列、阻塞队列、停止、新建、挂起的进程的顺序排列（见 liveProcs）。
+type OOMPolicy func(os *OS, resource string, candidates []*Process) *Process
+
+// OOMLargestResident 杀掉占用耗尽了的资源最多的进程：页框按在物理内存中的页算，堆按堆上的内存块算
+func OOMLargestResident(os *OS, resource string, candidates []*Process) *Process {
+	victim := candidates[0]
+	for _, p := range candidates[1:] {
+		if os.usageOf(p, resource) > os.usageOf(victim, resource) {
+			victim = p
+		}
+	}
+	return victim
+}
+
+// OOMLowestPrecedence 杀掉优先级最低的进程
+func OOMLowestPrecedence(os *OS, resource string, candidates []*Process) *Process {
+	victim := candidates[0]
+	for _, p := range candidates[1:] {
+		if p.Precedence < victim.Precedence {
+			victim = p
+		}
+	}
+	return victim
+}
+
+// OOMMostRecent 杀掉最后创建的进程
+func OOMMostRecent(os *OS, resource string, candidates []*Process) *Process {
+	victim := candidates[0]
+	for _, p := range candidates[1:] {
+		if p.seq > victim.seq {
+			victim = p
+		}
+	}
+	return victim
+}
+
+// residentSize 返回进程 p 在物理内存中的页占用的内存（字）
+func (os *OS) residentSize(p *Process) uint {
+	var n uint
+	for _, pte := range p.PageTable {
+		if pte.Present {
+			n += os.PhysMem.PageSize
+		}
+	}
+	return n
+}
+
+// memoryUsage 返回进程 p 占用的内存（字）：物理内存中的页（或者各段），加上堆上的内存块和挂接的共享内存段
+func (os *OS) memoryUsage(p *Process) uint {
+	return os.residentSize(p) + os.SegMem.Usage(p.Id) + os.Heap.Usage(p.Id) + os.shmUsage(p)
+}
+
+// usageOf 返回进程 p 占用的资源 resource（字）：页框是物理内存中的页，堆是堆上的内存块，段内存是它的各段
+func (os *OS) usageOf(p *Process, resource string) uint {
+	switch resource {
+	case OOMHeap:
+		return os.Heap.Usage(p.Id)
+	case OOMSegments:
+		return os.SegMem.Usage(p.Id)
+	}
+	return os.residentSize(p)
+}
+
+// freeOf 返回资源 resource 还空闲多少：页框是空闲页框数，堆和段内存是空闲的字数
+func (os *OS) freeOf(resource string) uint {
+	switch resource {
+	case OOMHeap:
+		return os.Heap.Stats().Free
+	case OOMSegments:
+		return os.SegMem.Stats().Free
+	}
+	return os.PhysMem.FreeFrames()
+}
+
+// localVictim 在进程 p 自己的页里选一个换出（内存配额用完时用），用时钟算法：
+// 按页号扫过去，访问位为 1 的清零放过，选第一个访问位为 0 的页。p 没有页在内存中时返回 false。
+func (os *OS) localVictim(p *Process) (frame uint, ok bool) {
+	var pages []uint
+	for page, pte := range p.PageTable {
+		if pte.Present {
+			pages = append(pages, page)
+		}
+	}
+	if len(pages) == 0 {
+		return 0, false
+	}
+	sort.Slice(pages, func(i, j int) bool { return pages[i] < pages[j] })
+
+	for _, page := range pages {
+		pte := p.PageTable[page]
+		if !pte.Referenced {
+			return pte.Frame, true
+		}
+		pte.Referenced = false // 第二次机会
+	}
+	return p.PageTable[pages[0]].Frame, true
+}
+
+// oomKill 资源 resource（OOMFrames｜OOMHeap｜OOMSegments）耗尽时由 os.OOMPolicy 选出一个进程杀掉，回收它的内存。
+// 候选者是没有线程在运行的、占用着 resource 的进程，不包括 requester（申请内存的进程）。
+// 没有可杀的进程，或者杀掉的进程没有腾出 resource（比如它的页框都和别的进程共用）时返回 false，
+// 调用者不用再重试分配了。
+func (os *OS) oomKill(requester *Process, resource string) bool {
+	os.ProcsMutex.RLock()
+	var candidates []*Process
+	for _, p := range os.liveProcs() {
+		if !p.idle && p != requester && p.owner() == p && !os.onCPU(p) && os.usageOf(p, resource) > 0 {
+			candidates = append(candidates, p)
+		}
+	}
+	os.ProcsMutex.RUnlock()
+
+	if len(candidates) == 0 {
+		log.WithField("requester", requester.Id).Error("[OS] OOM: out of memory and nothing to kill")
+		return false
+	}
+
+	victim := os.OOMPolicy(os, resource, candidates)
+	usage := os.usageOf(victim, resource)
+	log.WithFields(log.Fields{
+		"requester": requester.Id,
+		"resource":  resource,
+		"victim":    victim.Id,
+		"usage":     usage,
+	}).Warn("[OS] OOM: kill process")
+	os.Tracer.emit(Event{Type: EventOOMKill, Pid: victim.Id, Data: fmt.Sprintf("%s=%d", resource, usage)})
+
+	free := os.freeOf(resource)
+	os.kill(victim, ExitOOMKilled)
+	if os.freeOf(resource) <= free {
+		log.WithFields(log.Fields{
+			"requester": requester.Id,
+			"resource":  resource,
+			"victim":    victim.Id,
+		}).Error("[OS] OOM: killing the process freed nothing")
+		return false
+	}
+	return true
+}
+
+// kill 杀掉没在运行的进程 p（一般是就绪或阻塞的）：从所在的队列中删除，记下结束的原因，回收它的资源。
+// 和正常结束一样，父进程还在的话 p 变成僵尸进程，退出码为 ExitCodeKilled
+func (os *OS) kill(p *Process, reason string) {
+	os.killWithCode(p, reason, ExitCodeKilled)
+}
+
+// killWithCode 同 kill，退出码为 code。也可以杀掉停止、新建和挂起的进程。p 的线程随之结束。
+func (os *OS) killWithCode(p *Process, reason string, code int) {
+	os.ProcsMutex.Lock()
+	defer os.ProcsMutex.Unlock()
+
+	os.terminate(p, reason, code)
+}
+
+// terminate 同 killWithCode，返回是不是杀掉了 p（p 有线程在运行或者已经结束时杀不掉）。调用时要持有 os.ProcsMutex。
+func (os *OS) terminate(p *Process, reason string, code int) bool {
+	if os.onCPU(p) {
+		log.WithField("process", p.Id).Error("[OS] kill: cannot kill a running process")
+		return false
+	}
+	from, ok := os.dequeue(p)
+	if !ok {
+		log.WithField("process", p.Id).Error("[OS] kill: cannot kill a running or finished process")
+		return false
+	}
+
+	log.WithFields(log.Fields{
+		"process": p.Id,
+		"reason":  reason,
+	}).Info("[OS] kill")
+
+	p.ExitReason = reason
+	p.ExitCode = code
+	os.Metrics.kill(p, from, os.Clock.Now())
+	os.Metrics.exit(p, os.Clock.Now())
+
+	os.reclaim(p)
+	os.exited(p, from)
+	return true
+}
+
+// dequeue 把没在运行的进程 p 从它所在的队列中删除，返回它原来的状态。
+// p 在运行或者已经结束时返回 false。调用时要持有 os.ProcsMutex。
+func (os *OS) dequeue(p *Process) (from int, ok bool) {
+	switch p.Status {
+	case StatusReady:
+		os.ReadyProcs = withoutProcess(os.ReadyProcs, p)
+	case StatusBlocked:
+		os.BlockedProcs = withoutProcess(os.BlockedProcs, p)
+	case StatusStopped:
+		os.StoppedProcs = withoutProcess(os.StoppedProcs, p)
+	case StatusNew:
+		os.NewProcs = withoutProcess(os.NewProcs, p)
+	case StatusSuspendedReady:
+		os.SuspendedReadyProcs = withoutProcess(os.SuspendedReadyProcs, p)
+	case StatusSuspendedBlocked:
+		os.SuspendedBlockedProcs = withoutProcess(os.SuspendedBlockedProcs, p)
+	default:
+		return p.Status, false
+	}
+	return p.Status, true
+}
+
+// withoutProcess 从 procs 中删掉 p
+func withoutProcess(procs []*Process, p *Process) []*Process {
+	for i, q := range procs {
+		if q == p {
+			return append(procs[:i:i], procs[i+1:]...)
+		}
+	}
+	return procs
+}
@@ -1,7 +1,9 @@
 package sham
 
 import (
+	"fmt"
 	log "github.com/sirupsen/logrus"
+	"math/rand"
 	"sync"
 	"time"
 )
@@ -12,32 +14,144 @@ type OS struct {
 	CPU  CPU
 	Mem  Memory
 	Devs map[string]Device
-
-	ProcsMutex   sync.RWMutex
+	// PhysMem 是分页的物理内存，进程通过虚拟地址（Contextual.Load、Contextual.Store）访问
+	PhysMem *PhysicalMemory
+	// PageReplacer 是页面置换算法，物理内存满了以后用它选出要换出的页
+	PageReplacer PageReplacer
+	// CopyOnWrite fork 时父子进程先共用页框，谁写再给谁复制一份（默认）；
+	// 为 false 时 fork 立即复制所有的页。复制一页要花 PageCopyCost 个时钟周期。
+	CopyOnWrite  bool
+	PageCopyCost uint
+	// MemoryModel 内存模型：分页（MemoryPaged，默认）或者分段（MemorySegmented）。
+	// 要在创建进程之前设置。
+	MemoryModel string
+	// SegMem 是分段模式下的内存，进程的各段都从这里分配，SegmentSizes 是各段的大小。
+	// 共享内存段（不管是不是分段模式）也从这里分配
+	SegMem       *Heap
+	SegmentSizes [SegmentCount]uint
+	// Heap 是进程通过 Alloc、Free 系统调用动态申请的内存
+	Heap *Heap
+	// MemoryLimit 是 CreateProcess 创建的进程的默认内存配额（字），0 表示不限
+	MemoryLimit uint
+	// OOMPolicy 决定内存耗尽时 OOM killer 杀掉哪个进程
+	OOMPolicy OOMPolicy
+	// Shm 共享内存段，见 Shmget
+	Shm      map[string]*SharedSegment
+	ShmMutex sync.Mutex
+	// Sems 信号量，见 Semget。由 ProcsMutex 保护
+	Sems map[string]*Semaphore
+	// Mutexes 互斥锁，Conds 条件变量，见 Mutexget、Condget。由 ProcsMutex 保护
+	Mutexes map[string]*Mutex
+	Conds   map[string]*CondVar
+	// MonitorSemantics 条件变量的唤醒语义：MonitorMesa（默认，为空时也是）｜MonitorHoare
+	MonitorSemantics string
+	// Programs 注册的程序，Exec、Spawn 按名字装入，见 RegisterProgram
+	Programs map[string]Program
+
+	ProcsMutex sync.RWMutex
+	// Noop 这个 OS 的空闲进程：没有进程可以运行时 CPU 就跑它，不算作进程。见 newNoop
+	Noop *Process
+	// RunningProc 正在运行的进程，进程结束后为 nil
 	RunningProc  *Process
 	ReadyProcs   []*Process
 	BlockedProcs []*Process
-	Scheduler    Scheduler
+	// ZombieProcs 已经结束、等父进程 Wait 的进程，见 WaitPid
+	ZombieProcs []*Process
+	// StoppedProcs 被信号停止的进程，见 SendSignal。只剩下停止的进程时，调度器也会退出
+	StoppedProcs []*Process
+	// NewProcs 新建了还没被接纳的进程，SuspendedReadyProcs、SuspendedBlockedProcs 被挂起的进程。
+	// 见 MaxActive、SuspendProcess。只剩下挂起的进程时，调度器也会退出
+	NewProcs              []*Process
+	SuspendedReadyProcs   []*Process
+	SuspendedBlockedProcs []*Process
+	// MaxActive 最多有几个活跃的（没被挂起，也没结束的）进程，即多道程序的道数，0 表示不限。
+	// 超出的新进程留在 NewProcs 里，等有进程结束或者被挂起再接纳。1:1 模型下的线程也各算一个（见 ThreadCreate）
+	MaxActive uint
+	// ThreadModel 线程模型：内核级线程（ThreadsKernel，默认）或者用户级线程（ThreadsUser）。
+	// 要在创建进程之前设置。见 ThreadCreate
+	ThreadModel string
+	Scheduler   Scheduler
+
+	// waiting 正在 Wait 的进程：pid -> 等的子进程 pid（"" 表示任意一个）
+	waiting map[string]string
+
+	// procSeq 已经创建了多少个进程
+	procSeq uint
 
 	Interrupts []Interrupt
+	// delayed 是还没到时间的中断，见 raiseAfter
+	delayed []delayedInterrupt
+
+	// Clock 是系统时钟，决定一个时钟周期在现实中要走多久
+	Clock Clock
+	// Rand 随机数发生器，模拟中需要随机的地方都应该用它，这样给定种子就能重现
+	Rand *rand.Rand
+
+	// Metrics 记录调度数据，见 OS.Report
+	Metrics *Metrics
+	// Gantt 记录 CPU 占用的变化，可以导出甘特图
+	Gantt *Gantt
+	// Tracer 记录运行中发生的各种事件，可以导出成 JSON Lines，见 Replay
+	Tracer *Tracer
 }
 
 // NewOS 构建一个「操作系统」。
 // 新的操作系统有自己控制的 CPU、内存、IO 设备，
-// 包含一个 Noop 的进程表以及默认的 NoScheduler 调度器。
+// 包含一个 Noop 的进程表、默认的 NoScheduler 调度器，
+// 以及一个时钟周期为 1 秒的实时时钟（跑测试的话换成 NewVirtualClock() 会快很多）。
 func NewOS() *OS {
-	return &OS{
-		CPU: CPU{},
-		Mem: Memory{},
+	os := &OS{
+		CPU:          CPU{},
+		Mem:          Memory{},
+		PhysMem:      NewPhysicalMemory(DefaultFrames, DefaultPageSize),
+		PageReplacer: &FIFOReplacer{},
+		CopyOnWrite:  true,
+		PageCopyCost: DefaultPageCopyCost,
+		MemoryModel:  MemoryPaged,
+		ThreadModel:  ThreadsKernel,
+		SegMem:       NewHeap(DefaultSegMemSize, &FirstFit{}),
+		SegmentSizes: DefaultSegmentSizes,
+		Heap:         NewHeap(DefaultHeapSize, &FirstFit{}),
+		OOMPolicy:    OOMLargestResident,
+		Shm:          map[string]*SharedSegment{},
+		Sems:         map[string]*Semaphore{},
+		Mutexes:      map[string]*Mutex{},
+		Conds:        map[string]*CondVar{},
+		Programs:     map[string]Program{},
 		Devs: map[string]Device{
 			"stdout": NewStdOut(),
 			"stdin":  NewStdIn(),
+			"swap":   NewSwap("swap", NewMemorySwapStore()),
 		},
-		ReadyProcs:   []*Process{&Noop},
 		BlockedProcs: []*Process{},
 		Scheduler:    NoScheduler{},
+		waiting:      map[string]string{},
 		Interrupts:   []Interrupt{},
+		Clock:        NewRealClock(DefaultTickDuration),
+		Rand:         rand.New(rand.NewSource(time.Now().UnixNano())),
+		Metrics:      NewMetrics(),
+		Gantt:        NewGantt(),
 	}
+
+	os.Tracer = NewTracer(func() uint {
+		return os.Clock.Now()
+	})
+	os.CPU.Tracer = os.Tracer
+	os.Noop = os.newNoop()
+	os.ReadyProcs = []*Process{os.Noop}
+
+	return os
+}
+
+// SetDeterministic 把 OS 设为完全确定的模拟模式：
+// CPU 同步运行（调度器在自己的协程里一步步跑线程，不再和线程的协程赛跑），
+// 使用虚拟时钟，并用 seed 重置随机数发生器。
+// 这样，同样的进程加上同样的 seed，每次运行的事件顺序都完全一样。
+// 注意要在 Boot 之前调用，并且之后不要再换掉 Clock。
+func (os *OS) SetDeterministic(seed int64) {
+	os.CPU.Synchronous = true
+	os.Clock = NewVirtualClock()
+	os.Rand = rand.New(rand.NewSource(seed))
 }
 
 // Boot 启动操作系统。即启动操作系统的调度器。
@@ -52,6 +166,14 @@ func (os *OS) Boot() {
 	log.Info(field, "No process to run. Showdown OS.")
 }
 
+// Report 生成调度报告：每个进程的周转时间、等待时间、响应时间等，
+// 以及平均值、上下文切换次数、CPU 利用率和吞吐量。一般在 Boot 返回之后调用。
+func (os *OS) Report() Report {
+	r := os.Metrics.report(os.Clock.Now())
+	r.Heap = os.Heap.Stats()
+	return r
+}
+
 // HandleInterrupts 处理中断队列中的中断
 func (os *OS) HandleInterrupts() {
 	var i Interrupt
@@ -64,6 +186,7 @@ func (os *OS) HandleInterrupts() {
 		}).Info("[OS] Handle Interrupt")
 
 		i.Handler(os, i.Data)
+		os.Tracer.emit(Event{Type: EventInterruptHandled, Pid: i.Data.Pid, Interrupt: i.Typ})
 		os.clockTick()
 	}
 }
@@ -73,55 +196,133 @@ func (os *OS) HandleInterrupts() {
 // OSInterface 是操作系统暴露出来的「系统调用」接口
 type OSInterface interface {
 	CreateProcess(pid string, precedence uint, timeCost uint, runnable Runnable)
+	CreateProcessWithLimit(pid string, precedence uint, timeCost uint, memoryLimit uint, runnable Runnable)
+	CreateChild(thread *Thread, pid string, precedence uint, timeCost uint, runnable Runnable)
 	InterruptRequest(thread *Thread, typ string, channel chan interface{})
 	FindProcess(pid string) *Process
+	ReadMemory(thread *Thread, addr uint) (interface{}, bool)
+	WriteMemory(thread *Thread, addr uint, value interface{}) bool
+	Alloc(thread *Thread, size uint) (Handle, bool)
+	Free(thread *Thread, handle Handle) bool
+	ReadHeap(thread *Thread, handle Handle, offset uint) (interface{}, bool)
+	WriteHeap(thread *Thread, handle Handle, offset uint, value interface{}) bool
+	Shmget(thread *Thread, key string, size uint) bool
+	Shmat(thread *Thread, key string) bool
+	Shmdt(thread *Thread, key string) bool
+	Shmrm(thread *Thread, key string) bool
+	ReadShared(thread *Thread, key string, offset uint) (interface{}, bool)
+	WriteShared(thread *Thread, key string, offset uint, value interface{}) bool
+	Fork(thread *Thread) (pid string, ok bool)
+	Exec(thread *Thread, name string, args []string) bool
+	Spawn(pid string, precedence uint, name string, args []string) bool
+	SpawnChild(thread *Thread, pid string, precedence uint, name string, args []string) bool
+	WaitPid(thread *Thread, pid string) (child string, code int, ok bool)
+	Kill(thread *Thread, pid string, sig Signal) bool
+	SetSignalHandler(thread *Thread, sig Signal, handler SignalHandler) bool
+	IgnoreSignal(thread *Thread, sig Signal) bool
+	MaskSignals(thread *Thread, sigs []Signal)
+	UnmaskSignals(thread *Thread, sigs []Signal)
+	Suspend(thread *Thread, pid string) bool
+	Resume(thread *Thread, pid string) bool
+	ThreadCreate(thread *Thread, timeCost uint, runnable Runnable) string
+	ThreadJoin(thread *Thread, tid string) (code int, ok bool)
+	ThreadExit(thread *Thread, code int) int
+	Semget(thread *Thread, key string, value int, binary bool) bool
+	SemWait(thread *Thread, key string) bool
+	SemSignal(thread *Thread, key string) bool
+	Mutexget(thread *Thread, key string) bool
+	Condget(thread *Thread, key string) bool
+	Lock(thread *Thread, key string) bool
+	Unlock(thread *Thread, key string) bool
+	CondWait(thread *Thread, cond string, mutex string) bool
+	CondSignal(thread *Thread, cond string) bool
+	CondBroadcast(thread *Thread, cond string) bool
 
 	// 这个只是模拟的内部需要，不是真正意义上的系统调用。
 	clockTick()
+	// 这个也是：线程每条指令之前递送信号
+	deliverSignals(thread *Thread) int
 }
 
-// CreateProcess 创建一个进程，放到进程表里
+// CreateProcess 创建一个进程，放到进程表里。进程的内存配额为 os.MemoryLimit。
+// 这是给操作员用的：创建的进程是 init 的子进程，在进程里调用也一样。要创建自己的子进程用 CreateChild。
 func (os *OS) CreateProcess(pid string, precedence uint, timeCost uint, runnable Runnable) {
+	os.CreateProcessWithLimit(pid, precedence, timeCost, os.MemoryLimit, runnable)
+}
+
+// CreateProcessWithLimit 创建一个内存配额为 memoryLimit 个字的进程，放到进程表里。
+// memoryLimit 为 0 表示不限。创建的进程是 init 的子进程。
+func (os *OS) CreateProcessWithLimit(pid string, precedence uint, timeCost uint, memoryLimit uint, runnable Runnable) {
+	os.newProcess(InitPid, pid, precedence, timeCost, memoryLimit, runnable)
+}
+
+// CreateChild 系统调用：创建线程所在进程的子进程，内存配额为 os.MemoryLimit。见 CreateProcess
+func (os *OS) CreateChild(thread *Thread, pid string, precedence uint, timeCost uint, runnable Runnable) {
+	os.newProcess(thread.contextual.Process.Id, pid, precedence, timeCost, os.MemoryLimit, runnable)
+}
 
+// newProcess 创建进程 parent 的子进程，返回这个进程。进程先是新建状态，接纳（见 admit）后进入就绪队列。
+func (os *OS) newProcess(parent string, pid string, precedence uint, timeCost uint, memoryLimit uint, runnable Runnable) *Process {
 	// process
 	p := Process{
-		Id:         pid,
-		Precedence: precedence,
-		Devices:    map[string]Device{},
+		Id:          pid,
+		Precedence:  precedence,
+		Parent:      parent,
+		Devices:     map[string]Device{},
+		PageTable:   PageTable{},
+		Shm:         map[string]*SharedSegment{},
+		MemoryLimit: memoryLimit,
+	}
+
+	if os.MemoryModel == MemorySegmented {
+		os.allocSegments(&p)
+	}
+
+	// thread
+	main := os.newThread(&p, pid, timeCost, runnable)
+	p.Thread = main
+	p.Threads = []*Thread{main}
+	if os.ThreadModel == ThreadsUser {
+		// M:1：CPU 上跑的是用户级线程调度程序，由它来跑主线程和以后创建的线程
+		p.Thread = os.newThread(&p, pid, timeCost, os.userScheduler(&p))
 	}
 
+	// 进程表、os.Mem 可能正被别的进程（通过系统调用）和调度器改着
+	os.ProcsMutex.Lock()
+	defer os.ProcsMutex.Unlock()
+
+	p.seq = os.procSeq
+	os.procSeq += 1
+
 	// init mem
 	// give new process a var table
 	os.Mem = append(os.Mem, Object{
 		Pid:     pid,
 		Content: nil,
 	})
-
+	os.remapMemory() // append 可能换了底层数组
 	p.Memory = os.Mem[len(os.Mem)-1:]
 
-	// thread
-	p.Thread = &Thread{
-		runnable: runnable,
-		contextual: &Contextual{
-			Process: &p,
-			OS:      os,
-		},
-		remainingTime: timeCost,
-	}
+	// append to NewProcs, then admit it into ReadyProcs
+	p.Status = StatusNew
+	os.NewProcs = append(os.NewProcs, &p)
+	os.Metrics.arrive(&p, os.Clock.Now())
+	os.Tracer.emit(Event{Type: EventProcessCreated, Pid: pid})
+	os.admit()
 
-	// append to ReadyProcs
-	os.ReadyProcs = append(os.ReadyProcs, &p)
+	return &p
 }
 
-/// InterruptRequest 发出中断请求，阻塞当前进程
+// InterruptRequest 发出中断请求，阻塞发出请求的线程 thread（在进程里一般用 Contextual.InterruptRequest）
 func (os *OS) InterruptRequest(thread *Thread, typ string, channel chan interface{}) {
 	log.WithFields(log.Fields{
 		"thread":  thread,
 		"type":    typ,
 		"channel": channel,
 	}).Info("[OS] InterruptRequest")
-	i := GetInterrupt(thread.contextual.Process.Id, typ, channel)
+	i := GetInterrupt(thread.task.Id, typ, channel)
 	os.Interrupts = append(os.Interrupts, i)
+	os.Tracer.emit(Event{Type: EventInterruptRaised, Pid: i.Data.Pid, Interrupt: typ})
 	os.CPU.Cancel(StatusBlocked)
 }
 
@@ -130,10 +331,12 @@ func (os *OS) FindProcess(pid string) *Process {
 	os.ProcsMutex.Lock()
 	defer os.ProcsMutex.Unlock()
 
-	if pid == os.RunningProc.Id {
-		return os.RunningProc
-	}
-	for _, p := range append(os.ReadyProcs, os.BlockedProcs...) {
+	return os.lookup(pid)
+}
+
+// lookup 同 FindProcess，调用时要持有 os.ProcsMutex
+func (os *OS) lookup(pid string) *Process {
+	for _, p := range os.liveProcs() {
 		if p.Id == pid {
 			return p
 		}
@@ -141,19 +344,330 @@ func (os *OS) FindProcess(pid string) *Process {
 	return nil
 }
 
+// ReadMemory 读取线程所在进程的虚拟地址 addr 上的值。
+// 如果 addr 所在的页不在物理内存中，会发出缺页中断（阻塞当前进程）并返回 nil, false，
+// 缺页处理完后，这条指令会重新执行。
+// 分段模式下，越界访问会发出段错误中断（进程会被杀掉）并返回 nil, false。
+func (os *OS) ReadMemory(thread *Thread, addr uint) (interface{}, bool) {
+	if os.MemoryModel == MemorySegmented {
+		pa, ok := os.translateSegment(thread, addr, false)
+		if !ok {
+			return nil, false
+		}
+		os.SegMem.Lock()
+		defer os.SegMem.Unlock()
+		return os.SegMem.Cells[pa], true
+	}
+
+	pa, ok := os.translate(thread, addr, false)
+	if !ok {
+		return nil, false
+	}
+	return os.PhysMem.Cells[pa], true
+}
+
+// WriteMemory 把 value 写到线程所在进程的虚拟地址 addr。
+// 缺页、段错误时的行为同 ReadMemory，返回 false。
+func (os *OS) WriteMemory(thread *Thread, addr uint, value interface{}) bool {
+	if os.MemoryModel == MemorySegmented {
+		pa, ok := os.translateSegment(thread, addr, true)
+		if !ok {
+			return false
+		}
+		os.SegMem.Lock()
+		defer os.SegMem.Unlock()
+		os.SegMem.Cells[pa] = value
+		return true
+	}
+
+	pa, ok := os.translate(thread, addr, true)
+	if !ok {
+		return false
+	}
+	os.PhysMem.Cells[pa] = value
+	return true
+}
+
+// Alloc 在堆上给线程所在的进程分配 size 个字的内存，返回句柄。
+// 堆里放不下时返回 false（不会阻塞进程，由程序自己决定怎么办）。
+// 超出进程的内存配额也会失败；堆满了则先由 OOM killer 杀掉别的进程腾出地方。
+func (os *OS) Alloc(thread *Thread, size uint) (Handle, bool) {
+	proc := thread.contextual.Process
+	pid := proc.Id
+
+	if proc.MemoryLimit > 0 && os.memoryUsage(proc)+size > proc.MemoryLimit {
+		log.WithFields(log.Fields{
+			"pid":   pid,
+			"size":  size,
+			"limit": proc.MemoryLimit,
+		}).Warn("[OS] Alloc: memory limit exceeded")
+		return 0, false
+	}
+
+	handle, ok := os.Heap.Alloc(pid, size)
+	for !ok && size <= os.Heap.Stats().Size && os.oomKill(proc, OOMHeap) {
+		handle, ok = os.Heap.Alloc(pid, size)
+	}
+	if ok && proc.MemoryLimit > 0 && os.memoryUsage(proc) > proc.MemoryLimit {
+		// 实际分配的比申请的多（比如伙伴系统），超出了配额
+		os.Heap.Free(pid, handle)
+		handle, ok = 0, false
+	}
+
+	log.WithFields(log.Fields{
+		"pid":    pid,
+		"size":   size,
+		"handle": handle,
+		"ok":     ok,
+	}).Info("[OS] Alloc")
+	if ok {
+		os.Tracer.emit(Event{Type: EventHeapAlloc, Pid: pid, Data: fmt.Sprintf("handle=%d size=%d", handle, size)})
+	}
+
+	return handle, ok
+}
+
+// Free 释放线程所在进程在堆上的内存块 handle
+func (os *OS) Free(thread *Thread, handle Handle) bool {
+	pid := thread.contextual.Process.Id
+	ok := os.Heap.Free(pid, handle)
+
+	log.WithFields(log.Fields{
+		"pid":    pid,
+		"handle": handle,
+		"ok":     ok,
+	}).Info("[OS] Free")
+	if ok {
+		os.Tracer.emit(Event{Type: EventHeapFree, Pid: pid, Data: fmt.Sprintf("handle=%d", handle)})
+	}
+
+	return ok
+}
+
+// ReadHeap 读取线程所在进程的堆内存块 handle 中第 offset 个字。
+// handle 不属于这个进程或者越界时返回 nil, false。
+func (os *OS) ReadHeap(thread *Thread, handle Handle, offset uint) (interface{}, bool) {
+	return os.Heap.Load(thread.contextual.Process.Id, handle, offset)
+}
+
+// WriteHeap 把 value 写到线程所在进程的堆内存块 handle 中第 offset 个字
+func (os *OS) WriteHeap(thread *Thread, handle Handle, offset uint, value interface{}) bool {
+	return os.Heap.Store(thread.contextual.Process.Id, handle, offset, value)
+}
+
+// translate 把虚拟地址转换为物理地址，同时维护页表项的访问位、修改位。
+// 缺页（包括写一个写时复制的页）时发出缺页中断，并让当前指令在缺页处理后重新执行。
+func (os *OS) translate(thread *Thread, addr uint, write bool) (uint, bool) {
+	proc := thread.contextual.Process
+	page, offset := os.PhysMem.Split(addr)
+
+	pte, ok := proc.PageTable[page]
+	if ok && pte.Present && write && pte.CopyOnWrite && len(os.PhysMem.Users(pte.Frame)) == 1 {
+		pte.CopyOnWrite = false // 别的进程都不用这个页框了，不用复制
+	}
+	if !ok || !pte.Present || (write && pte.CopyOnWrite) {
+		os.Metrics.pageFault(proc, os.Clock.Now())
+
+		log.WithFields(log.Fields{
+			"pid":  thread.contextual.Process.Id,
+			"addr": addr,
+			"page": page,
+		}).Info("[OS] page fault")
+
+		ch := make(chan interface{}, 1)
+		ch <- page
+		os.InterruptRequest(thread, PageFaultInterrupt, ch)
+		thread.contextual.restart = true
+		return 0, false
+	}
+
+	pte.Referenced = true
+	if write {
+		pte.Dirty = true
+	}
+	os.PhysMem.References = append(os.PhysMem.References, PageRef{Pid: proc.Id, Page: page})
+	os.PageReplacer.accessed(pte.Frame)
+	os.Metrics.pageReference(proc, os.Clock.Now())
+
+	return pte.Frame*os.PhysMem.PageSize + offset, true
+}
+
+// swap 返回交换区设备，没有的话返回 nil
+func (os *OS) swap() *Swap {
+	s, _ := os.Devs["swap"].(*Swap)
+	return s
+}
+
+// evict 换出页框 frame 中的页：被写过的页写到交换区，页表项标为不在内存，释放页框。
+// 页框被几个进程共用（写时复制）的话，每个进程的页都要换出，各自在交换区里有一份。
+// 返回换出花费的时钟周期数。
+func (os *OS) evict(frame uint) (cost uint) {
+	users := os.PhysMem.Users(frame)
+	if len(users) == 0 {
+		return 0
+	}
+
+	for _, owner := range users {
+		log.WithFields(log.Fields{
+			"pid":   owner.Pid,
+			"page":  owner.Page,
+			"frame": frame,
+		}).Info("[OS] evict page")
+		os.Tracer.emit(Event{Type: EventPageEvicted, Pid: owner.Pid, Data: fmt.Sprint(owner.Page)})
+
+		p := os.FindProcess(owner.Pid)
+		if p == nil {
+			continue
+		}
+		pte, ok := p.PageTable[owner.Page]
+		if !ok {
+			continue
+		}
+		if swap := os.swap(); swap != nil && pte.Dirty {
+			if err := swap.SwapOut(owner.Pid, owner.Page, os.PhysMem.Page(frame)); err != nil {
+				log.WithError(err).Error("[OS] evict page: swap out failed, page content lost")
+			} else {
+				pte.Swapped = true
+				pte.Dirty = false
+				cost += swap.OutCost
+			}
+		}
+		pte.Present = false
+		pte.CopyOnWrite = false
+	}
+	os.PhysMem.Free(frame)
+	os.PageReplacer.freed(frame)
+
+	return cost
+}
+
+// allocFrame 给进程 p 的第 page 页分配一个页框，返回页框和为此换出别的页花费的时钟周期数。
+// 进程的内存配额用完了的话，只能换出它自己的页（配额连一页都放不下时进程被杀掉）；
+// 没有空闲页框时，由 os.PageReplacer 选出一页换出（被写过的页要写到交换区），
+// 没有交换区可以换出的话，内存就耗尽了，由 OOM killer 杀掉一个进程腾出页框。
+func (os *OS) allocFrame(p *Process, page uint) (frame uint, cost uint, ok bool) {
+	if p.MemoryLimit > 0 && os.residentSize(p)+os.PhysMem.PageSize > p.MemoryLimit {
+		victim, ok := os.localVictim(p)
+		if !ok {
+			log.WithFields(log.Fields{
+				"pid":   p.Id,
+				"limit": p.MemoryLimit,
+			}).Error("[OS] allocFrame: memory limit is smaller than a page")
+			os.kill(p, ExitMemoryLimit)
+			return 0, 0, false
+		}
+		cost += os.evict(victim)
+	}
+
+	owner := FrameOwner{Pid: p.Id, Page: page}
+	frame, ok = os.PhysMem.Alloc(owner)
+	for !ok && os.swap() == nil && os.oomKill(p, OOMFrames) {
+		frame, ok = os.PhysMem.Alloc(owner)
+	}
+	if !ok && os.PhysMem.Frames() > 0 {
+		cost += os.evict(os.PageReplacer.victim(os))
+		frame, ok = os.PhysMem.Alloc(owner)
+	}
+	return frame, cost, ok
+}
+
+// pagingDone 分页 IO 要花 cost 个时钟周期，完成后唤醒进程 pid
+func (os *OS) pagingDone(pid string, cost uint) {
+	if cost == 0 {
+		os.BlockedToReady(pid)
+		return
+	}
+	// 这里不能用 GetInterrupt：interrupts 表里的处理程序会调用本函数，会造成初始化循环
+	os.raiseAfter(cost, Interrupt{
+		Typ:     SwapDoneInterrupt,
+		Handler: HandleSwapDoneInterrupt,
+		Data:    InterruptData{Pid: pid},
+	})
+}
+
+// delayedInterrupt 是一个要在 Due 时刻才发出的中断
+type delayedInterrupt struct {
+	Due       uint
+	Interrupt Interrupt
+}
+
+// raiseAfter 在 ticks 个时钟周期之后发出中断 i，用来模拟要花时间的 IO（比如换页）。
+// 和 InterruptRequest 不同，这个中断不是由正在运行的进程发出的，不会打断 CPU：
+// 到时间后在时钟周期里直接处理（见 handleDueInterrupts），不等运行的进程离开 CPU。
+func (os *OS) raiseAfter(ticks uint, i Interrupt) {
+	os.delayed = append(os.delayed, delayedInterrupt{
+		Due:       os.Clock.Now() + ticks,
+		Interrupt: i,
+	})
+}
+
+// handleDueInterrupts 马上处理到时间了的延时中断。
+// 不能只放进中断队列：中断队列要等运行的进程离开 CPU 才处理，
+// 一个一直在算的进程会让等分页 IO 的进程一直阻塞下去。
+func (os *OS) handleDueInterrupts() {
+	now := os.Clock.Now()
+	var due []Interrupt
+	remaining := os.delayed[:0]
+	for _, d := range os.delayed {
+		if d.Due > now {
+			remaining = append(remaining, d)
+			continue
+		}
+		due = append(due, d.Interrupt)
+	}
+	os.delayed = remaining
+
+	for _, i := range due {
+		log.WithFields(log.Fields{
+			"type": i.Typ,
+			"data": i.Data,
+		}).Info("[OS] Handle delayed Interrupt")
+
+		os.Tracer.emit(Event{Type: EventInterruptRaised, Pid: i.Data.Pid, Interrupt: i.Typ})
+		i.Handler(os, i.Data)
+		os.Tracer.emit(Event{Type: EventInterruptHandled, Pid: i.Data.Pid, Interrupt: i.Typ})
+	}
+}
+
 // clockTick 时钟增长
 // 这里模拟需要，所以是软的实现，而不是真的"硬件"时钟。
+// 时间片（由调度器决定，见 TimeSlice）用尽，或者调度器要求抢占时，会发出时钟中断。
 func (os *OS) clockTick() {
 	os.CPU.Clock += 1
-	time.Sleep(time.Second)
-	if os.CPU.Clock%10 == 0 && os.RunningProc.Status == StatusRunning { // 时钟中断
+	os.Clock.Tick()
+	os.Tracer.emit(Event{Type: EventClockTick})
+	os.handleDueInterrupts()
+	if os.RunningProc == nil || os.RunningProc.Status != StatusRunning {
+		return
+	}
+
+	expired := os.CPU.Clock >= os.quantum()
+	if e, ok := os.Scheduler.(expirer); ok && expired {
+		e.expire(os, os.RunningProc)
+	}
+	preempt := false
+	if p, ok := os.Scheduler.(preemptor); ok {
+		preempt = p.preempt(os)
+	}
+	if expired || preempt { // 时钟中断：进程直接回到就绪队列，不经过阻塞（见 HandleClockInterrupt）
 		ch := make(chan interface{}, 1) // buffer 很重要！
-		os.InterruptRequest(os.RunningProc.Thread, ClockInterrupt, ch)
 		ch <- os.RunningProc
+		i := GetInterrupt(os.RunningProc.Id, ClockInterrupt, ch)
+		os.Interrupts = append(os.Interrupts, i)
+		os.Tracer.emit(Event{Type: EventInterruptRaised, Pid: i.Data.Pid, Interrupt: ClockInterrupt})
+		os.CPU.Cancel(StatusReady)
 		os.CPU.Clock = 0
 	}
 }
 
+// quantum 返回当前运行进程的时间片长度，由调度器决定
+func (os *OS) quantum() uint {
+	if s, ok := os.Scheduler.(timeSlicer); ok {
+		return s.quantum(os, os.RunningProc)
+	}
+	return TimeSlice{}.quantum(os, os.RunningProc)
+}
+
 /********* 👆 SYSTEM CALLS 👆 ***************/
 
 /********* 👇 进程状态转换 👇 ***************/
@@ -166,6 +680,9 @@ func (os *OS) RunningToBlocked() {
 	log.WithField("process", os.RunningProc).Info("[OS] RunningToBlocked")
 	os.RunningProc.Status = StatusBlocked
 	os.BlockedProcs = append(os.BlockedProcs, os.RunningProc)
+	os.Metrics.stop(os.RunningProc, StatusBlocked, os.Clock.Now())
+	os.Gantt.record(os.Clock.Now(), os.RunningProc, StatusRunning, StatusBlocked)
+	os.traceTransition(os.RunningProc, StatusRunning, StatusBlocked)
 
 	os.CPU.Unlock()
 }
@@ -178,21 +695,158 @@ func (os *OS) RunningToReady() {
 	log.WithField("process", os.RunningProc).Info("[OS] RunningToReady")
 	os.RunningProc.Status = StatusReady
 	os.ReadyProcs = append(os.ReadyProcs, os.RunningProc)
+	os.Metrics.stop(os.RunningProc, StatusReady, os.Clock.Now())
+	os.Gantt.record(os.Clock.Now(), os.RunningProc, StatusRunning, StatusReady)
+	os.traceTransition(os.RunningProc, StatusRunning, StatusReady)
+
+	os.CPU.Unlock()
+}
+
+// RunningToStopped 当前运行的进程被信号停止，并释放 CPU。1:1 模型下进程的别的线程也停下，见 stopTasks
+func (os *OS) RunningToStopped() {
+	os.ProcsMutex.Lock()
+	defer os.ProcsMutex.Unlock()
+
+	log.WithField("process", os.RunningProc).Info("[OS] RunningToStopped")
+	os.RunningProc.Status = StatusStopped
+	os.StoppedProcs = append(os.StoppedProcs, os.RunningProc)
+	os.Metrics.stop(os.RunningProc, StatusStopped, os.Clock.Now())
+	os.Gantt.record(os.Clock.Now(), os.RunningProc, StatusRunning, StatusStopped)
+	os.traceTransition(os.RunningProc, StatusRunning, StatusStopped)
+	os.stopTasks(os.RunningProc.owner())
 
 	os.CPU.Unlock()
 }
 
-// RunningToDone 把当前运行的进程标示成完成，并释放 CPU
+// RunningToSuspended 当前运行的进程被挂起（见 SuspendProcess）：换出它的页，变为就绪挂起，并释放 CPU
+func (os *OS) RunningToSuspended() {
+	os.ProcsMutex.Lock()
+	defer os.ProcsMutex.Unlock()
+
+	log.WithField("process", os.RunningProc).Info("[OS] RunningToSuspended")
+	os.RunningProc.Status = StatusSuspendedReady
+	os.SuspendedReadyProcs = append(os.SuspendedReadyProcs, os.RunningProc)
+	os.Metrics.stop(os.RunningProc, StatusSuspendedReady, os.Clock.Now())
+	os.Gantt.record(os.Clock.Now(), os.RunningProc, StatusRunning, StatusSuspendedReady)
+	os.traceTransition(os.RunningProc, StatusRunning, StatusSuspendedReady)
+	p := os.RunningProc.owner() // 1:1 模型下在运行的可能是别的线程，页是进程的
+	os.ProcsMutex.Unlock()
+
+	os.swapOutProcess(p)
+
+	os.ProcsMutex.Lock()
+	os.admit()
+
+	os.CPU.Unlock()
+}
+
+// RunningToDone 把当前运行的进程标示成完成，回收它的资源，并释放 CPU。
+// 父进程还在的话，进程变成僵尸进程（StatusZombie），等父进程 Wait，否则从进程表中删除。见 exited
+// 1:1 模型下结束的是别的线程（不是主线程）的话，只有这个线程结束，见 threadDone；
+// 除非它是递送了结束进程的信号结束的（见 deliverSignals），那样整个进程跟着结束。
 func (os *OS) RunningToDone() {
 	os.ProcsMutex.Lock()
 	defer os.ProcsMutex.Unlock()
 
 	log.WithField("process", os.RunningProc).Info("[OS] RunningToDone")
-	os.RunningProc.Status = StatusDone
+	os.Metrics.stop(os.RunningProc, StatusDone, os.Clock.Now())
+
+	if os.RunningProc.ExitReason == "" {
+		os.RunningProc.ExitReason = ExitNormal
+	}
+	os.Metrics.exit(os.RunningProc, os.Clock.Now())
+
+	var to int
+	if os.RunningProc.owner() != os.RunningProc { // 1:1 模型下别的线程结束，进程还在
+		to = os.threadDone(os.RunningProc)
+		if os.RunningProc.ExitReason == ExitSignaled { // 这个线程递送了结束进程的信号，整个进程结束
+			os.terminate(os.RunningProc.owner(), ExitSignaled, os.RunningProc.ExitCode)
+		}
+	} else {
+		os.reclaim(os.RunningProc)
+		to = os.exited(os.RunningProc, StatusRunning)
+	}
+	os.Gantt.record(os.Clock.Now(), os.RunningProc, StatusRunning, to)
+	os.RunningProc = nil
 
 	os.CPU.Unlock()
 }
 
+// remapMemory os.Mem 换了底层数组（append 扩容、reclaim 重建）后，
+// 让活着的进程的 Process.Memory 重新指向 os.Mem 里自己的对象，不然它们读写的是旧数组，和 os.Mem 对不上。
+// 调用时要持有 os.ProcsMutex。
+func (os *OS) remapMemory() {
+	index := map[string]int{}
+	for i, obj := range os.Mem {
+		index[obj.Pid] = i
+	}
+	procs := os.liveProcs()
+	if os.RunningProc != nil { // 刚离开 CPU、还没回到队列里的进程也要算上
+		procs = append(procs, os.RunningProc)
+	}
+	for _, p := range procs {
+		if i, ok := index[p.Id]; ok && p.owner() == p {
+			p.Memory = os.Mem[i : i+1]
+		}
+	}
+}
+
+// reclaim 回收结束了的进程 p 的资源：
+// os.Mem 中的对象、物理内存的页框和交换区中的页、各段、堆上的内存块，以及它持有的设备。
+// 挂接的共享内存段会解除挂接（最后一个挂接的进程结束时段被销毁）。
+// 设备只是从 p 身上摘下来，不会销毁：Pipe 可能还有别的进程在用，要销毁请用 DestroyPipeInterrupt。
+func (os *OS) reclaim(p *Process) {
+	if p.idle {
+		return
+	}
+
+	mem := Memory{}
+	for _, obj := range os.Mem {
+		if obj.Pid != p.Id {
+			mem = append(mem, obj)
+		}
+	}
+	os.Mem = mem
+	os.remapMemory()
+	p.Memory = nil
+
+	blocks := os.releaseImage(p)
+
+	for id := range p.Devices {
+		delete(p.Devices, id)
+	}
+
+	log.WithFields(log.Fields{
+		"pid":         p.Id,
+		"heap_blocks": blocks,
+	}).Info("[OS] reclaim process resources")
+}
+
+// releaseImage 释放进程 p 的地址空间：物理内存的页框和交换区中的页、各段、堆上的内存块，
+// 并解除挂接的共享内存段。返回释放的堆内存块数。进程结束（reclaim）和 Exec 时调用，调用时要持有 os.ProcsMutex。
+func (os *OS) releaseImage(p *Process) (blocks uint) {
+	swap := os.swap()
+	for page, pte := range p.PageTable {
+		if pte.Present && os.PhysMem.Unshare(pte.Frame, FrameOwner{Pid: p.Id, Page: page}) == 0 {
+			os.PageReplacer.freed(pte.Frame)
+		}
+		if pte.Swapped && swap != nil {
+			swap.Discard(p.Id, page)
+		}
+	}
+	p.PageTable = PageTable{}
+
+	blocks = os.Heap.FreeAll(p.Id)
+	os.SegMem.FreeAll(p.Id)
+	p.Segments = [SegmentCount]Segment{}
+
+	for key := range p.Shm {
+		os.shmdt(p, key)
+	}
+
+	return blocks
+}
+
 // ReadyToRunning 把就绪队列中的 pid 进程变成运行状态呀
 // 这个方法会引导 CPU 切换运行进程，并锁上 CPU
 func (os *OS) ReadyToRunning(pid string) {
@@ -210,6 +864,9 @@ func (os *OS) ReadyToRunning(pid string) {
 	os.ReadyProcs[key].Status = StatusRunning
 	os.RunningProc = os.ReadyProcs[key]
 	os.ReadyProcs = append(os.ReadyProcs[:key], os.ReadyProcs[key+1:]...) // 从就绪队列里删除
+	os.Metrics.dispatch(os.RunningProc, os.Clock.Now())
+	os.Gantt.record(os.Clock.Now(), os.RunningProc, StatusReady, StatusRunning)
+	os.traceTransition(os.RunningProc, StatusReady, StatusRunning)
 
 	os.CPU.Lock()
 
@@ -223,6 +880,27 @@ func (os *OS) BlockedToReady(pid string) {
 	os.ProcsMutex.Lock()
 	defer os.ProcsMutex.Unlock()
 
+	os.blockedToReady(pid)
+}
+
+// blockedToReady 同 BlockedToReady，调用时要持有 os.ProcsMutex。
+// 进程被挂起了的话（阻塞挂起），它等的事件发生后变成就绪挂起。
+func (os *OS) blockedToReady(pid string) {
+	for i, p := range os.SuspendedBlockedProcs {
+		if p.Id != pid {
+			continue
+		}
+		log.WithField("process", p).Info("[OS] SuspendedBlockedToSuspendedReady")
+
+		p.Status = StatusSuspendedReady
+		os.Metrics.leave(p, StatusSuspendedBlocked, os.Clock.Now())
+		os.traceTransition(p, StatusSuspendedBlocked, StatusSuspendedReady)
+
+		os.SuspendedReadyProcs = append(os.SuspendedReadyProcs, p)
+		os.SuspendedBlockedProcs = append(os.SuspendedBlockedProcs[:i], os.SuspendedBlockedProcs[i+1:]...)
+		return
+	}
+
 	key := -1
 	for i, p := range os.BlockedProcs {
 		if p.Id == pid {
@@ -237,9 +915,40 @@ func (os *OS) BlockedToReady(pid string) {
 	log.WithField("process", os.BlockedProcs[key]).Info("[OS] BlockedToReady")
 
 	os.BlockedProcs[key].Status = StatusReady
+	os.Metrics.wake(os.BlockedProcs[key], os.Clock.Now())
+	os.traceTransition(os.BlockedProcs[key], StatusBlocked, StatusReady)
 
 	os.ReadyProcs = append(os.ReadyProcs, os.BlockedProcs[key])                 // append BlockedProcs[key] into ReadyProcs
 	os.BlockedProcs = append(os.BlockedProcs[:key], os.BlockedProcs[key+1:]...) // Delete BlockedProcs[key]
 }
 
+// stoppedToReady 让停止的 pid 进程回到就绪队列，调用时要持有 os.ProcsMutex
+func (os *OS) stoppedToReady(pid string) {
+	for i, p := range os.StoppedProcs {
+		if p.Id != pid {
+			continue
+		}
+		log.WithField("process", p).Info("[OS] StoppedToReady")
+
+		p.Status = StatusReady
+		os.Metrics.leave(p, StatusStopped, os.Clock.Now())
+		os.traceTransition(p, StatusStopped, StatusReady)
+
+		os.ReadyProcs = append(os.ReadyProcs, p)
+		os.StoppedProcs = append(os.StoppedProcs[:i], os.StoppedProcs[i+1:]...)
+		return
+	}
+	log.WithField("pid", pid).Warn("[OS] StoppedToReady Failed: No such Stopped Process")
+}
+
+// traceTransition 记录一次进程状态转换事件
+func (os *OS) traceTransition(p *Process, from, to int) {
+	os.Tracer.emit(Event{
+		Type: EventTransition,
+		Pid:  p.Id,
+		From: StatusName(from),
+		To:   StatusName(to),
+	})
+}
+
 /********* 👆 进程状态转换 👆 ***************/
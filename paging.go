@@ -0,0 +1,185 @@
+package sham
+
+import (
+	"sync"
+)
+
+// 分页内存的默认大小
+const (
+	// DefaultPageSize 默认的页（页框）大小：一页有多少个字（一个字存一个 interface{} 值）
+	DefaultPageSize uint = 16
+	// DefaultFrames 默认的物理页框数
+	DefaultFrames uint = 64
+	// DefaultPageCopyCost 默认的复制一页所需的时钟周期数
+	DefaultPageCopyCost uint = 1
+)
+
+// PhysicalMemory 是模拟的分页「物理内存」：
+// 一共 len(Cells) 个字，按 PageSize 大小分成若干页框（frame），由 OS 分配给进程的虚拟页。
+// 和 Memory 那种无限大的「对象内存」不同，这里的容量是有限的。
+type PhysicalMemory struct {
+	sync.Mutex
+
+	PageSize uint
+	// Cells 是所有的存储单元，第 f 个页框是 Cells[f*PageSize : (f+1)*PageSize]
+	Cells []interface{}
+	// Owners 记录每个页框装的是哪个进程的哪一页，空闲页框为 nil
+	Owners []*FrameOwner
+	// Sharers 记录写时复制（fork）后和 Owners 共用同一个页框的其他进程的页
+	Sharers [][]FrameOwner
+	// References 是访问串：按顺序记录每一次访存访问的（进程, 虚拟页），可以交给 OPTReplacer
+	References []PageRef
+
+	free []uint
+}
+
+// FrameOwner 是一个页框的主人：进程 Pid 的第 Page 个虚拟页
+type FrameOwner struct {
+	Pid  string
+	Page uint
+}
+
+// NewPhysicalMemory 新建一个有 frames 个页框、页大小为 pageSize 的物理内存
+func NewPhysicalMemory(frames uint, pageSize uint) *PhysicalMemory {
+	m := &PhysicalMemory{
+		PageSize: pageSize,
+		Cells:    make([]interface{}, frames*pageSize),
+		Owners:   make([]*FrameOwner, frames),
+		Sharers:  make([][]FrameOwner, frames),
+	}
+	for f := uint(0); f < frames; f++ {
+		m.free = append(m.free, f)
+	}
+	return m
+}
+
+// Frames 返回页框总数
+func (m *PhysicalMemory) Frames() uint {
+	return uint(len(m.Owners))
+}
+
+// FreeFrames 返回空闲页框数
+func (m *PhysicalMemory) FreeFrames() uint {
+	m.Lock()
+	defer m.Unlock()
+	return uint(len(m.free))
+}
+
+// Alloc 分配一个空闲页框给 owner，并把其内容清空。没有空闲页框时返回 false。
+func (m *PhysicalMemory) Alloc(owner FrameOwner) (frame uint, ok bool) {
+	m.Lock()
+	defer m.Unlock()
+
+	if len(m.free) == 0 {
+		return 0, false
+	}
+	frame, m.free = m.free[0], m.free[1:]
+	m.Owners[frame] = &owner
+	for i := frame * m.PageSize; i < (frame+1)*m.PageSize; i++ {
+		m.Cells[i] = nil
+	}
+	return frame, true
+}
+
+// Free 释放页框 frame
+func (m *PhysicalMemory) Free(frame uint) {
+	m.Lock()
+	defer m.Unlock()
+
+	if m.Owners[frame] == nil {
+		return
+	}
+	m.Owners[frame] = nil
+	m.Sharers[frame] = nil
+	m.free = append(m.free, frame)
+}
+
+// Users 返回使用页框 frame 的所有进程的页：主人在前，然后是共用者
+func (m *PhysicalMemory) Users(frame uint) []FrameOwner {
+	m.Lock()
+	defer m.Unlock()
+
+	if m.Owners[frame] == nil {
+		return nil
+	}
+	return append([]FrameOwner{*m.Owners[frame]}, m.Sharers[frame]...)
+}
+
+// Share 让 user 和页框 frame 的主人共用这个页框
+func (m *PhysicalMemory) Share(frame uint, user FrameOwner) {
+	m.Lock()
+	defer m.Unlock()
+
+	m.Sharers[frame] = append(m.Sharers[frame], user)
+}
+
+// Unshare user 不再使用页框 frame，返回还有几个进程在用它。没有人用了，页框就被释放。
+// user 是主人的话，由第一个共用者接替。
+func (m *PhysicalMemory) Unshare(frame uint, user FrameOwner) int {
+	m.Lock()
+	defer m.Unlock()
+
+	if m.Owners[frame] == nil {
+		return 0
+	}
+
+	sharers := m.Sharers[frame]
+	if *m.Owners[frame] == user {
+		if len(sharers) == 0 {
+			m.Owners[frame] = nil
+			m.free = append(m.free, frame)
+			return 0
+		}
+		next := sharers[0]
+		m.Owners[frame], sharers = &next, sharers[1:]
+	} else {
+		for i, s := range sharers {
+			if s == user {
+				sharers = append(sharers[:i:i], sharers[i+1:]...)
+				break
+			}
+		}
+	}
+	m.Sharers[frame] = sharers
+	return 1 + len(sharers)
+}
+
+// Page 返回页框 frame 的内容（一份拷贝）
+func (m *PhysicalMemory) Page(frame uint) []interface{} {
+	m.Lock()
+	defer m.Unlock()
+
+	return append([]interface{}{}, m.Cells[frame*m.PageSize:(frame+1)*m.PageSize]...)
+}
+
+// SetPage 把 data 写进页框 frame
+func (m *PhysicalMemory) SetPage(frame uint, data []interface{}) {
+	m.Lock()
+	defer m.Unlock()
+
+	copy(m.Cells[frame*m.PageSize:(frame+1)*m.PageSize], data)
+}
+
+// PageTableEntry 是页表项
+type PageTableEntry struct {
+	// Frame 页所在的页框，Present 为 false 时无意义
+	Frame uint
+	// Present 页是否在物理内存中
+	Present bool
+	// Referenced 页最近被访问过
+	Referenced bool
+	// Dirty 页被写过：换出时要写回交换区
+	Dirty bool
+	// Swapped 交换区里有这一页的内容：换入时要从交换区读回来
+	Swapped bool
+	// CopyOnWrite 页框和别的进程共用（fork 之后），写的时候要先复制一份
+	CopyOnWrite bool
+}
+
+// PageTable 是进程的页表：虚拟页号 -> 页表项
+type PageTable map[uint]*PageTableEntry
+
+// Split 把虚拟地址 addr 拆成虚拟页号和页内偏移
+func (m *PhysicalMemory) Split(addr uint) (page uint, offset uint) {
+	return addr / m.PageSize, addr % m.PageSize
+}
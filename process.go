@@ -9,20 +9,34 @@ import (
 
 // Runnable 程序：应用程序的具体的代码就写在这里面
 // 每一次返回就代表“一条指令”（一个原子操作）执行完毕，返回值为状态：
-//  - StatusRunning 继续运行（如果时间片未用尽）
-//  - StatusReady 会进入就绪队列（即 yield，主动让出 CPU）
-//  - StatusBlocked 会进入阻塞状态（无法恢复，所以一般不用。需要阻塞时一般通过中断请求）
-//  - StatusDone 进程运行结束。
+//   - StatusRunning 继续运行（如果时间片未用尽）
+//   - StatusReady 会进入就绪队列（即 yield，主动让出 CPU）
+//   - StatusBlocked 会进入阻塞状态（无法恢复，所以一般不用。需要阻塞时一般通过中断请求）
+//   - StatusDone 进程运行结束（退出码为 Process.ExitCode，默认 0，见 Contextual.Exit）。
 type Runnable func(contextual *Contextual) int
 
 // Thread 线程：是一个可以在 CPU 里跑的东西。
+// 一个进程可以有多个线程（见 ThreadCreate），它们共用进程的内存和设备，各自有自己的 Contextual（PC）。
 type Thread struct {
+	// Id 线程 id：主线程的是进程的 pid，别的线程是 "pid.t1" 这样的
+	Id string
 	// runnable 是实际要运行的内容，应该自己在内部保存状态。
 	runnable Runnable
 	// contextual 是 Thread 的环境
 	contextual *Contextual
-	// 预计剩余时间
+	// 预计剩余时间，SJF、SRTF 等调度器依此决策。
+	// 每执行一条指令减一，超出预计时保持为 0。
 	remainingTime uint
+
+	// task 是调度这个线程的内核调度实体，即进程表里的一项：
+	// 主线程的是进程自己；1:1 模型下别的线程在进程表里各有一项；M:1 模型下所有线程都映射到进程上。见 OS.ThreadModel
+	task *Process
+	// exited 线程已经结束，exitCode 是它的退出码，等别的线程 ThreadJoin 来拿
+	exited   bool
+	exitCode int
+	// joining 线程正在 ThreadJoin 的线程（M:1 模型下用），joiners 正在 ThreadJoin 这个线程的线程
+	joining *Thread
+	joiners []*Thread
 }
 
 // Run 包装并运行 Thread 的 runnable。
@@ -34,31 +48,57 @@ func (t *Thread) Run() (done chan int, cancel context.CancelFunc) {
 
 	_ctx, cancel := context.WithCancel(context.Background())
 
-	go func() {
-		for { // 一条条代码不停跑，直到阻塞｜退出｜被取消
-			select {
-			case <-_ctx.Done(): // 被取消，取消由 CPU 发起
-				// 取消时 CPU 会临时置 Status 为需要转到的状态，
-				// 这里获取并把这个值传给操作系统
-				// 同时把状态重置为 StatusRunning
-				// （真正的状态转化需由操作系统完成，这里只是暂时借用了这个值，故要还原）
-				log.WithField("process", t.contextual.Process).Info("Thread Run Cancel")
-				s := t.contextual.Process.Status
-				t.contextual.Process.Status = StatusRunning
-				done <- s
-				return
-			default:
-				ret := t.runnable(t.contextual)
-				t.contextual.Commit()
-				if ret != StatusRunning { // 结束了，交给调度器处理
-					done <- ret
+	go t.exec(_ctx, done)
+
+	return done, cancel
+}
+
+// Prepare 和 Run 类似，但不会在新的协程中运行 runnable，
+// 而是返回 exec，由调用者自己在需要的时候同步调用：
+// exec 把 runnable 跑到停下后返回，状态会放在 done 中（done 有 buffer，不会阻塞）。
+func (t *Thread) Prepare() (done chan int, cancel context.CancelFunc, exec func()) {
+	done = make(chan int, 1)
+
+	_ctx, cancel := context.WithCancel(context.Background())
+
+	exec = func() {
+		t.exec(_ctx, done)
+	}
+
+	return done, cancel, exec
+}
+
+// exec 一条条代码不停跑，直到阻塞｜退出｜被取消，然后把状态发给 done
+func (t *Thread) exec(_ctx context.Context, done chan int) {
+	for {
+		select {
+		case <-_ctx.Done(): // 被取消，取消由 CPU 发起
+			// 取消时 CPU 会临时置 Status 为需要转到的状态，
+			// 这里获取并把这个值传给操作系统
+			// 同时把状态重置为 StatusRunning
+			// （真正的状态转化需由操作系统完成，这里只是暂时借用了这个值，故要还原）
+			log.WithField("process", t.task).Info("Thread Run Cancel")
+			s := t.task.Status
+			t.task.Status = StatusRunning
+			done <- s
+			return
+		default:
+			if c := t.contextual; c.OS != nil && c.Process != nil && t == t.task.Thread {
+				// 先递送未决的信号（信号发给进程，由进程里接下来上 CPU 的内核线程递送：
+				// 1:1 模型下可能是任何一个线程，M:1 模型下是跑用户级线程调度程序的那个），可能因此结束或者停止
+				if s := c.OS.deliverSignals(t); s != StatusRunning {
+					done <- s
 					return
 				}
 			}
+			ret := t.runnable(t.contextual)
+			t.contextual.Commit()
+			if ret != StatusRunning { // 结束了，交给调度器处理
+				done <- ret
+				return
+			}
 		}
-	}()
-
-	return done, cancel
+	}
 }
 
 // 进程的状态
@@ -67,39 +107,133 @@ const (
 	StatusReady   = 0
 	StatusRunning = 1
 	StatusDone    = 2
+	// StatusZombie 进程已经结束，资源都回收了，但父进程还没有 Wait 它，要留着退出码
+	StatusZombie = 3
+	// StatusStopped 进程被信号停止了（SIGSTOP），收到 SIGCONT 才回到就绪队列
+	StatusStopped = 4
+	// StatusNew 进程刚创建，还没被接纳进就绪队列，见 OS.MaxActive
+	StatusNew = 5
+	// StatusSuspendedReady、StatusSuspendedBlocked 进程被挂起（换出到交换区），
+	// 挂起前分别是就绪（或运行）、阻塞的。见 OS.SuspendProcess
+	StatusSuspendedReady   = 6
+	StatusSuspendedBlocked = 7
 )
 
+// statusNames 是进程状态的名字
+var statusNames = map[int]string{
+	StatusBlocked: "blocked",
+	StatusReady:   "ready",
+	StatusRunning: "running",
+	StatusDone:    "done",
+	StatusZombie:  "zombie",
+	StatusStopped: "stopped",
+	StatusNew:     "new",
+
+	StatusSuspendedReady:   "suspended-ready",
+	StatusSuspendedBlocked: "suspended-blocked",
+}
+
+// StatusName 返回进程状态的名字，如 StatusReady 的名字是 "ready"
+func StatusName(status int) string {
+	if name, ok := statusNames[status]; ok {
+		return name
+	}
+	return fmt.Sprintf("status(%d)", status)
+}
+
 // Process 进程：一个可运行（其中的 Thread 可以运行），集合了资源的东西。
-// 为了简化设计，一个 Process 只能持有且必须持有一个 Thread。
+// Process 持有一个由调度器调度、在 CPU 上跑的 Thread；进程的所有线程在 Threads 里。
+// 1:1 模型下别的线程在进程表里各占一项（也是一个 Process），它们的 Thread 的 Contextual.Process 指向所在的进程。
 type Process struct {
 	Id string
 	// Precedence 优先级，数字越大越优先
 	Precedence uint
-	Thread     *Thread
-	Memory     Memory
-	Devices    map[string]Device
-	// Status 状态：one of -1, 0, 1, 2 分别代表 阻塞，就绪，运行，已结束
+	// Quantum 时间片长度，0 表示由调度器决定。见 TimeSlice
+	Quantum uint
+	// Thread 调度器调度的线程：一般就是主线程；M:1 模型下是运行用户级线程调度程序的内核线程
+	Thread *Thread
+	// Threads 进程的所有线程（还没被 ThreadJoin 回收的），主线程在最前面
+	Threads []*Thread
+	Memory  Memory
+	// PageTable 页表，虚拟地址经由它映射到 OS.PhysMem
+	PageTable PageTable
+	// Segments 段寄存器，分段模式下虚拟地址经由它映射到 OS.SegMem
+	Segments [SegmentCount]Segment
+	Devices  map[string]Device
+	// Shm 挂接的共享内存段
+	Shm map[string]*SharedSegment
+	// Status 状态：one of -1, 0, 1, 2, 3, 4, 5, 6, 7 分别代表 阻塞，就绪，运行，已结束，僵尸，停止，新建，就绪挂起，阻塞挂起
 	Status int
+
+	// MemoryLimit 内存配额：最多能占用多少个字（物理内存中的页，加上堆上的内存块），0 表示不限
+	MemoryLimit uint
+	// ExitReason 进程结束的原因，见 ExitNormal 等
+	ExitReason string
+	// ExitCode 退出码，父进程 Wait 时拿到。被杀掉的进程为 ExitCodeKilled
+	ExitCode int
+
+	// Parent 父进程的 pid：创建它（CreateProcess、Spawn、Fork）的进程，
+	// 由操作员在进程外创建的，以及父进程先结束了的（孤儿进程），父进程是 InitPid
+	Parent string
+	// Program 进程运行的程序名，见 OS.Exec。直接用 Runnable 创建的进程为空
+	Program string
+
+	// PendingSignals 已经发出、还没递送的信号；SignalMask 被屏蔽（暂不递送）的信号
+	PendingSignals SignalSet
+	SignalMask     SignalSet
+	// SignalHandlers 注册了处理程序的信号，IgnoredSignals 忽略的信号，其余的信号执行默认动作。见 OS.SendSignal
+	SignalHandlers map[Signal]SignalHandler
+	IgnoredSignals SignalSet
+
+	// seq 进程是第几个创建的
+	seq uint
+	// threadSeq 进程已经创建了多少个线程（不算主线程）
+	threadSeq uint
+	// idle 是 OS 的 Noop 进程（见 OS.newNoop），不算作进程
+	idle bool
 }
 
+// 进程结束的原因
+const (
+	// ExitNormal 进程自己运行结束
+	ExitNormal = "exit"
+	// ExitOOMKilled 内存耗尽，被 OOM killer 杀掉
+	ExitOOMKilled = "oom-killed"
+	// ExitMemoryLimit 内存配额连一页都放不下，无法运行
+	ExitMemoryLimit = "memory-limit"
+	// ExitSegmentationFault 分段模式下访问越界，被杀掉
+	ExitSegmentationFault = "segmentation-fault"
+	// ExitSignaled 被信号结束，退出码为 128 + 信号编号
+	ExitSignaled = "signaled"
+)
+
+// ExitCodeKilled 是被操作系统杀掉的进程的退出码
+const ExitCodeKilled = -1
+
 // TODO: Contextual.Commit: after a time_cost (an operation): remainingTime--, schedule.
 
 // Contextual 上下文：线程的上下文。
 // 其实就是包含一个指向 Process 的指针。
 // 后面还可以往这里加东西：用来保存各种值。
 type Contextual struct {
+	// Process 线程所在的进程
 	Process *Process
+	// thread 是这个上下文所属的线程，系统调用以它的名义发起
+	thread *Thread
 	// 通过 Contextual.OS.XX 调系统调用
 	OS OSInterface
 	// 程序计数器
 	PC uint
+	// restart 当前指令因缺页没能完成，提交时不前进 PC，下次重新执行这条指令
+	restart bool
+	// forked 这是 fork 出来的子进程，还没有从 Fork 返回
+	forked bool
+	// replaced 当前指令里 Exec 换了程序，提交时 PC 回到 0，从新程序的第一条指令开始
+	replaced bool
 }
 
 func (c *Contextual) Commit() {
-	c.PC += 1
-	if c.Process != nil {
-		c.Process.Thread.remainingTime -= 1
-	}
+	c.advance()
 	if c.OS != nil {
 		c.OS.clockTick()
 	} else {
@@ -108,6 +242,38 @@ func (c *Contextual) Commit() {
 	}
 }
 
+// InterruptRequest 以这个上下文所属的线程的名义发出中断请求，阻塞这个线程（M:1 模型下是整个进程），见 OS.InterruptRequest。
+// 不要用 contextual.OS.InterruptRequest(contextual.Process.Thread, ...)：Process.Thread 是主线程，
+// 在别的线程里这样写阻塞的是主线程，中断处理完唤醒的也是主线程。
+func (c *Contextual) InterruptRequest(typ string, channel chan interface{}) {
+	c.OS.InterruptRequest(c.thread, typ, channel)
+}
+
+// advance 提交一条指令，不走时钟：前进 PC；重新执行的指令 PC 不变，换了程序的 PC 回到 0
+func (c *Contextual) advance() {
+	if c.replaced {
+		c.replaced = false
+		c.PC = 0
+	} else if c.restart {
+		c.restart = false
+	} else {
+		c.PC += 1
+		c.consume()
+	}
+}
+
+// consume 完成了一条指令，预计剩余时间减一
+func (c *Contextual) consume() {
+	if c.Process != nil && c.thread != nil {
+		if c.thread.remainingTime > 0 {
+			c.thread.remainingTime -= 1
+		} else {
+			// 跑得比预计的久：剩余时间停在 0，而不是 uint 下溢成一个巨大的数
+			log.WithField("process", c.Process.Id).Debug("Commit: process outruns its estimated time cost")
+		}
+	}
+}
+
 // 👇VAR POOL👇
 // 由于放变量是最常用的使用内存的方式，所以这里提供一组方法来方便变量的使用。
 // 这里所谓的变量池是放在 Process.Memory[0] 的一个 map[string]interface{}
@@ -175,24 +341,293 @@ func (c *Contextual) SetVar(name string, value interface{}) bool {
 
 // 👆VAR POOL👆
 
-// Noop 是一个基本的进程，运行时会使用 fmt.Println 打印 "no-op"。
+// 👇VIRTUAL MEMORY👇
+// 通过虚拟地址读写分页内存（OS.PhysMem），分段模式下读写 OS.SegMem，地址用 SegAddr 得到。
+// 访问的页不在内存中时会缺页：进程被阻塞，OS 处理完缺页中断后，这条指令会从头重新执行。
+// 所以 Load、Store 最好放在一条指令（一次 runnable 返回）的开头，或者保证这条指令重复执行也没关系。
+
+// Load 读取虚拟地址 addr 上的值，缺页时返回 nil, false
+func (c *Contextual) Load(addr uint) (interface{}, bool) {
+	return c.OS.ReadMemory(c.thread, addr)
+}
+
+// Store 把 value 写到虚拟地址 addr，缺页时返回 false
+func (c *Contextual) Store(addr uint, value interface{}) bool {
+	return c.OS.WriteMemory(c.thread, addr, value)
+}
+
+// 👆VIRTUAL MEMORY👆
+
+// 👇HEAP👇
+// 在堆（OS.Heap）上动态申请内存，通过句柄读写。
+
+// Malloc 申请 size 个字的内存，堆里放不下时返回 false
+func (c *Contextual) Malloc(size uint) (Handle, bool) {
+	return c.OS.Alloc(c.thread, size)
+}
+
+// Free 释放 Malloc 申请的内存
+func (c *Contextual) Free(handle Handle) bool {
+	return c.OS.Free(c.thread, handle)
+}
+
+// HeapLoad 读取内存块 handle 中第 offset 个字
+func (c *Contextual) HeapLoad(handle Handle, offset uint) (interface{}, bool) {
+	return c.OS.ReadHeap(c.thread, handle, offset)
+}
+
+// HeapStore 把 value 写到内存块 handle 中第 offset 个字
+func (c *Contextual) HeapStore(handle Handle, offset uint, value interface{}) bool {
+	return c.OS.WriteHeap(c.thread, handle, offset, value)
+}
+
+// 👆HEAP👆
+
+// 👇FORK👇
+
+// Fork 复制当前进程，创建一个子进程，见 OS.Fork。
+// 父进程得到子进程的 pid，子进程得到 ""。失败时返回 false。
+func (c *Contextual) Fork() (pid string, ok bool) {
+	return c.OS.Fork(c.thread)
+}
+
+// CreateChild 创建一个运行 runnable 的子进程，见 OS.CreateChild。
+// 用 contextual.OS.CreateProcess 创建的进程不是子进程，是 init 的。
+func (c *Contextual) CreateChild(pid string, precedence uint, timeCost uint, runnable Runnable) {
+	c.OS.CreateChild(c.thread, pid, precedence, timeCost, runnable)
+}
+
+// 👆FORK👆
+
+// 👇WAIT👇
+// 进程结束后变成僵尸进程，等父进程用 Wait 拿走退出码，见 OS.WaitPid。
+
+// Exit 设置退出码，返回 StatusDone：用法是 return contextual.Exit(code)
+func (c *Contextual) Exit(code int) int {
+	c.Process.ExitCode = code
+	return StatusDone
+}
+
+// Wait 等任意一个子进程结束，返回它的 pid 和退出码。
+// 没有已经结束的子进程时会阻塞，子进程结束后这条指令重新执行；没有子进程时返回 false，不会阻塞。
+func (c *Contextual) Wait() (pid string, code int, ok bool) {
+	return c.OS.WaitPid(c.thread, "")
+}
+
+// WaitPid 等子进程 pid 结束，返回它的退出码，用法同 Wait
+func (c *Contextual) WaitPid(pid string) (code int, ok bool) {
+	_, code, ok = c.OS.WaitPid(c.thread, pid)
+	return code, ok
+}
+
+// 👆WAIT👆
+
+// 👇SIGNAL👇
+// 信号的发送和处理，见 OS.SendSignal。SIGKILL 和 SIGSTOP 不能被捕获、忽略或者屏蔽。
+
+// Kill 给进程 pid 发送信号 sig
+func (c *Contextual) Kill(pid string, sig Signal) bool {
+	return c.OS.Kill(c.thread, pid, sig)
+}
+
+// Signal 注册信号 sig 的处理程序，handler 为 nil 时恢复默认动作，见 OS.SetSignalHandler
+func (c *Contextual) Signal(sig Signal, handler SignalHandler) bool {
+	return c.OS.SetSignalHandler(c.thread, sig, handler)
+}
+
+// IgnoreSignal 忽略信号 sig
+func (c *Contextual) IgnoreSignal(sig Signal) bool {
+	return c.OS.IgnoreSignal(c.thread, sig)
+}
+
+// MaskSignals 屏蔽信号：屏蔽期间收到的信号留在未决信号里，解除屏蔽后再递送
+func (c *Contextual) MaskSignals(sigs ...Signal) {
+	c.OS.MaskSignals(c.thread, sigs)
+}
+
+// UnmaskSignals 解除对信号的屏蔽
+func (c *Contextual) UnmaskSignals(sigs ...Signal) {
+	c.OS.UnmaskSignals(c.thread, sigs)
+}
+
+// 👆SIGNAL👆
+
+// 👇EXEC👇
+
+// Exec 把当前进程的程序换成注册在 OS 上的程序 name，见 OS.Exec。
+// 成功后这条指令返回时就换成了新程序；没有这个程序时返回 false。
+func (c *Contextual) Exec(name string, args ...string) bool {
+	return c.OS.Exec(c.thread, name, args)
+}
+
+// Spawn 创建一个运行程序 name 的子进程，见 OS.SpawnChild
+func (c *Contextual) Spawn(pid string, precedence uint, name string, args ...string) bool {
+	return c.OS.SpawnChild(c.thread, pid, precedence, name, args)
+}
+
+// 👆EXEC👆
+
+// 👇SUSPEND👇
+// 中程调度：挂起、激活进程，见 OS.SuspendProcess、OS.ResumeProcess。
+
+// Suspend 挂起进程 pid，可以是自己：挂起自己的话这条指令完成后就离开 CPU，等别的进程 Resume
+func (c *Contextual) Suspend(pid string) bool {
+	return c.OS.Suspend(c.thread, pid)
+}
+
+// Resume 激活挂起的进程 pid
+func (c *Contextual) Resume(pid string) bool {
+	return c.OS.Resume(c.thread, pid)
+}
+
+// 👆SUSPEND👆
+
+// 👇THREAD👇
+// 进程里的多个线程，共用进程的内存和设备，见 OS.ThreadCreate。
+
+// Tid 返回当前线程的 id，主线程的就是进程的 pid
+func (c *Contextual) Tid() string {
+	return c.thread.Id
+}
+
+// ThreadCreate 在当前进程里创建一个运行 runnable 的线程，预计运行时间为 timeCost，返回线程 id
+func (c *Contextual) ThreadCreate(timeCost uint, runnable Runnable) string {
+	return c.OS.ThreadCreate(c.thread, timeCost, runnable)
+}
+
+// ThreadJoin 等线程 tid 结束，拿到它的退出码。和 WaitPid 一样，ok 为 false 时要 return StatusRunning，
+// 线程结束后这条指令会重新执行。
+func (c *Contextual) ThreadJoin(tid string) (code int, ok bool) {
+	return c.OS.ThreadJoin(c.thread, tid)
+}
+
+// ThreadExit 结束当前线程，退出码为 code，用法是 return contextual.ThreadExit(code)。
+// 主线程结束时整个进程结束。
+func (c *Contextual) ThreadExit(code int) int {
+	return c.OS.ThreadExit(c.thread, code)
+}
+
+// 👆THREAD👆
+
+// 👇SEMAPHORE👇
+// 信号量，见 Semaphore。SemWait 可能会阻塞，应该是一条指令里的最后一个操作。
+
+// Semget 获取信号量 key，不存在就新建一个初值为 value 的计数信号量
+func (c *Contextual) Semget(key string, value int) bool {
+	return c.OS.Semget(c.thread, key, value, false)
+}
+
+// BinarySemget 获取二元信号量 key，不存在就新建一个初值为 value（0 或 1）的二元信号量
+func (c *Contextual) BinarySemget(key string, value int) bool {
+	return c.OS.Semget(c.thread, key, value, true)
+}
+
+// SemWait 信号量 key 的 P 操作：拿不到就阻塞，被唤醒时已经拿到了
+func (c *Contextual) SemWait(key string) bool {
+	return c.OS.SemWait(c.thread, key)
+}
+
+// SemSignal 信号量 key 的 V 操作
+func (c *Contextual) SemSignal(key string) bool {
+	return c.OS.SemSignal(c.thread, key)
+}
+
+// 👆SEMAPHORE👆
+
+// 👇MONITOR👇
+// 互斥锁和条件变量，见 Mutex、CondVar。Lock、CondWait、CondSignal 可能会阻塞，应该是一条指令里的最后一个操作。
+
+// Mutexget 获取互斥锁 key，不存在就新建一个
+func (c *Contextual) Mutexget(key string) bool {
+	return c.OS.Mutexget(c.thread, key)
+}
+
+// Condget 获取条件变量 key，不存在就新建一个
+func (c *Contextual) Condget(key string) bool {
+	return c.OS.Condget(c.thread, key)
+}
+
+// Lock 给互斥锁 key 加锁：拿不到就阻塞，被唤醒时已经拿到了
+func (c *Contextual) Lock(key string) bool {
+	return c.OS.Lock(c.thread, key)
+}
+
+// Unlock 释放互斥锁 key，不是自己持有的锁返回 false
+func (c *Contextual) Unlock(key string) bool {
+	return c.OS.Unlock(c.thread, key)
+}
+
+// CondWait 释放互斥锁 mutex，在条件变量 cond 上等待。
+// 返回 true 时要 return StatusRunning：被唤醒、重新拿到锁后这条指令会重新执行，重新检查条件。
+func (c *Contextual) CondWait(cond string, mutex string) bool {
+	return c.OS.CondWait(c.thread, cond, mutex)
+}
+
+// CondSignal 唤醒在条件变量 cond 上等待最久的线程，见 OS.MonitorSemantics
+func (c *Contextual) CondSignal(cond string) bool {
+	return c.OS.CondSignal(c.thread, cond)
+}
+
+// CondBroadcast 唤醒在条件变量 cond 上等待的所有线程
+func (c *Contextual) CondBroadcast(cond string) bool {
+	return c.OS.CondBroadcast(c.thread, cond)
+}
+
+// 👆MONITOR👆
+
+// 👇SHARED MEMORY👇
+// 和别的进程共享的内存段，见 SharedSegment。
+
+// ShmGet 获取键为 key 的共享内存段，不存在就新建一个大小为 size 的段
+func (c *Contextual) ShmGet(key string, size uint) bool {
+	return c.OS.Shmget(c.thread, key, size)
+}
+
+// ShmAt 挂接共享内存段 key
+func (c *Contextual) ShmAt(key string) bool {
+	return c.OS.Shmat(c.thread, key)
+}
+
+// ShmDt 解除对共享内存段 key 的挂接
+func (c *Contextual) ShmDt(key string) bool {
+	return c.OS.Shmdt(c.thread, key)
+}
+
+// ShmRm 删除共享内存段 key，没有进程挂接时马上销毁
+func (c *Contextual) ShmRm(key string) bool {
+	return c.OS.Shmrm(c.thread, key)
+}
+
+// ShmLoad 读取共享内存段 key 中第 offset 个字
+func (c *Contextual) ShmLoad(key string, offset uint) (interface{}, bool) {
+	return c.OS.ReadShared(c.thread, key, offset)
+}
+
+// ShmStore 把 value 写到共享内存段 key 中第 offset 个字
+func (c *Contextual) ShmStore(key string, offset uint, value interface{}) bool {
+	return c.OS.WriteShared(c.thread, key, offset, value)
+}
+
+// 👆SHARED MEMORY👆
+
+// NoopId 是 Noop 进程的 id
+const NoopId = "no-op"
+
+// newNoop 新建这个 OS 的 Noop 进程（见 OS.Noop）：一个基本的进程，运行时会使用 fmt.Println 打印 "no-op"。
 // 这个东西不需要 IO 设备，不需要内存。
 // 运行需要的时间是 0，优先级为最低 (0)。
-var Noop = Process{
-	Id:         "no-op",
-	Precedence: 0,
-	Thread: &Thread{
-		runnable: func(contextual *Contextual) int {
-			fmt.Println("no-op")
-			return StatusDone
-		},
-		contextual:    &Contextual{},
-		remainingTime: 0,
-	},
-	Memory:  Memory{},
-	Devices: map[string]Device{},
-}
-
-func init() {
-	Noop.Thread.contextual.Process = &Noop
+// 每个 OS 有自己的 Noop，它的线程只给这个 OS 发系统调用，几个 OS 同时跑也不会互相改写。
+func (os *OS) newNoop() *Process {
+	p := &Process{
+		Id:         NoopId,
+		Precedence: 0,
+		Memory:     Memory{},
+		Devices:    map[string]Device{},
+		idle:       true,
+	}
+	p.Thread = os.newThread(p, NoopId, 0, func(contextual *Contextual) int {
+		fmt.Println("no-op")
+		return StatusDone
+	})
+	return p
 }
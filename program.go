@@ -0,0 +1,107 @@
+package sham
+
+import (
+	log "github.com/sirupsen/logrus"
+	"strings"
+)
+
+// Program 程序：注册在 OS 上（见 OS.RegisterProgram），由 Exec、Spawn 按名字装入进程。
+// 和直接写给 CreateProcess 的 Runnable 不同，一个程序可以被装入很多次，
+// 所以 Main 是一个工厂：每装入一次调用一次，生成一个新的 Runnable，程序的状态应该放在这个新的闭包里。
+type Program struct {
+	// TimeCost 预计运行时间，装入后作为线程的预计剩余时间
+	TimeCost uint
+	// Main 用命令行参数 args 生成程序的 Runnable
+	Main func(args []string) Runnable
+}
+
+// RegisterProgram 以 name 为名注册程序，已有同名的会被替换
+func (os *OS) RegisterProgram(name string, program Program) {
+	if os.Programs == nil {
+		os.Programs = map[string]Program{}
+	}
+	os.Programs[name] = program
+}
+
+// Spawn 创建一个运行程序 name 的进程，args 是传给程序的参数。没有这个程序时返回 false。
+// 和 CreateProcess 一样，创建的进程是 init 的子进程。
+func (os *OS) Spawn(pid string, precedence uint, name string, args []string) bool {
+	return os.spawn(InitPid, pid, precedence, name, args)
+}
+
+// SpawnChild 系统调用：创建一个运行程序 name 的进程，是线程所在进程的子进程。见 Spawn
+func (os *OS) SpawnChild(thread *Thread, pid string, precedence uint, name string, args []string) bool {
+	return os.spawn(thread.contextual.Process.Id, pid, precedence, name, args)
+}
+
+// spawn 创建一个运行程序 name 的进程，是进程 parent 的子进程
+func (os *OS) spawn(parent string, pid string, precedence uint, name string, args []string) bool {
+	program, ok := os.Programs[name]
+	if !ok {
+		log.WithFields(log.Fields{"pid": pid, "program": name}).Warn("[OS] Spawn: no such program")
+		return false
+	}
+
+	p := os.newProcess(parent, pid, precedence, program.TimeCost, os.MemoryLimit, program.Main(args))
+	p.Program = name
+	return true
+}
+
+// Exec 把线程所在进程的程序换成 name，args 是传给程序的参数。
+// 进程的 pid、父进程和打开的设备不变，地址空间被清空：
+// 变量池、分页内存（页框和交换区中的页）、各段（分段模式下会重新分配）和堆上的内存块都释放掉，
+// 挂接的共享内存段解除挂接。PC 回到 0，预计剩余时间改为程序的 TimeCost。
+// 注册的信号处理程序恢复为默认动作，忽略的信号和信号屏蔽字不变。
+//
+// 成功的话不会再回到原来的程序：这条指令返回后，下一条指令就是新程序的第一条。
+// 没有这个程序，或者进程还有别的线程（见 ThreadCreate）时返回 false，原来的程序接着运行。
+func (os *OS) Exec(thread *Thread, name string, args []string) bool {
+	c := thread.contextual
+	proc := c.Process
+
+	program, ok := os.Programs[name]
+	if !ok {
+		log.WithFields(log.Fields{"pid": proc.Id, "program": name}).Warn("[OS] Exec: no such program")
+		return false
+	}
+	for _, t := range proc.Threads {
+		if t != thread && !t.exited {
+			log.WithFields(log.Fields{"pid": proc.Id, "program": name}).Warn("[OS] Exec: process has other threads")
+			return false
+		}
+	}
+
+	// os.Mem、页表、各段这些 newProcess、reclaim 也会改，和 reclaim 一样持有 os.ProcsMutex 换掉地址空间
+	os.ProcsMutex.Lock()
+	for i := range os.Mem {
+		if os.Mem[i].Pid == proc.Id {
+			os.Mem[i].Content = nil
+		}
+	}
+	for i := range proc.Memory {
+		proc.Memory[i].Content = nil
+	}
+	blocks := os.releaseImage(proc)
+	// 信号处理程序是原来的程序里的代码，新程序里没有了，恢复默认动作；忽略的信号和信号屏蔽字保留
+	proc.SignalHandlers = nil
+	os.ProcsMutex.Unlock()
+
+	if os.MemoryModel == MemorySegmented {
+		os.allocSegments(proc) // 段内存不够时要 OOM kill，不能持有 os.ProcsMutex
+	}
+
+	proc.Program = name
+	thread.runnable = program.Main(args)
+	thread.remainingTime = program.TimeCost
+	c.replaced, c.restart, c.forked = true, false, false
+
+	log.WithFields(log.Fields{
+		"pid":         proc.Id,
+		"program":     name,
+		"args":        args,
+		"heap_blocks": blocks,
+	}).Info("[OS] Exec")
+	os.Tracer.emit(Event{Type: EventExec, Pid: proc.Id, Data: strings.TrimSpace(name + " " + strings.Join(args, " "))})
+
+	return true
+}
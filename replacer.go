@@ -0,0 +1,204 @@
+package sham
+
+// PageReplacer 是页面置换算法：物理内存满了以后，决定换出哪个页框。
+// OS 在页框装入、访问、释放时通知它，在缺页又没有空闲页框时问它要一个牺牲者。
+type PageReplacer interface {
+	// loaded 页框 frame 装入了一个新的页
+	loaded(frame uint)
+	// accessed 页框 frame 被访问了一次
+	accessed(frame uint)
+	// freed 页框 frame 被释放（换出，或者进程退出）
+	freed(frame uint)
+	// victim 选出一个要换出的页框。调用时保证所有页框都在使用中。
+	victim(os *OS) uint
+}
+
+// PageRef 是访问串（reference string）中的一项：进程 Pid 访问了它的虚拟页 Page
+type PageRef struct {
+	Pid  string
+	Page uint
+}
+
+// FIFOReplacer 先进先出：换出最早装入的页
+type FIFOReplacer struct {
+	queue []uint
+}
+
+func (r *FIFOReplacer) loaded(frame uint) {
+	r.queue = append(r.queue, frame)
+}
+
+func (r *FIFOReplacer) accessed(frame uint) {}
+
+func (r *FIFOReplacer) freed(frame uint) {
+	r.queue = withoutFrame(r.queue, frame)
+}
+
+func (r *FIFOReplacer) victim(os *OS) uint {
+	return r.queue[0]
+}
+
+// LRUReplacer 最近最少使用：换出最久没被访问的页
+type LRUReplacer struct {
+	// lastUse 页框最后一次被访问的（逻辑）时间
+	lastUse map[uint]uint
+	now     uint
+}
+
+func (r *LRUReplacer) loaded(frame uint) {
+	r.accessed(frame)
+}
+
+func (r *LRUReplacer) accessed(frame uint) {
+	if r.lastUse == nil {
+		r.lastUse = map[uint]uint{}
+	}
+	r.now += 1
+	r.lastUse[frame] = r.now
+}
+
+func (r *LRUReplacer) freed(frame uint) {
+	delete(r.lastUse, frame)
+}
+
+func (r *LRUReplacer) victim(os *OS) uint {
+	return minFrame(r.lastUse)
+}
+
+// ClockReplacer 时钟（第二次机会）算法：
+// 指针绕着页框转，访问位为 1 的清零放过，换出第一个访问位为 0 的页
+type ClockReplacer struct {
+	referenced map[uint]bool
+	hand       uint
+}
+
+func (r *ClockReplacer) loaded(frame uint) {
+	r.accessed(frame)
+}
+
+func (r *ClockReplacer) accessed(frame uint) {
+	if r.referenced == nil {
+		r.referenced = map[uint]bool{}
+	}
+	r.referenced[frame] = true
+}
+
+func (r *ClockReplacer) freed(frame uint) {
+	delete(r.referenced, frame)
+}
+
+func (r *ClockReplacer) victim(os *OS) uint {
+	frames := os.PhysMem.Frames()
+	for {
+		frame := r.hand
+		r.hand = (r.hand + 1) % frames
+		if !r.referenced[frame] {
+			return frame
+		}
+		r.referenced[frame] = false // 第二次机会
+	}
+}
+
+// LFUReplacer 最不经常使用：换出访问次数最少的页，次数相同的换出先装入的
+type LFUReplacer struct {
+	count map[uint]uint
+	order []uint
+}
+
+func (r *LFUReplacer) loaded(frame uint) {
+	if r.count == nil {
+		r.count = map[uint]uint{}
+	}
+	r.count[frame] = 0
+	r.order = append(r.order, frame)
+}
+
+func (r *LFUReplacer) accessed(frame uint) {
+	r.count[frame] += 1
+}
+
+func (r *LFUReplacer) freed(frame uint) {
+	delete(r.count, frame)
+	r.order = withoutFrame(r.order, frame)
+}
+
+func (r *LFUReplacer) victim(os *OS) uint {
+	v := r.order[0]
+	for _, f := range r.order[1:] {
+		if r.count[f] < r.count[v] {
+			v = f
+		}
+	}
+	return v
+}
+
+// RandomReplacer 随机换出一页，使用 os.Rand，所以在确定模式下给定种子可以重现
+type RandomReplacer struct{}
+
+func (r *RandomReplacer) loaded(frame uint) {}
+
+func (r *RandomReplacer) accessed(frame uint) {}
+
+func (r *RandomReplacer) freed(frame uint) {}
+
+func (r *RandomReplacer) victim(os *OS) uint {
+	return uint(os.Rand.Intn(int(os.PhysMem.Frames())))
+}
+
+// OPTReplacer 最佳置换（Belady 算法）：换出在将来最久不会被用到的页。
+// 这需要预知未来，所以要给它一份访问串 Future，一般是同样的程序上一次运行时记录的 os.PhysMem.References。
+type OPTReplacer struct {
+	Future []PageRef
+
+	// pos 当前访问到了 Future 中的哪一项
+	pos uint
+}
+
+func (r *OPTReplacer) loaded(frame uint) {}
+
+func (r *OPTReplacer) accessed(frame uint) {
+	r.pos += 1
+}
+
+func (r *OPTReplacer) freed(frame uint) {}
+
+func (r *OPTReplacer) victim(os *OS) uint {
+	victim, farthest := uint(0), -1
+	for frame, owner := range os.PhysMem.Owners {
+		if owner == nil {
+			continue
+		}
+		next := len(r.Future) // 将来不会再用到
+		for i := int(r.pos); i < len(r.Future); i++ {
+			if r.Future[i].Pid == owner.Pid && r.Future[i].Page == owner.Page {
+				next = i
+				break
+			}
+		}
+		if next > farthest {
+			victim, farthest = uint(frame), next
+		}
+	}
+	return victim
+}
+
+// withoutFrame 从 frames 中删掉 frame
+func withoutFrame(frames []uint, frame uint) []uint {
+	for i, f := range frames {
+		if f == frame {
+			return append(frames[:i:i], frames[i+1:]...)
+		}
+	}
+	return frames
+}
+
+// minFrame 找出 m 中值最小的页框，值相同的取页框号小的
+func minFrame(m map[uint]uint) uint {
+	v, first := uint(0), true
+	for f, n := range m {
+		if first || n < m[v] || (n == m[v] && f < v) {
+			v, first = f, false
+		}
+	}
+	return v
+}
@@ -16,15 +16,20 @@ type Scheduler interface {
 // 它只运行表中第一个东西，然后结束退出。
 type NoScheduler struct{}
 
+// quantum NoScheduler 不做时间片轮转
+func (n NoScheduler) quantum(os *OS, p *Process) uint {
+	return NoQuantum
+}
+
 func (n NoScheduler) schedule(os *OS) {
 	// 起手式：运行一个线程
 	if len(os.ReadyProcs) > 0 {
 		os.ReadyToRunning(os.ReadyProcs[0].Id)
 	}
 	// 调度过程
-	for len(os.ReadyProcs) > 0 || os.RunningProc.Status != StatusDone {
+	for len(os.ReadyProcs) > 0 || os.RunningProc != nil {
 		select {
-		case pid := <-os.CPU.Done:
+		case pid := <-os.CPU.Wait():
 			os.RunningToDone()
 			log.WithField("done_process", pid).Info("first thread done, do no more schedule. Shutdown NoScheduler")
 			return
@@ -33,20 +38,318 @@ func (n NoScheduler) schedule(os *OS) {
 }
 
 // FCFSScheduler do first-come first-served schedule.
-// 先来先服务，一次跑到够(退出｜阻塞)，后来排队尾。
-type FCFSScheduler struct{}
+// 先来先服务，一次跑到够(退出｜阻塞｜时间片用尽)，后来排队尾。
+type FCFSScheduler struct {
+	TimeSlice
+}
 
 func (F FCFSScheduler) schedule(os *OS) {
-	field := "[FCFSScheduler] "
+	serve(os, "[FCFSScheduler] ", F)
+}
+
+// pick 选出就绪队列的队头进程
+func (F FCFSScheduler) pick(os *OS) *Process {
+	return os.ReadyProcs[0]
+}
+
+// SJFScheduler do non-preemptive shortest-job-first schedule.
+// 短作业优先：从就绪队列中选出预计剩余时间 (Thread.remainingTime) 最短的进程，
+// 一次跑到够(退出｜阻塞｜时间片用尽)。剩余时间相同的，先来先服务。
+type SJFScheduler struct {
+	TimeSlice
+}
+
+func (S SJFScheduler) schedule(os *OS) {
+	serve(os, "[SJFScheduler] ", S)
+}
+
+// pick 选出就绪队列中剩余时间最短的进程
+func (S SJFScheduler) pick(os *OS) *Process {
+	return shortest(os.ReadyProcs)
+}
+
+// SRTFScheduler do preemptive shortest-remaining-time-first schedule.
+// 最短剩余时间优先：SJF 的抢占式版本。
+// 每个时钟周期都会检查就绪队列，如果来了剩余时间比正在运行的进程更短的进程，就抢占 CPU。
+type SRTFScheduler struct {
+	TimeSlice
+}
+
+func (S SRTFScheduler) schedule(os *OS) {
+	serve(os, "[SRTFScheduler] ", S)
+}
+
+// pick 选出就绪队列中剩余时间最短的进程
+func (S SRTFScheduler) pick(os *OS) *Process {
+	return shortest(os.ReadyProcs)
+}
+
+// preempt 就绪队列中有剩余时间严格短于当前运行进程的，就抢占
+func (S SRTFScheduler) preempt(os *OS) bool {
+	os.ProcsMutex.RLock()
+	defer os.ProcsMutex.RUnlock()
+
+	if len(os.ReadyProcs) == 0 {
+		return false
+	}
+	return shortest(os.ReadyProcs).Thread.remainingTime < os.RunningProc.Thread.remainingTime
+}
+
+// shortest 找出 procs 中剩余时间最短的进程，剩余时间相同的取靠前的那个。
+// 该函数假设 procs 不为空。
+func shortest(procs []*Process) *Process {
+	s := procs[0]
+	for _, p := range procs[1:] {
+		if p.Thread.remainingTime < s.Thread.remainingTime {
+			s = p
+		}
+	}
+	return s
+}
+
+// PriorityScheduler do priority schedule.
+// 优先级调度：从就绪队列中选出有效优先级最高的进程运行，优先级相同的先来先服务。
+// Preemptive 为 true 时是抢占式的：就绪队列中出现有效优先级更高的进程时立即抢占 CPU；
+// 否则一次跑到够(退出｜阻塞｜时间片用尽)。
+// Aging 是老化策略，用来防止低优先级的进程饿死。
+//
+// PriorityScheduler 要记录就绪进程的等待情况，所以要用指针：
+//
+//	os.Scheduler = &PriorityScheduler{Preemptive: true, Aging: Aging{Interval: 2, Step: 1}}
+type PriorityScheduler struct {
+	TimeSlice
+	Preemptive bool
+	Aging      Aging
+
+	// waited 记录就绪进程自上次运行以来，等过了几次调度
+	waited map[*Process]uint
+	// last 上一次选中运行的进程：在 CPU 上时保持老化后的有效优先级
+	last *Process
+}
 
-	log.Info(field, "FCFSScheduler on")
+// Aging 老化策略：就绪进程每等过 Interval 次调度（别的进程被选中运行），
+// 其有效优先级就提高 Step。进程在 CPU 上时保持这个有效优先级（抢占时和它比），离开 CPU 后回到 Precedence。
+// Interval 为 0 表示不老化。
+type Aging struct {
+	Interval uint
+	Step     uint
+}
+
+func (P *PriorityScheduler) schedule(os *OS) {
+	P.waited = map[*Process]uint{}
+	P.last = nil
+	serve(os, "[PriorityScheduler] ", P)
+}
+
+// pick 选出就绪队列中有效优先级最高的进程，并让其余的就绪进程老化。
+// 上一次运行的进程已经离开了 CPU，它的有效优先级先回到 Precedence。
+func (P *PriorityScheduler) pick(os *OS) *Process {
+	delete(P.waited, P.last)
+
+	h := os.ReadyProcs[0]
+	for _, p := range os.ReadyProcs[1:] {
+		if P.effective(p) > P.effective(h) {
+			h = p
+		}
+	}
+
+	for _, p := range os.ReadyProcs {
+		if p != h {
+			P.waited[p] += 1
+		}
+	}
+	P.last = h
+
+	return h
+}
+
+// preempt 抢占式时，就绪队列中有有效优先级高于当前运行进程（的有效优先级）的，就抢占
+func (P *PriorityScheduler) preempt(os *OS) bool {
+	if !P.Preemptive {
+		return false
+	}
+
+	os.ProcsMutex.RLock()
+	defer os.ProcsMutex.RUnlock()
+
+	running := P.effective(os.RunningProc)
+	for _, p := range os.ReadyProcs {
+		if P.effective(p) > running {
+			return true
+		}
+	}
+	return false
+}
+
+// effective 计算进程老化后的有效优先级
+func (P *PriorityScheduler) effective(p *Process) uint {
+	if P.Aging.Interval == 0 {
+		return p.Precedence
+	}
+	return p.Precedence + P.waited[p]/P.Aging.Interval*P.Aging.Step
+}
+
+// MLFQScheduler do multilevel feedback queue schedule.
+// 多级反馈队列：有 len(Quanta) 级就绪队列，Quanta[i] 是第 i 级队列的时间片长度。
+//   - 新进程进入最高级（第 0 级）队列；
+//   - 总是运行最高级的非空队列中最先来的进程，高级队列来了进程会抢占低级队列的进程；
+//   - 用完了整个时间片的进程降一级（最低级的留在最低级），设置了 Process.Quantum 的进程时间片总是 Process.Quantum；
+//   - 主动让出 CPU（StatusReady）或因 IO 中断阻塞的进程保持原级别；
+//   - 每运行 BoostPeriod 个时钟周期，把所有进程提回最高级队列，BoostPeriod 为 0 表示不提升。
+//
+// MLFQScheduler 要记录进程所在的队列，所以要用指针：
+//
+//	os.Scheduler = &MLFQScheduler{Quanta: []uint{2, 4, 8}, BoostPeriod: 50}
+type MLFQScheduler struct {
+	Quanta      []uint
+	BoostPeriod uint
+
+	// level 记录进程所在的队列级别，不在里面的是第 0 级
+	level map[*Process]int
+	// ticks 是进程运行过的时钟周期总数，lastBoost 是上次提升时的 ticks
+	ticks     uint
+	lastBoost uint
+}
+
+// DefaultMLFQQuanta 是没有指定 MLFQScheduler.Quanta 时使用的三级队列时间片
+var DefaultMLFQQuanta = []uint{2, 4, 8}
+
+func (M *MLFQScheduler) schedule(os *OS) {
+	if len(M.Quanta) == 0 {
+		M.Quanta = DefaultMLFQQuanta
+	}
+	M.level = map[*Process]int{}
+	M.ticks, M.lastBoost = 0, 0
+
+	serve(os, "[MLFQScheduler] ", M)
+}
+
+// pick 选出最高级非空队列的队头进程。到了提升周期的话先把所有进程提回最高级。
+func (M *MLFQScheduler) pick(os *OS) *Process {
+	if M.BoostPeriod > 0 && M.ticks-M.lastBoost >= M.BoostPeriod {
+		log.WithField("ticks", M.ticks).Info("[MLFQScheduler] ", "boost all processes to the top queue")
+		M.level = map[*Process]int{}
+		M.lastBoost = M.ticks
+	}
+
+	h := os.ReadyProcs[0]
+	for _, p := range os.ReadyProcs[1:] {
+		if M.level[p] < M.level[h] {
+			h = p
+		}
+	}
+	return h
+}
+
+// quantum 进程的时间片是其所在队列的时间片。和 TimeSlice 一样，进程自己设置了 Process.Quantum 的，以进程的为准
+func (M *MLFQScheduler) quantum(os *OS, p *Process) uint {
+	if p.Quantum > 0 {
+		return p.Quantum
+	}
+	return M.Quanta[M.level[p]]
+}
+
+// expire 用完了整个时间片的进程降一级
+func (M *MLFQScheduler) expire(os *OS, p *Process) {
+	if M.level[p] < len(M.Quanta)-1 {
+		M.level[p] += 1
+	}
+	log.WithFields(log.Fields{
+		"process": p.Id,
+		"level":   M.level[p],
+	}).Info("[MLFQScheduler] ", "quantum used up, demote")
+}
+
+// preempt 更高级的队列里来了进程时抢占
+func (M *MLFQScheduler) preempt(os *OS) bool {
+	M.ticks += 1
+
+	os.ProcsMutex.RLock()
+	defer os.ProcsMutex.RUnlock()
+
+	for _, p := range os.ReadyProcs {
+		if M.level[p] < M.level[os.RunningProc] {
+			return true
+		}
+	}
+	return false
+}
+
+// DefaultQuantum 是默认的时间片长度（时钟周期数）
+const DefaultQuantum uint = 10
+
+// NoQuantum 表示不限时间片：进程不会因时间片用尽而被中断，即不做时间片轮转
+const NoQuantum = ^uint(0)
+
+// TimeSlice 是嵌入调度器中使用的时间片设置，例如：
+//
+//	os.Scheduler = FCFSScheduler{TimeSlice{Quantum: 4}}
+//
+// 进程自己设置了 Process.Quantum 的，以进程的为准。
+type TimeSlice struct {
+	// Quantum 时间片长度。0 表示使用 DefaultQuantum，NoQuantum 表示不限。
+	Quantum uint
+}
+
+func (t TimeSlice) quantum(os *OS, p *Process) uint {
+	if p.Quantum > 0 {
+		return p.Quantum
+	}
+	if t.Quantum > 0 {
+		return t.Quantum
+	}
+	return DefaultQuantum
+}
+
+// timeSlicer 是自己决定时间片长度的调度器。
+// quantum 返回进程 p 上一次 CPU 最多能连续运行的时钟周期数，NoQuantum 表示不限。
+// 没有实现 timeSlicer 的调度器使用 TimeSlice{} 的设置。
+type timeSlicer interface {
+	quantum(os *OS, p *Process) uint
+}
+
+// expirer 是关心时间片用尽的调度器。
+// OS 因进程 p 时间片用尽发出时钟中断时，会调用 expire 通知调度器。
+type expirer interface {
+	expire(os *OS, p *Process)
+}
+
+// picker 是调度器中"决定运行谁"的部分。
+// pick 从 os.ReadyProcs 中选出下一个要运行的进程，
+// 调用时保证 os.ReadyProcs 不为空，且 CPU 空闲（Thread == nil）。
+type picker interface {
+	pick(os *OS) *Process
+}
+
+// preemptor 是可抢占的调度器。
+// 有进程在运行时，OS 每个时钟周期都会调用 preempt 询问是否要抢占这个进程，
+// 返回 true 则发出时钟中断，让当前进程立即让出 CPU。
+type preemptor interface {
+	preempt(os *OS) bool
+}
+
+// serve 是带时间片轮转的调度器的通用调度过程：
+// 等待 CPU 上的进程停下，完成进程状态转换、处理中断，然后由 p 决定下一个运行的进程。
+// 没有进程可以运行时会去跑 Noop，所有进程都结束后返回。
+func serve(os *OS, field string, p picker) {
+	log.Info(field, "Scheduler on")
+
+	// busy 表示 CPU 上有进程在跑，之后一定会从 os.CPU.Done 收到它停下的状态
+	busy := false
 	if len(os.ReadyProcs) > 0 {
-		log.WithField("first_process", os.ReadyProcs[0].Id).Info(field, "Boot the first process")
-		os.ReadyToRunning(os.ReadyProcs[0].Id)
+		log.Info(field, "Boot the first process")
+		_schedule(os, field, p)
+		busy = true
 	}
 	for {
+		var idle <-chan time.Time
+		if !busy {
+			idle = os.Clock.After(3)
+		}
+
+		done := os.CPU.Wait()
 		select {
-		case status := <-os.CPU.Done:
+		case status := <-done:
 			logger := log.WithFields(log.Fields{
 				"process":       os.RunningProc.Id,
 				"status":        status,
@@ -58,42 +361,48 @@ func (F FCFSScheduler) schedule(os *OS) {
 				os.RunningToDone()
 			case StatusBlocked:
 				os.RunningToBlocked()
+			case StatusStopped:
+				os.RunningToStopped()
+			case StatusSuspendedReady:
+				os.RunningToSuspended()
 			default:
 				os.RunningToReady()
 			}
 
 			os.HandleInterrupts()
 
+			busy = false
 			if len(os.ReadyProcs) > 0 {
-				F._schedule(os)
+				_schedule(os, field, p)
+				busy = true
 			}
-		case <-time.After(3 * time.Second):
-			if os.RunningProc.Status != StatusRunning {
-				// 避免 "all goroutines are asleep - deadlock"：别闲着，去跑 Noop
-				log.Warn("no process ready. Waiting with noop...")
+		case <-idle:
+			// 避免 "all goroutines are asleep - deadlock"：别闲着，去跑 Noop
+			log.Warn("no process ready. Waiting with noop...")
 
-				os.ProcsMutex.Lock()
-				os.ReadyProcs = append(os.ReadyProcs, &Noop)
-				os.ProcsMutex.Unlock()
+			os.ProcsMutex.Lock()
+			os.ReadyProcs = append(os.ReadyProcs, os.Noop)
+			os.ProcsMutex.Unlock()
 
-				F._schedule(os)
-			}
+			_schedule(os, field, p)
+			busy = true
 		}
 
 		os.ProcsMutex.RLock()
-		hasJobsToDo := len(os.ReadyProcs) > 0 || os.RunningProc.Status != StatusDone || len(os.BlockedProcs) > 0
+		hasJobsToDo := len(os.ReadyProcs) > 0 || os.RunningProc != nil || len(os.BlockedProcs) > 0 || len(os.NewProcs) > 0
 		os.ProcsMutex.RUnlock()
 
 		if !hasJobsToDo {
 			break
 		}
 	}
-	log.Info(field, "All process done. no process to schedule. Shutdown FCFSScheduler")
+	log.Info(field, "All process done. no process to schedule. Shutdown scheduler")
 }
 
 // _schedule 完成真正的调度工作：决定并运行谁
 // 该函数假设 process 不为空，且 cpu 空闲（Thread == nil）
-func (F FCFSScheduler) _schedule(os *OS) {
-	log.WithField("process_to_run", os.ReadyProcs[0].Id).Info("[FCFSScheduler] ", "run the head process")
-	os.ReadyToRunning(os.ReadyProcs[0].Id)
+func _schedule(os *OS, field string, p picker) {
+	proc := p.pick(os)
+	log.WithField("process_to_run", proc.Id).Info(field, "run the picked process")
+	os.ReadyToRunning(proc.Id)
 }
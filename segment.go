@@ -0,0 +1,126 @@
+package sham
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+)
+
+// 内存模型：进程的 Contextual.Load、Contextual.Store 用的虚拟地址怎么翻译
+const (
+	// MemoryPaged 分页：虚拟地址按页映射到 OS.PhysMem，见 PageTable
+	MemoryPaged = "paged"
+	// MemorySegmented 分段：虚拟地址由段号和段内偏移组成，由段的基址、界限翻译到 OS.SegMem，见 Segment
+	MemorySegmented = "segmented"
+)
+
+// 进程的段
+const (
+	SegmentCode = iota
+	SegmentData
+	SegmentStack
+	SegmentHeap
+	// SegmentCount 段的个数
+	SegmentCount
+)
+
+// segmentNames 是段的名字
+var segmentNames = [SegmentCount]string{"code", "data", "stack", "heap"}
+
+// DefaultSegmentSizes 是默认的各段大小（字），按 SegmentCode、SegmentData、SegmentStack、SegmentHeap 排列
+var DefaultSegmentSizes = [SegmentCount]uint{16, 64, 32, 64}
+
+// DefaultSegMemSize 默认的分段内存大小（字）
+const DefaultSegMemSize uint = 1024
+
+// SegmentShift 分段模式下，虚拟地址的低 SegmentShift 位是段内偏移，再往上是段号。见 SegAddr
+const SegmentShift = 16
+
+// SegAddr 返回第 seg 段中偏移为 offset 的虚拟地址
+func SegAddr(seg int, offset uint) uint {
+	return uint(seg)<<SegmentShift | offset
+}
+
+// Segment 是段寄存器：段从 OS.SegMem 的 Base 开始，长 Limit 个字。
+// 只读的段（代码段）不能写。
+type Segment struct {
+	Base     uint
+	Limit    uint
+	ReadOnly bool
+
+	// handle 段在 OS.SegMem 中对应的内存块
+	handle Handle
+}
+
+// allocSegments 在 os.SegMem 中给进程 p 分配各段，大小为 os.SegmentSizes。
+// 和堆上的 Alloc 一样，段要算进进程的内存配额，超出配额的段不分配；SegMem 放不下时由 OOM killer 杀掉一个进程腾地方。
+// 放不下的段界限为 0，访问它会段错误。
+func (os *OS) allocSegments(p *Process) {
+	for seg, size := range os.SegmentSizes {
+		if p.MemoryLimit > 0 && os.memoryUsage(p)+size > p.MemoryLimit {
+			log.WithFields(log.Fields{
+				"pid":     p.Id,
+				"segment": segmentNames[seg],
+				"size":    size,
+				"limit":   p.MemoryLimit,
+			}).Warn("[OS] allocSegments: memory limit exceeded")
+			continue
+		}
+
+		handle, ok := os.SegMem.Alloc(p.Id, size)
+		for !ok && size <= os.SegMem.Stats().Size && os.oomKill(p, OOMSegments) {
+			handle, ok = os.SegMem.Alloc(p.Id, size)
+		}
+		if ok && p.MemoryLimit > 0 && os.memoryUsage(p) > p.MemoryLimit {
+			// 实际分配的比申请的多（比如伙伴系统），超出了配额
+			os.SegMem.Free(p.Id, handle)
+			continue
+		}
+		if !ok {
+			log.WithFields(log.Fields{
+				"pid":     p.Id,
+				"segment": segmentNames[seg],
+				"size":    size,
+			}).Error("[OS] allocSegments: out of segment memory")
+			continue
+		}
+		p.Segments[seg] = Segment{
+			Base:     os.SegMem.Blocks[handle].Addr,
+			Limit:    size,
+			ReadOnly: seg == SegmentCode,
+			handle:   handle,
+		}
+	}
+}
+
+// translateSegment 把分段模式下的虚拟地址转换为 OS.SegMem 中的地址。
+// 段号不存在、越界或者写只读的段时，发出段错误中断（进程会被杀掉）。
+func (os *OS) translateSegment(thread *Thread, addr uint, write bool) (uint, bool) {
+	proc := thread.contextual.Process
+	seg, offset := addr>>SegmentShift, addr&(1<<SegmentShift-1)
+
+	var reason string
+	switch {
+	case seg >= SegmentCount:
+		reason = "no such segment"
+	case offset >= proc.Segments[seg].Limit:
+		reason = "out of bounds"
+	case write && proc.Segments[seg].ReadOnly:
+		reason = "write to read-only segment"
+	default:
+		return proc.Segments[seg].Base + offset, true
+	}
+
+	log.WithFields(log.Fields{
+		"pid":    proc.Id,
+		"addr":   addr,
+		"reason": reason,
+	}).Warn("[OS] segmentation fault")
+
+	// 这条指令如果就是进程的最后一条，进程会在中断处理之前自己结束，所以现在就记下原因
+	proc.ExitReason = ExitSegmentationFault
+
+	ch := make(chan interface{}, 1)
+	ch <- fmt.Sprintf("addr %d (segment %d, offset %d): %s", addr, seg, offset, reason)
+	os.InterruptRequest(thread, SegmentFaultInterrupt, ch)
+	return 0, false
+}
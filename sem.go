@@ -0,0 +1,105 @@
+package sham
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+)
+
+// Semaphore 是信号量：内核里的一个计数器，加上一个等待队列。
+// 进程（线程）通过 Semget 创建（或找到）一个信号量，用 SemWait（P 操作）、SemSignal（V 操作）同步，
+// 在 SemWait 上等待的进程是阻塞的，不占 CPU，不用再轮询、让出 CPU。
+// 信号量和进程表一起由 os.ProcsMutex 保护。
+type Semaphore struct {
+	Key string
+	// Value 信号量的值：还能不阻塞地 SemWait 几次
+	Value int
+	// Binary 二元信号量：值只能是 0 或 1
+	Binary bool
+	// Waiting 等待队列：阻塞在这个信号量上的线程，先来先服务
+	Waiting []*Thread
+}
+
+// Semget 获取键为 key 的信号量，不存在就新建一个初值为 value 的信号量，binary 为 true 时是二元信号量。
+// 信号量已经存在但类型不同，或者初值不合法（负数，二元信号量大于 1）时返回 false。
+func (os *OS) Semget(thread *Thread, key string, value int, binary bool) bool {
+	pid := thread.contextual.Process.Id
+
+	os.ProcsMutex.Lock()
+	defer os.ProcsMutex.Unlock()
+
+	if sem, ok := os.Sems[key]; ok {
+		return sem.Binary == binary
+	}
+	if value < 0 || (binary && value > 1) {
+		log.WithFields(log.Fields{"pid": pid, "key": key, "value": value}).Warn("[OS] Semget: invalid initial value")
+		return false
+	}
+
+	log.WithFields(log.Fields{
+		"pid":    pid,
+		"key":    key,
+		"value":  value,
+		"binary": binary,
+	}).Info("[OS] Semget: create a semaphore")
+
+	if os.Sems == nil {
+		os.Sems = map[string]*Semaphore{}
+	}
+	os.Sems[key] = &Semaphore{Key: key, Value: value, Binary: binary}
+	os.Tracer.emit(Event{Type: EventSemCreated, Pid: pid, Data: fmt.Sprintf("key=%s value=%d binary=%v", key, value, binary)})
+	return true
+}
+
+// SemWait 对信号量 key 做 P 操作（wait）：值大于 0 时减一，接着运行；
+// 否则发出 SemWaitInterrupt，线程阻塞在信号量的等待队列上，直到别的线程 SemSignal 唤醒它。
+// 唤醒时信号量已经交给了它，从下一条指令接着运行，所以 SemWait 应该是一条指令里的最后一个操作。
+// 没有这个信号量时返回 false。
+func (os *OS) SemWait(thread *Thread, key string) bool {
+	os.ProcsMutex.Lock()
+	sem, ok := os.Sems[key]
+	acquired := ok && sem.Value > 0
+	if acquired {
+		sem.Value -= 1
+	}
+	os.ProcsMutex.Unlock()
+
+	if !ok {
+		log.WithFields(log.Fields{"tid": thread.Id, "key": key}).Warn("[OS] SemWait: no such semaphore")
+		return false
+	}
+	if acquired {
+		log.WithFields(log.Fields{"tid": thread.Id, "key": key}).Info("[OS] SemWait: acquired")
+		return true
+	}
+
+	ch := make(chan interface{}, 2)
+	ch <- key
+	ch <- thread
+	os.InterruptRequest(thread, SemWaitInterrupt, ch)
+	return true
+}
+
+// SemSignal 对信号量 key 做 V 操作（signal）：等待队列里有线程的话，把信号量直接交给最早来的那个并唤醒它，
+// 否则值加一（二元信号量最多为 1）。不会阻塞。没有这个信号量时返回 false。
+func (os *OS) SemSignal(thread *Thread, key string) bool {
+	os.ProcsMutex.Lock()
+	defer os.ProcsMutex.Unlock()
+
+	sem, ok := os.Sems[key]
+	if !ok {
+		log.WithFields(log.Fields{"tid": thread.Id, "key": key}).Warn("[OS] SemSignal: no such semaphore")
+		return false
+	}
+
+	if t := os.popWaiter(&sem.Waiting); t != nil { // 跳过已经结束或者被杀掉的线程
+		log.WithFields(log.Fields{"tid": thread.Id, "key": key, "wake": t.Id}).Info("[OS] SemSignal: wake a waiter")
+		os.blockedToReady(t.task.Id)
+		return true
+	}
+
+	if !sem.Binary || sem.Value < 1 {
+		sem.Value += 1
+	}
+	log.WithFields(log.Fields{"tid": thread.Id, "key": key, "value": sem.Value}).Info("[OS] SemSignal")
+	return true
+}
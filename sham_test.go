@@ -3,19 +3,40 @@ package sham
 import (
 	"fmt"
 	log "github.com/sirupsen/logrus"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 )
 
 func TestNoSchedulerNoop(t *testing.T) {
 	shamOS := NewOS()
+	shamOS.Clock = NewVirtualClock()
 	shamOS.Boot()
 }
 
+// TestNoopPerOS 每个 OS 有自己的 Noop，它的系统调用发给自己的 OS
+func TestNoopPerOS(t *testing.T) {
+	a, b := NewOS(), NewOS()
+	if a.Noop == b.Noop {
+		t.Fatalf("two OS share one noop")
+	}
+	for _, shamOS := range []*OS{a, b} {
+		if c := shamOS.Noop.Thread.contextual; c.OS != shamOS || c.Process != shamOS.Noop {
+			t.Errorf("noop of %p runs on %p", shamOS, c.OS)
+		}
+		if shamOS.ReadyProcs[0] != shamOS.Noop {
+			t.Errorf("ready queue starts with %s, want the OS's own noop", shamOS.ReadyProcs[0].Id)
+		}
+	}
+}
+
 func TestFCFSScheduler(t *testing.T) {
 	shamOS := NewOS()
+	shamOS.Clock = NewVirtualClock()
 	shamOS.Scheduler = FCFSScheduler{}
-	shamOS.ReadyProcs = []*Process{&Noop, &Noop}
+	shamOS.ReadyProcs = []*Process{shamOS.Noop, shamOS.Noop}
 
 	log.WithField("OS.ReadyProcs", shamOS.ReadyProcs).Debug("before CreateProcess")
 	shamOS.CreateProcess("processFoo", 10, 1, func(contextual *Contextual) int {
@@ -51,6 +72,7 @@ func TestFCFSScheduler(t *testing.T) {
 
 func TestCommit(t *testing.T) {
 	shamOS := NewOS()
+	shamOS.Clock = NewVirtualClock()
 	shamOS.Scheduler = FCFSScheduler{}
 
 	shamOS.CreateProcess("processFoo", 10, 1, func(contextual *Contextual) int {
@@ -80,6 +102,7 @@ func TestCommit(t *testing.T) {
 
 func TestReturnStatus(t *testing.T) {
 	shamOS := NewOS()
+	shamOS.Clock = NewVirtualClock()
 	shamOS.Scheduler = FCFSScheduler{}
 
 	shamOS.CreateProcess("processFoo", 10, 1, func(contextual *Contextual) int {
@@ -108,6 +131,7 @@ func TestReturnStatus(t *testing.T) {
 
 func TestSeq(t *testing.T) {
 	shamOS := NewOS()
+	shamOS.Clock = NewVirtualClock()
 	shamOS.Scheduler = FCFSScheduler{}
 
 	// 这是一个标准的顺序运行的进程
@@ -143,6 +167,7 @@ func TestSeq(t *testing.T) {
 
 func TestCancel(t *testing.T) {
 	shamOS := NewOS()
+	shamOS.Clock = NewRealClock(time.Second) // 要在运行中途从外部取消，所以得用实时时钟
 	shamOS.Scheduler = FCFSScheduler{}
 
 	go func() {
@@ -182,6 +207,7 @@ func TestCancel(t *testing.T) {
 
 func TestClockInterrupt(t *testing.T) {
 	shamOS := NewOS()
+	shamOS.Clock = NewVirtualClock()
 	shamOS.Scheduler = FCFSScheduler{}
 
 	shamOS.CreateProcess("processSeq", 10, 1, func(contextual *Contextual) int {
@@ -200,10 +226,56 @@ func TestClockInterrupt(t *testing.T) {
 	})
 
 	shamOS.Boot()
+
+	if len(shamOS.Mem) != 0 {
+		t.Errorf("os.Mem after all processes exit: got %d objects, want 0", len(shamOS.Mem))
+	}
+}
+
+func TestMemoryRemap(t *testing.T) {
+	shamOS := newTestOS(FCFSScheduler{TimeSlice{Quantum: 1}})
+
+	var inMem interface{}
+
+	shamOS.CreateProcess("processShort", 10, 1, func(contextual *Contextual) int {
+		contextual.InitVarPool()
+		return StatusDone
+	})
+	// processShort 结束时 os.Mem 重建，后面新建进程时 os.Mem 扩容：processLong 的变量池都要跟着 os.Mem 走
+	shamOS.CreateProcess("processLong", 10, 3, func(contextual *Contextual) int {
+		switch contextual.PC {
+		case 0:
+			contextual.InitVarPool()
+		case 1:
+			for i := 0; i < 8; i++ {
+				contextual.OS.CreateProcess(fmt.Sprintf("processNew%d", i), 10, 1, func(contextual *Contextual) int {
+					return StatusDone
+				})
+			}
+			contextual.SetVar("x", 1)
+			for _, obj := range shamOS.Mem {
+				if obj.Pid == contextual.Process.Id {
+					if pool, ok := obj.Content.(map[string]interface{}); ok {
+						inMem = pool["x"]
+					}
+				}
+			}
+		default:
+			return StatusDone
+		}
+		return StatusRunning
+	})
+
+	shamOS.Boot()
+
+	if inMem != 1 {
+		t.Errorf("var x in os.Mem: got %v, want 1", inMem)
+	}
 }
 
 func TestStdOut(t *testing.T) {
 	shamOS := NewOS()
+	shamOS.Clock = NewVirtualClock()
 	shamOS.Scheduler = FCFSScheduler{}
 
 	shamOS.CreateProcess("processSeq", 10, 1, func(contextual *Contextual) int {
@@ -247,6 +319,7 @@ func TestStdOut(t *testing.T) {
 
 func TestHelloWorld(t *testing.T) {
 	shamOS := NewOS()
+	shamOS.Clock = NewVirtualClock()
 	shamOS.Scheduler = FCFSScheduler{}
 
 	shamOS.ReadyProcs = []*Process{} // No Noop
@@ -264,6 +337,7 @@ func TestHelloWorld(t *testing.T) {
 
 func TestStdIn(t *testing.T) {
 	shamOS := NewOS()
+	shamOS.Clock = NewVirtualClock()
 	shamOS.Scheduler = FCFSScheduler{}
 
 	shamOS.ReadyProcs = []*Process{} // No Noop
@@ -329,6 +403,7 @@ func TestStdIn(t *testing.T) {
 
 func TestClockInterruptMeetIO(t *testing.T) {
 	shamOS := NewOS()
+	shamOS.Clock = NewVirtualClock()
 	shamOS.Scheduler = FCFSScheduler{}
 
 	shamOS.CreateProcess("processMixItr", 10, 1, func(contextual *Contextual) int {
@@ -355,6 +430,7 @@ func TestClockInterruptMeetIO(t *testing.T) {
 
 func TestPipe(t *testing.T) {
 	shamOS := NewOS()
+	shamOS.Clock = NewVirtualClock()
 	shamOS.Scheduler = FCFSScheduler{}
 	shamOS.ReadyProcs = []*Process{} // No Noop
 
@@ -474,6 +550,7 @@ func TestPipe(t *testing.T) {
 
 func TestVarPool(t *testing.T) {
 	shamOS := NewOS()
+	shamOS.Clock = NewVirtualClock()
 	shamOS.Scheduler = FCFSScheduler{}
 	shamOS.ReadyProcs = []*Process{} // No Noop
 
@@ -506,6 +583,7 @@ func TestProducerConsumer(t *testing.T) {
 	// log.SetLevel(log.ErrorLevel)  // 只看标准输出
 
 	shamOS := NewOS()
+	shamOS.Clock = NewVirtualClock()
 	shamOS.Scheduler = FCFSScheduler{}
 	shamOS.ReadyProcs = []*Process{} // No Noop
 
@@ -646,3 +724,2428 @@ func TestProducerConsumer(t *testing.T) {
 
 	shamOS.Boot()
 }
+
+// jobOf 返回一个跑满 timeCost 条指令就结束的程序，结束时把自己的 pid 记到 order 里
+func jobOf(timeCost uint, order *[]string) Runnable {
+	return func(contextual *Contextual) int {
+		if contextual.PC+1 >= timeCost {
+			*order = append(*order, contextual.Process.Id)
+			return StatusDone
+		}
+		return StatusRunning
+	}
+}
+
+func TestSJFScheduler(t *testing.T) {
+	shamOS := newTestOS(SJFScheduler{})
+
+	var order []string
+
+	shamOS.CreateProcess("long", 10, 4, jobOf(4, &order))
+	shamOS.CreateProcess("short", 10, 1, jobOf(1, &order))
+	shamOS.CreateProcess("mid", 10, 2, jobOf(2, &order))
+
+	shamOS.Boot()
+
+	if fmt.Sprint(order) != "[short mid long]" {
+		t.Errorf("SJF order: got %v, want [short mid long]", order)
+	}
+}
+
+func TestSRTFScheduler(t *testing.T) {
+	shamOS := newTestOS(SRTFScheduler{})
+
+	var order []string
+
+	// long 跑到一半来了个 short，short 应当抢占 long
+	shamOS.CreateProcess("long", 10, 5, func(contextual *Contextual) int {
+		if contextual.PC == 1 {
+			contextual.OS.CreateProcess("short", 10, 1, jobOf(1, &order))
+		}
+		return jobOf(5, &order)(contextual)
+	})
+
+	shamOS.Boot()
+
+	if fmt.Sprint(order) != "[short long]" {
+		t.Errorf("SRTF order: got %v, want [short long]", order)
+	}
+}
+
+func TestPriorityScheduler(t *testing.T) {
+	shamOS := newTestOS(&PriorityScheduler{})
+
+	var order []string
+
+	shamOS.CreateProcess("low", 1, 1, jobOf(1, &order))
+	shamOS.CreateProcess("high", 10, 1, jobOf(1, &order))
+	shamOS.CreateProcess("mid", 5, 1, jobOf(1, &order))
+
+	shamOS.Boot()
+
+	if fmt.Sprint(order) != "[high mid low]" {
+		t.Errorf("priority order: got %v, want [high mid low]", order)
+	}
+}
+
+func TestPrioritySchedulerPreemptive(t *testing.T) {
+	shamOS := newTestOS(&PriorityScheduler{Preemptive: true})
+
+	var order []string
+
+	// low 跑到一半来了个 high，high 应当抢占 low
+	shamOS.CreateProcess("low", 1, 4, func(contextual *Contextual) int {
+		if contextual.PC == 1 {
+			contextual.OS.CreateProcess("high", 10, 1, jobOf(1, &order))
+		}
+		return jobOf(4, &order)(contextual)
+	})
+
+	shamOS.Boot()
+
+	if fmt.Sprint(order) != "[high low]" {
+		t.Errorf("preemptive priority order: got %v, want [high low]", order)
+	}
+}
+
+func TestPrioritySchedulerAging(t *testing.T) {
+	shamOS := newTestOS(&PriorityScheduler{Aging: Aging{Interval: 1, Step: 3}})
+
+	var order []string
+
+	// hog 每条指令都 yield，没有老化的话 low 要等到 hog 跑完才轮得到
+	shamOS.CreateProcess("hog", 10, 6, func(contextual *Contextual) int {
+		if ret := jobOf(6, &order)(contextual); ret == StatusDone {
+			return ret
+		}
+		return StatusReady
+	})
+	shamOS.CreateProcess("low", 1, 1, jobOf(1, &order))
+
+	shamOS.Boot()
+
+	if fmt.Sprint(order) != "[low hog]" {
+		t.Errorf("aging order: got %v, want [low hog]", order)
+	}
+}
+
+func TestMLFQScheduler(t *testing.T) {
+	shamOS := newTestOS(&MLFQScheduler{Quanta: []uint{2, 4}})
+
+	var order []string
+
+	// cpu 会用完时间片被降级；io 每条指令都主动让出 CPU，一直留在最高级，后来居上
+	shamOS.CreateProcess("cpu", 10, 6, jobOf(6, &order))
+	shamOS.CreateProcess("io", 10, 3, func(contextual *Contextual) int {
+		if ret := jobOf(3, &order)(contextual); ret == StatusDone {
+			return ret
+		}
+		return StatusReady
+	})
+
+	shamOS.Boot()
+
+	if fmt.Sprint(order) != "[io cpu]" {
+		t.Errorf("MLFQ order: got %v, want [io cpu]", order)
+	}
+}
+
+func TestQuantum(t *testing.T) {
+	shamOS := newTestOS(FCFSScheduler{TimeSlice{Quantum: 2}})
+
+	var order []string
+
+	// 时间片为 2：long 跑 2 条指令就得让给 short
+	shamOS.CreateProcess("long", 10, 6, jobOf(6, &order))
+	shamOS.CreateProcess("short", 10, 2, jobOf(2, &order))
+
+	shamOS.Boot()
+
+	if fmt.Sprint(order) != "[short long]" {
+		t.Errorf("round-robin order: got %v, want [short long]", order)
+	}
+}
+
+func TestProcessQuantum(t *testing.T) {
+	for _, scheduler := range []Scheduler{
+		FCFSScheduler{TimeSlice{Quantum: NoQuantum}},
+		&MLFQScheduler{Quanta: []uint{NoQuantum}},
+	} {
+		shamOS := newTestOS(scheduler)
+
+		var order []string
+
+		// 调度器不做时间片轮转，但 long 自己设置了时间片 2
+		shamOS.CreateProcess("long", 10, 6, jobOf(6, &order))
+		shamOS.CreateProcess("short", 10, 2, jobOf(2, &order))
+		shamOS.FindProcess("long").Quantum = 2
+
+		shamOS.Boot()
+
+		if fmt.Sprint(order) != "[short long]" {
+			t.Errorf("%T: per process quantum order: got %v, want [short long]", scheduler, order)
+		}
+	}
+}
+
+func TestVirtualClock(t *testing.T) {
+	shamOS := NewOS()
+	shamOS.Clock = NewVirtualClock()
+	shamOS.Scheduler = FCFSScheduler{}
+	shamOS.ReadyProcs = []*Process{} // No Noop
+
+	var order []string
+	shamOS.CreateProcess("processFoo", 10, 5, jobOf(5, &order))
+
+	start := time.Now()
+	shamOS.Boot()
+
+	if shamOS.Clock.Now() != 5 {
+		t.Errorf("clock: got %v ticks, want 5", shamOS.Clock.Now())
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("virtual clock should not sleep, but 5 ticks took %v", elapsed)
+	}
+}
+
+// deterministicRun 用 seed 生成一组随机长度的进程，在确定模式下运行，返回执行过的指令序列
+func deterministicRun(seed int64) []string {
+	shamOS := NewOS()
+	shamOS.SetDeterministic(seed)
+	shamOS.Scheduler = FCFSScheduler{TimeSlice{Quantum: 2}}
+	shamOS.ReadyProcs = []*Process{} // No Noop
+
+	var trace []string
+
+	for i := 0; i < 5; i++ {
+		timeCost := uint(1 + shamOS.Rand.Intn(5))
+		shamOS.CreateProcess(fmt.Sprintf("p%d", i), 10, timeCost, func(contextual *Contextual) int {
+			trace = append(trace, fmt.Sprintf("%s@%d", contextual.Process.Id, contextual.PC))
+			if contextual.PC == 0 {
+				ch := make(chan interface{}, 1)
+				ch <- contextual.Process.Id
+				contextual.OS.InterruptRequest(contextual.Process.Thread, StdOutInterrupt, ch)
+			}
+			if contextual.PC+1 >= timeCost {
+				return StatusDone
+			}
+			return StatusRunning
+		})
+	}
+
+	shamOS.Boot()
+
+	return trace
+}
+
+func TestDeterministic(t *testing.T) {
+	want := deterministicRun(42)
+	for i := 0; i < 5; i++ {
+		if got := deterministicRun(42); fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Fatalf("run %d differs:\ngot  %v\nwant %v", i, got, want)
+		}
+	}
+}
+
+func TestReport(t *testing.T) {
+	shamOS := newTestOS(FCFSScheduler{TimeSlice{Quantum: NoQuantum}})
+
+	var order []string
+	shamOS.CreateProcess("a", 10, 3, jobOf(3, &order))
+	shamOS.CreateProcess("b", 10, 2, jobOf(2, &order))
+
+	shamOS.Boot()
+
+	report := shamOS.Report()
+	fmt.Print(report)
+
+	// a: 0~3 运行；b: 0~3 等待，3~5 运行
+	if report.AvgTurnaround != 4 || report.AvgWaiting != 1.5 || report.AvgResponse != 1.5 {
+		t.Errorf("averages: got turnaround %v, waiting %v, response %v, want 4, 1.5, 1.5",
+			report.AvgTurnaround, report.AvgWaiting, report.AvgResponse)
+	}
+	if report.ContextSwitches != 1 || report.TotalTime != 5 || report.Utilization != 1 || report.Throughput != 0.4 {
+		t.Errorf("aggregate: got %+v", report)
+	}
+}
+
+func TestGantt(t *testing.T) {
+	shamOS := newTestOS(FCFSScheduler{TimeSlice{Quantum: 2}})
+
+	var order []string
+	shamOS.CreateProcess("a", 10, 3, jobOf(3, &order))
+	shamOS.CreateProcess("b", 10, 2, jobOf(2, &order))
+
+	shamOS.Boot()
+
+	// 时间片用尽时处理时钟中断还要花一个周期
+	fmt.Print(shamOS.Gantt.ASCII())
+	want := "pid,start,end,duration\na,0,2,2\nb,3,5,2\na,6,7,1\n"
+
+	var csv strings.Builder
+	if err := shamOS.Gantt.WriteCSV(&csv); err != nil {
+		t.Fatal(err)
+	}
+	if csv.String() != want {
+		t.Errorf("csv:\ngot\n%s\nwant\n%s", csv.String(), want)
+	}
+
+	var svg strings.Builder
+	if err := shamOS.Gantt.WriteSVG(&svg); err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(svg.String(), "<rect"); n != 3 {
+		t.Errorf("svg: got %d rects, want 3", n)
+	}
+
+	// 时间片用尽的进程直接回到就绪队列，等 CPU 的时间算作就绪，不算阻塞
+	for _, e := range shamOS.Tracer.Events {
+		if e.Type == EventTransition && e.To == StatusName(StatusBlocked) {
+			t.Errorf("%s: blocked after being preempted, want ready", e.Pid)
+		}
+	}
+}
+
+func TestTraceReplay(t *testing.T) {
+	shamOS := newTestOS(FCFSScheduler{TimeSlice{Quantum: NoQuantum}})
+
+	var order []string
+	shamOS.CreateProcess("a", 10, 2, func(contextual *Contextual) int {
+		if contextual.PC == 0 {
+			ch := make(chan interface{}, 1)
+			ch <- "hello"
+			contextual.OS.InterruptRequest(contextual.Process.Thread, StdOutInterrupt, ch)
+		}
+		return jobOf(2, &order)(contextual)
+	})
+	shamOS.CreateProcess("b", 10, 1, jobOf(1, &order))
+
+	shamOS.Boot()
+
+	var jsonl strings.Builder
+	if err := shamOS.Tracer.WriteJSONL(&jsonl); err != nil {
+		t.Fatal(err)
+	}
+	fmt.Print(jsonl.String())
+
+	events, err := ReadTrace(strings.NewReader(jsonl.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(events) != fmt.Sprint(shamOS.Tracer.Events) {
+		t.Fatalf("ReadTrace: got %v, want %v", events, shamOS.Tracer.Events)
+	}
+
+	replay := NewReplay(events)
+	for tick, want := range map[uint]string{
+		0: "{a [b] [] [] [] [] [] [] []}",  // a 先跑
+		1: "{ [b a] [] [] [] [] [] [] []}", // a 输出时阻塞，中断处理完 a 回到就绪队列
+		2: "{b [a] [] [] [] [] [] [] []}",  // 处理中断花了一个周期，然后 b 上 CPU
+		4: "{ [] [] [b a] [] [] [] [] []}", // 都跑完了
+	} {
+		if got := fmt.Sprint(replay.At(tick)); got != want {
+			t.Errorf("replay at %d: got %v, want %v", tick, got, want)
+		}
+	}
+}
+
+// newTestOS 返回测试用的 OS：确定性运行，用 scheduler 调度，就绪队列里没有 Noop，只跑测试创建的进程
+func newTestOS(scheduler Scheduler) *OS {
+	shamOS := NewOS()
+	shamOS.SetDeterministic(0)
+	shamOS.Scheduler = scheduler
+	shamOS.ReadyProcs = []*Process{} // No Noop
+	return shamOS
+}
+
+// countEvents 数一数 tracer 中类型为 typ、中断类型为 interrupt 的事件
+func countEvents(tracer *Tracer, typ string, interrupt string) int {
+	n := 0
+	for _, e := range tracer.Events {
+		if e.Type == typ && e.Interrupt == interrupt {
+			n++
+		}
+	}
+	return n
+}
+
+func TestPaging(t *testing.T) {
+	shamOS := newTestOS(FCFSScheduler{})
+
+	var sum int
+
+	// 往 3 个不同的页里各写一个数，再读出来加起来
+	shamOS.CreateProcess("processPaging", 10, 4, func(contextual *Contextual) int {
+		switch contextual.PC {
+		case 0:
+			contextual.Store(0, 1)
+		case 1:
+			contextual.Store(DefaultPageSize+4, 2)
+		case 2:
+			contextual.Store(2*DefaultPageSize+8, 3)
+		case 3:
+			for _, addr := range []uint{0, DefaultPageSize + 4, 2*DefaultPageSize + 8} {
+				v, ok := contextual.Load(addr)
+				if !ok {
+					t.Errorf("load %d: unexpected page fault", addr)
+					return StatusDone
+				}
+				sum += v.(int)
+			}
+			return StatusDone
+		}
+		return StatusRunning
+	})
+
+	shamOS.Boot()
+
+	if sum != 6 {
+		t.Errorf("sum: got %d, want 6", sum)
+	}
+	if n := countEvents(shamOS.Tracer, EventInterruptRaised, PageFaultInterrupt); n != 3 {
+		t.Errorf("page faults: got %d, want 3", n)
+	}
+	if free := shamOS.PhysMem.FreeFrames(); free != DefaultFrames {
+		t.Errorf("free frames after exit: got %d, want %d", free, DefaultFrames)
+	}
+}
+
+// beladyString 是经典的 Belady 异常访问串（页号）
+var beladyString = []uint{1, 2, 3, 4, 1, 2, 5, 1, 2, 3, 4, 5}
+
+// runReferenceString 在只有 frames 个页框的内存上，用 replacer 跑一遍访问串 pages，
+// 返回运行报告和记录下来的访问串
+func runReferenceString(frames uint, replacer PageReplacer, pages []uint) (Report, []PageRef) {
+	shamOS := newTestOS(FCFSScheduler{})
+	shamOS.PhysMem = NewPhysicalMemory(frames, DefaultPageSize)
+	shamOS.PageReplacer = replacer
+
+	shamOS.CreateProcess("processRefs", 10, uint(len(pages)), func(contextual *Contextual) int {
+		if contextual.PC >= uint(len(pages)) {
+			return StatusDone
+		}
+		contextual.Load(pages[contextual.PC] * DefaultPageSize)
+		return StatusRunning
+	})
+
+	shamOS.Boot()
+
+	return shamOS.Report(), shamOS.PhysMem.References
+}
+
+func TestBeladyAnomaly(t *testing.T) {
+	three, _ := runReferenceString(3, &FIFOReplacer{}, beladyString)
+	four, _ := runReferenceString(4, &FIFOReplacer{}, beladyString)
+
+	fmt.Println("FIFO, 3 frames:", three.PageFaults, "faults; 4 frames:", four.PageFaults, "faults")
+
+	if three.PageFaults != 9 || four.PageFaults != 10 {
+		t.Errorf("FIFO faults: got %d (3 frames), %d (4 frames), want 9, 10", three.PageFaults, four.PageFaults)
+	}
+}
+
+func TestPageReplacers(t *testing.T) {
+	_, refs := runReferenceString(3, &FIFOReplacer{}, beladyString)
+	if len(refs) != len(beladyString) {
+		t.Fatalf("reference string: got %d refs, want %d", len(refs), len(beladyString))
+	}
+
+	opt, _ := runReferenceString(3, &OPTReplacer{Future: refs}, beladyString)
+	if opt.PageFaults != 7 {
+		t.Errorf("OPT faults: got %d, want 7", opt.PageFaults)
+	}
+
+	for name, replacer := range map[string]PageReplacer{
+		"FIFO":   &FIFOReplacer{},
+		"LRU":    &LRUReplacer{},
+		"Clock":  &ClockReplacer{},
+		"LFU":    &LFUReplacer{},
+		"Random": &RandomReplacer{},
+	} {
+		report, _ := runReferenceString(3, replacer, beladyString)
+
+		if report.PageFaults < opt.PageFaults {
+			t.Errorf("%s: %d faults, fewer than OPT (%d)", name, report.PageFaults, opt.PageFaults)
+		}
+		if name == "LRU" && report.PageFaults != 10 {
+			t.Errorf("LRU faults: got %d, want 10", report.PageFaults)
+		}
+	}
+}
+
+func TestHitRatio(t *testing.T) {
+	for _, tc := range []struct {
+		references, faults uint
+		want               float64
+	}{
+		{0, 0, 0},
+		{4, 1, 0.75},
+		{2, 5, 0}, // 缺页比访存多：不会因为无符号数下溢变成很大的数
+	} {
+		s := ProcessStats{References: tc.references, PageFaults: tc.faults}
+		if got := s.HitRatio(); got != tc.want {
+			t.Errorf("%d references, %d faults: got hit ratio %v, want %v", tc.references, tc.faults, got, tc.want)
+		}
+	}
+}
+
+// runThrashing 在只有 frames 个页框的内存上，让 3 个进程轮流写各自的 2 页，
+// 每次写之前先读回上一次写在这个地址的值，检查换出、换入没有丢数据
+func runThrashing(t *testing.T, frames uint) (Report, *Swap) {
+	shamOS := NewOS()
+	shamOS.SetDeterministic(0)
+	shamOS.Scheduler = FCFSScheduler{TimeSlice{Quantum: 1}}
+	shamOS.PhysMem = NewPhysicalMemory(frames, DefaultPageSize)
+	swap := shamOS.swap()
+	swap.InCost, swap.OutCost = 10, 10 // 换页比算一条指令慢得多：抖动时进程都在等换页，CPU 闲着
+
+	const steps = 8
+	for i := 0; i < 3; i++ {
+		shamOS.CreateProcess(fmt.Sprintf("thrash%d", i), 10, steps, func(contextual *Contextual) int {
+			if contextual.PC >= steps {
+				return StatusDone
+			}
+			addr := (contextual.PC % 2) * DefaultPageSize
+			v, ok := contextual.Load(addr)
+			if !ok {
+				return StatusRunning // 缺页，重新执行
+			}
+			if contextual.PC >= 2 && v != int(contextual.PC-2) {
+				t.Errorf("%s: load %d: got %v, want %d", contextual.Process.Id, addr, v, contextual.PC-2)
+			}
+			contextual.Store(addr, int(contextual.PC))
+			return StatusRunning
+		})
+	}
+
+	shamOS.Boot()
+
+	return shamOS.Report(), shamOS.Devs["swap"].(*Swap)
+}
+
+func TestSwapThrashing(t *testing.T) {
+	roomy, roomySwap := runThrashing(t, 6)
+	tight, tightSwap := runThrashing(t, 3)
+
+	if roomySwap.Outs != 0 || roomySwap.Ins != 0 {
+		t.Errorf("6 frames: got %d swap outs, %d swap ins, want none", roomySwap.Outs, roomySwap.Ins)
+	}
+	if tightSwap.Outs == 0 || tightSwap.Ins == 0 {
+		t.Errorf("3 frames: got %d swap outs, %d swap ins, want some", tightSwap.Outs, tightSwap.Ins)
+	}
+	if tight.PageFaults <= roomy.PageFaults {
+		t.Errorf("page faults: got %d (3 frames), %d (6 frames), want more with 3 frames", tight.PageFaults, roomy.PageFaults)
+	}
+	if tight.Utilization >= roomy.Utilization {
+		t.Errorf("utilization: got %.2f (3 frames), %.2f (6 frames), want lower with 3 frames", tight.Utilization, roomy.Utilization)
+	}
+}
+
+func TestPagingIOWhileBusy(t *testing.T) {
+	shamOS := newTestOS(FCFSScheduler{})
+	shamOS.PhysMem = NewPhysicalMemory(1, DefaultPageSize)
+
+	const busy = 20
+	created := false
+
+	// 只有一个页框：写第 1 页要先把写过的第 0 页换出去，换出要花时间。
+	// 换出期间 processBusy 一直在算，换出完成的中断不能等它算完才处理。
+	shamOS.CreateProcess("processPaging", 10, 3, func(contextual *Contextual) int {
+		switch contextual.PC {
+		case 0:
+			contextual.Store(0, 0)
+		case 1:
+			if !created { // 缺页后这条指令会重新执行
+				created = true
+				contextual.OS.CreateProcess("processBusy", 10, busy, func(contextual *Contextual) int {
+					if contextual.PC >= busy {
+						return StatusDone
+					}
+					return StatusRunning
+				})
+			}
+			contextual.Store(DefaultPageSize, 1)
+		default:
+			return StatusDone
+		}
+		return StatusRunning
+	})
+
+	shamOS.Boot()
+
+	for _, s := range shamOS.Report().Processes {
+		if s.Pid == "processPaging" && s.Blocked > shamOS.swap().OutCost {
+			t.Errorf("%s: blocked for %d ticks, want at most %d (the swap out)", s.Pid, s.Blocked, shamOS.swap().OutCost)
+		}
+	}
+}
+
+func TestFileSwapStore(t *testing.T) {
+	store, err := NewFileSwapStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	page := []interface{}{1, "two", nil, 4.0}
+	if err := store.Save("p-0", page); err != nil {
+		t.Fatal(err)
+	}
+	got, err := store.Load("p-0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(got) != fmt.Sprint(page) {
+		t.Errorf("load: got %v, want %v", got, page)
+	}
+
+	store.Delete("p-0")
+	if _, err := store.Load("p-0"); err == nil {
+		t.Errorf("load after delete: want error")
+	}
+
+	// pid 里的 "/"、".." 不能让页文件跑到 Dir 外面去
+	for _, key := range []string{"../p-0", "a/b-0", "a%2Fb-0"} {
+		if err := store.Save(key, []interface{}{key}); err != nil {
+			t.Errorf("save %q: %v", key, err)
+		}
+	}
+	for _, key := range []string{"../p-0", "a/b-0", "a%2Fb-0"} {
+		if got, err := store.Load(key); err != nil || fmt.Sprint(got) != fmt.Sprint([]interface{}{key}) {
+			t.Errorf("load %q: got %v, %v", key, got, err)
+		}
+	}
+	if entries, _ := os.ReadDir(filepath.Dir(store.Dir)); len(entries) != 1 {
+		t.Errorf("page files outside the store directory: %v", entries)
+	}
+}
+
+// allocSequence 在大小为 24 的堆上，先占满再释放出 3 个空洞 [0,5) [8,12) [14,20)，
+// 然后依次申请 3、4、2 个字，返回这三次分配的地址
+func allocSequence(t *testing.T, allocator HeapAllocator) ([]uint, HeapStats) {
+	heap := NewHeap(24, allocator)
+
+	var fill []Handle
+	for _, size := range []uint{5, 3, 4, 2, 6, 4} {
+		h, ok := heap.Alloc("p", size)
+		if !ok {
+			t.Fatalf("fill: alloc %d failed", size)
+		}
+		fill = append(fill, h)
+	}
+	for _, i := range []int{0, 2, 4} {
+		heap.Free("p", fill[i])
+	}
+
+	var addrs []uint
+	for _, size := range []uint{3, 4, 2} {
+		h, ok := heap.Alloc("p", size)
+		if !ok {
+			t.Fatalf("alloc %d failed", size)
+		}
+		addrs = append(addrs, heap.Blocks[h].Addr)
+	}
+	return addrs, heap.Stats()
+}
+
+func TestHeapPlacement(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		allocator HeapAllocator
+		want      []uint
+	}{
+		{"FirstFit", &FirstFit{}, []uint{0, 8, 3}},
+		{"BestFit", &BestFit{}, []uint{8, 0, 14}},
+		{"WorstFit", &WorstFit{}, []uint{14, 0, 8}},
+		{"NextFit", &NextFit{}, []uint{0, 8, 14}},
+	} {
+		got, stats := allocSequence(t, tc.allocator)
+
+		if fmt.Sprint(got) != fmt.Sprint(tc.want) {
+			t.Errorf("%s: got %v, want %v", tc.name, got, tc.want)
+		}
+		if stats.Free != 6 || stats.InternalFragmentation != 0 {
+			t.Errorf("%s: free %d, internal fragmentation %.2f, want 6, 0", tc.name, stats.Free, stats.InternalFragmentation)
+		}
+	}
+}
+
+func TestBuddyAllocator(t *testing.T) {
+	heap := NewHeap(24, &BuddyAllocator{}) // 只用到前 16 个字
+
+	var addrs []uint
+	var handles []Handle
+	for _, size := range []uint{3, 5, 4} {
+		h, ok := heap.Alloc("p", size)
+		if !ok {
+			t.Fatalf("alloc %d failed", size)
+		}
+		addrs = append(addrs, heap.Blocks[h].Addr)
+		handles = append(handles, h)
+	}
+	if fmt.Sprint(addrs) != "[0 8 4]" {
+		t.Errorf("addrs: got %v, want [0 8 4]", addrs)
+	}
+	if _, ok := heap.Alloc("p", 1); ok {
+		t.Errorf("alloc in full heap: want failure")
+	}
+
+	stats := heap.Stats()
+	if stats.Allocated != 16 || stats.Requested != 12 || stats.InternalFragmentation != 0.25 {
+		t.Errorf("stats: got %+v, want 16 allocated, 12 requested, internal fragmentation 0.25", stats)
+	}
+
+	for _, h := range handles {
+		heap.Free("p", h)
+	}
+	if stats := heap.Stats(); stats.Holes != 1 || stats.LargestHole != 16 {
+		t.Errorf("after free: got %d holes, largest %d, want 1 hole of 16", stats.Holes, stats.LargestHole)
+	}
+}
+
+func TestHeapSyscalls(t *testing.T) {
+	shamOS := newTestOS(FCFSScheduler{})
+
+	var owner Handle
+	var sum int
+
+	shamOS.CreateProcess("processHeapOwner", 10, 3, func(contextual *Contextual) int {
+		switch contextual.PC {
+		case 0:
+			owner, _ = contextual.Malloc(4)
+			for i := uint(0); i < 4; i++ {
+				contextual.HeapStore(owner, i, int(i))
+			}
+		case 1:
+			for i := uint(0); i < 4; i++ {
+				v, _ := contextual.HeapLoad(owner, i)
+				sum += v.(int)
+			}
+			if contextual.HeapStore(owner, 4, 4) {
+				t.Errorf("store out of bounds: want failure")
+			}
+			return StatusDone
+		}
+		return StatusRunning
+	})
+	shamOS.CreateProcess("processHeapOther", 10, 1, func(contextual *Contextual) int {
+		if _, ok := contextual.HeapLoad(owner, 0); ok {
+			t.Errorf("load other's block: want failure")
+		}
+		if contextual.Free(owner) {
+			t.Errorf("free other's block: want failure")
+		}
+		return StatusDone
+	})
+
+	shamOS.Boot()
+
+	if sum != 6 {
+		t.Errorf("sum: got %d, want 6", sum)
+	}
+	report := shamOS.Report()
+	if report.Heap.Allocs != 1 || report.Heap.Allocated != 0 {
+		t.Errorf("heap report: got %+v, want 1 alloc, reclaimed on exit", report.Heap)
+	}
+}
+
+func TestReclaim(t *testing.T) {
+	shamOS := newTestOS(FCFSScheduler{})
+	shamOS.PhysMem = NewPhysicalMemory(2, DefaultPageSize)
+
+	var proc *Process
+
+	shamOS.CreateProcess("processGreedy", 10, 4, func(contextual *Contextual) int {
+		proc = contextual.Process
+		switch contextual.PC {
+		case 0:
+			contextual.InitVarPool()
+			contextual.Malloc(8)
+			ch := make(chan interface{}, 2)
+			ch <- "pipeGreedy"
+			ch <- 1
+			contextual.OS.InterruptRequest(contextual.Process.Thread, NewPipeInterrupt, ch)
+		case 1:
+			contextual.Store(0, 1)
+		case 2:
+			contextual.Store(DefaultPageSize, 2)
+		case 3:
+			contextual.Store(2*DefaultPageSize, 3) // 换出第 0 页到交换区
+		default:
+			return StatusDone
+		}
+		return StatusRunning
+	})
+
+	shamOS.Boot()
+
+	if len(shamOS.Mem) != 0 {
+		t.Errorf("os.Mem: got %v, want empty", shamOS.Mem)
+	}
+	if free := shamOS.PhysMem.FreeFrames(); free != 2 {
+		t.Errorf("free frames: got %d, want 2", free)
+	}
+	if n := len(shamOS.Heap.Blocks); n != 0 {
+		t.Errorf("heap blocks: got %d, want 0", n)
+	}
+	if n := len(shamOS.swap().Store.(*MemorySwapStore).pages); n != 0 {
+		t.Errorf("swapped pages: got %d, want 0", n)
+	}
+	if n := len(proc.Devices); n != 0 {
+		t.Errorf("process devices: got %d, want 0", n)
+	}
+	if _, ok := shamOS.Devs["pipeGreedy"]; !ok {
+		t.Errorf("pipe destroyed on exit: want it kept in os.Devs")
+	}
+	if shamOS.RunningProc != nil || shamOS.FindProcess("processGreedy") != nil {
+		t.Errorf("process still in the process table")
+	}
+}
+
+// runOOM 在大小为 16 的堆上，让 a（优先级 5）申请 8 个字、b（优先级 1）申请 4 个字，
+// 然后 c 申请 8 个字，堆放不下，由 policy 选出一个进程杀掉。返回各进程结束的原因。
+func runOOM(t *testing.T, policy OOMPolicy) map[string]string {
+	shamOS := newTestOS(FCFSScheduler{})
+	shamOS.Heap = NewHeap(16, &FirstFit{})
+	shamOS.OOMPolicy = policy
+
+	hog := func(size uint) Runnable {
+		return func(contextual *Contextual) int {
+			switch {
+			case contextual.PC == 0:
+				if _, ok := contextual.Malloc(size); !ok {
+					t.Errorf("%s: malloc %d failed", contextual.Process.Id, size)
+				}
+				return StatusReady
+			case contextual.PC < 3:
+				return StatusReady
+			}
+			return StatusDone
+		}
+	}
+	shamOS.CreateProcess("a", 5, 3, hog(8))
+	shamOS.CreateProcess("b", 1, 3, hog(4))
+	shamOS.CreateProcess("c", 9, 3, hog(8))
+
+	shamOS.Boot()
+
+	reasons := map[string]string{}
+	for _, s := range shamOS.Report().Processes {
+		reasons[s.Pid] = s.ExitReason
+	}
+	return reasons
+}
+
+func TestOOMKiller(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		policy OOMPolicy
+		victim string
+	}{
+		{"LargestResident", OOMLargestResident, "a"},
+		{"LowestPrecedence", OOMLowestPrecedence, "b"},
+		{"MostRecent", OOMMostRecent, "b"},
+	} {
+		reasons := runOOM(t, tc.policy)
+		for _, pid := range []string{"a", "b", "c"} {
+			want := ExitNormal
+			if pid == tc.victim {
+				want = ExitOOMKilled
+			}
+			if reasons[pid] != want {
+				t.Errorf("%s: %s exit reason: got %q, want %q", tc.name, pid, reasons[pid], want)
+			}
+		}
+	}
+}
+
+func TestOOMKillerFrames(t *testing.T) {
+	shamOS := newTestOS(FCFSScheduler{})
+	shamOS.PhysMem = NewPhysicalMemory(2, DefaultPageSize)
+	delete(shamOS.Devs, "swap") // 没有交换区：页框用完就只能杀进程
+
+	// yield 先做 first，然后让出 CPU，一共运行 4 条指令
+	yield := func(first func(contextual *Contextual) bool) Runnable {
+		return func(contextual *Contextual) int {
+			switch {
+			case contextual.PC == 0:
+				if !first(contextual) {
+					return StatusRunning // 缺页，重新执行
+				}
+				return StatusReady
+			case contextual.PC < 4:
+				return StatusReady
+			}
+			return StatusDone
+		}
+	}
+	// heapy 堆上占得最多，但一个页框也没有：杀掉它腾不出页框
+	shamOS.CreateProcess("heapy", 10, 4, yield(func(contextual *Contextual) bool {
+		contextual.Malloc(4 * DefaultPageSize)
+		return true
+	}))
+	shamOS.CreateProcess("framey", 10, 4, yield(func(contextual *Contextual) bool {
+		return contextual.Store(0, 1)
+	}))
+	shamOS.CreateProcess("c", 10, 4, yield(func(contextual *Contextual) bool {
+		return contextual.Store(0, 1) && contextual.Store(DefaultPageSize, 2)
+	}))
+
+	shamOS.Boot()
+
+	for _, s := range shamOS.Report().Processes {
+		want := ExitNormal
+		if s.Pid == "framey" {
+			want = ExitOOMKilled
+		}
+		if s.ExitReason != want {
+			t.Errorf("%s exit reason: got %q, want %q", s.Pid, s.ExitReason, want)
+		}
+	}
+}
+
+func TestOutOfFrames(t *testing.T) {
+	shamOS := newTestOS(FCFSScheduler{})
+	shamOS.PhysMem = NewPhysicalMemory(0, DefaultPageSize)
+
+	// 一个页框也没有：缺页时怎么也分配不到，进程要被杀掉，而不是一直缺页
+	shamOS.CreateProcess("processNoFrame", 10, 2, func(contextual *Contextual) int {
+		if contextual.PC == 0 {
+			contextual.Store(0, 1)
+			return StatusRunning
+		}
+		return StatusDone
+	})
+
+	shamOS.Boot()
+
+	s := shamOS.Report().Processes[0]
+	if s.ExitReason != ExitOOMKilled {
+		t.Errorf("exit reason: got %q, want %q", s.ExitReason, ExitOOMKilled)
+	}
+	if s.PageFaults != 1 {
+		t.Errorf("page faults: got %d, want 1", s.PageFaults)
+	}
+}
+
+// TestKilledBeforeRun 就绪时被杀掉、没上过 CPU 的进程没有响应时间，不计入平均响应时间
+func TestKilledBeforeRun(t *testing.T) {
+	shamOS := newTestOS(FCFSScheduler{TimeSlice{Quantum: NoQuantum}})
+
+	shamOS.CreateProcess("killer", 10, 3, func(contextual *Contextual) int {
+		switch contextual.PC {
+		case 1: // 过了一个时钟周期才创建，到达时刻不是 0
+			contextual.CreateChild("victim", 10, 1, func(contextual *Contextual) int {
+				return StatusDone
+			})
+		case 2:
+			if !contextual.Kill("victim", SIGKILL) {
+				t.Errorf("kill victim failed")
+			}
+		case 3:
+			return StatusDone
+		}
+		return StatusRunning
+	})
+
+	shamOS.Boot()
+
+	report := shamOS.Report()
+	for _, s := range report.Processes {
+		if s.Pid == "victim" && (s.Started || s.Arrival == 0 || s.Response() != 0) {
+			t.Errorf("victim: started %v, arrival %d, response %d, want killed after time 0 before running", s.Started, s.Arrival, s.Response())
+		}
+	}
+	if report.AvgResponse != 0 {
+		t.Errorf("average response: got %.2f, want 0 (only killer ran, right away)", report.AvgResponse)
+	}
+	if strings.Contains(report.String(), "18446744") {
+		t.Errorf("report shows a wrapped response time:\n%s", report)
+	}
+}
+
+func TestMemoryLimit(t *testing.T) {
+	shamOS := newTestOS(FCFSScheduler{})
+
+	var maxResident uint
+	var mallocOK bool
+
+	// 配额两页，却要轮流写三页：只能换出自己的页
+	shamOS.CreateProcessWithLimit("processLimited", 10, 7, 2*DefaultPageSize, func(contextual *Contextual) int {
+		if contextual.PC < 6 {
+			contextual.Store((contextual.PC%3)*DefaultPageSize, int(contextual.PC))
+			if r := shamOS.residentSize(contextual.Process); r > maxResident {
+				maxResident = r
+			}
+			return StatusRunning
+		}
+		_, mallocOK = contextual.Malloc(1)
+		return StatusDone
+	})
+
+	shamOS.Boot()
+
+	if maxResident != 2*DefaultPageSize {
+		t.Errorf("max resident: got %d, want %d", maxResident, 2*DefaultPageSize)
+	}
+	if mallocOK {
+		t.Errorf("malloc beyond memory limit: want failure")
+	}
+	if outs := shamOS.swap().Outs; outs == 0 {
+		t.Errorf("swap outs: got 0, want some (plenty of free frames, but over the limit)")
+	}
+}
+
+func TestSharedMemoryRace(t *testing.T) {
+	shamOS := newTestOS(FCFSScheduler{TimeSlice{Quantum: 1}})
+
+	const increments = 5
+	var final int
+
+	// counter++ 拆成两条指令：先读出来，再加一写回去。时间片只有 1，两个进程交替执行，会丢失更新。
+	incrementer := func(contextual *Contextual) int {
+		switch pc := contextual.PC; {
+		case pc == 0:
+			contextual.ShmGet("counter", 1)
+			contextual.ShmAt("counter")
+		case pc <= 2*increments && pc%2 == 1:
+			v, _ := contextual.ShmLoad("counter", 0)
+			n, _ := v.(int)
+			contextual.InitVarPool()
+			contextual.SetVar("n", n)
+		case pc <= 2*increments:
+			contextual.ShmStore("counter", 0, contextual.GetVar("n").(int)+1)
+		default:
+			v, _ := contextual.ShmLoad("counter", 0)
+			final = v.(int)
+			contextual.ShmDt("counter")
+			return StatusDone
+		}
+		return StatusRunning
+	}
+	shamOS.CreateProcess("incrementer1", 10, 2*increments+2, incrementer)
+	shamOS.CreateProcess("incrementer2", 10, 2*increments+2, incrementer)
+
+	shamOS.Boot()
+
+	t.Logf("counter: %d (want %d without races)", final, 2*increments)
+	if final >= 2*increments {
+		t.Errorf("counter: got %d, want lost updates (< %d)", final, 2*increments)
+	}
+	if len(shamOS.Shm) != 0 {
+		t.Errorf("segments after last detach: got %d, want 0", len(shamOS.Shm))
+	}
+	if n := countEvents(shamOS.Tracer, EventShmDestroyed, ""); n != 1 {
+		t.Errorf("segments destroyed: got %d, want 1", n)
+	}
+}
+
+func TestSharedMemoryLifetime(t *testing.T) {
+	shamOS := newTestOS(FCFSScheduler{})
+
+	var usage uint
+	var bigAttached, removed bool
+
+	// 配额 8 个字：挂接 4 个字的段可以，再挂接 16 个字的段就超了
+	shamOS.CreateProcessWithLimit("processShm", 10, 1, 8, func(contextual *Contextual) int {
+		contextual.ShmGet("small", 4)
+		contextual.ShmAt("small")
+		usage = shamOS.memoryUsage(contextual.Process)
+
+		contextual.ShmGet("big", 16)
+		bigAttached = contextual.ShmAt("big")
+		removed = contextual.ShmRm("big") // 没有进程挂接，马上销毁
+
+		contextual.ShmRm("small") // 还挂接着，解除挂接时才销毁
+		contextual.ShmDt("small")
+		return StatusDone
+	})
+
+	shamOS.Boot()
+
+	if usage != 4 {
+		t.Errorf("memory usage with a 4-word segment attached: got %d, want 4", usage)
+	}
+	if bigAttached {
+		t.Errorf("attach beyond memory limit: want failure")
+	}
+	if !removed {
+		t.Errorf("remove a segment nobody attached: want success")
+	}
+	if len(shamOS.Shm) != 0 {
+		t.Errorf("segments: got %d, want 0", len(shamOS.Shm))
+	}
+	if n := countEvents(shamOS.Tracer, EventShmDestroyed, ""); n != 2 {
+		t.Errorf("segments destroyed: got %d, want 2", n)
+	}
+	if free := shamOS.SegMem.Stats().Free; free != DefaultSegMemSize {
+		t.Errorf("free segment memory: got %d, want %d", free, DefaultSegMemSize)
+	}
+}
+
+func TestSegmentation(t *testing.T) {
+	shamOS := newTestOS(FCFSScheduler{})
+	shamOS.MemoryModel = MemorySegmented
+
+	var got interface{}
+	var afterFault bool
+
+	shamOS.CreateProcess("processSegments", 10, 3, func(contextual *Contextual) int {
+		switch contextual.PC {
+		case 0:
+			contextual.Store(SegAddr(SegmentData, 3), "data")
+			contextual.Store(SegAddr(SegmentStack, DefaultSegmentSizes[SegmentStack]-1), "top")
+		case 1:
+			got, _ = contextual.Load(SegAddr(SegmentData, 3))
+			contextual.Load(SegAddr(SegmentStack, DefaultSegmentSizes[SegmentStack])) // 越界
+		default:
+			afterFault = true
+			return StatusDone
+		}
+		return StatusRunning
+	})
+	shamOS.CreateProcess("processWriteCode", 10, 1, func(contextual *Contextual) int {
+		if _, ok := contextual.Load(SegAddr(SegmentCode, 0)); !ok {
+			t.Errorf("read code segment: want ok")
+		}
+		contextual.Store(SegAddr(SegmentCode, 0), "patch") // 代码段只读
+		return StatusDone
+	})
+
+	shamOS.Boot()
+
+	if got != "data" {
+		t.Errorf("load data segment: got %v, want data", got)
+	}
+	if afterFault {
+		t.Errorf("process kept running after segmentation fault")
+	}
+	for _, s := range shamOS.Report().Processes {
+		if s.ExitReason != ExitSegmentationFault {
+			t.Errorf("%s exit reason: got %q, want %q", s.Pid, s.ExitReason, ExitSegmentationFault)
+		}
+	}
+	if n := len(shamOS.SegMem.Blocks); n != 0 {
+		t.Errorf("segments after exit: got %d, want 0", n)
+	}
+}
+
+// TestSegmentLimits 段算在内存配额里，超出配额的段不分配；SegMem 放不下时 OOM killer 杀掉占着段内存的进程
+func TestSegmentLimits(t *testing.T) {
+	shamOS := newTestOS(FCFSScheduler{})
+	shamOS.MemoryModel = MemorySegmented
+	sizes := shamOS.SegmentSizes
+	done := func(contextual *Contextual) int { return StatusDone }
+
+	// 配额只放得下代码段和数据段
+	shamOS.CreateProcessWithLimit("limited", 10, 1, sizes[SegmentCode]+sizes[SegmentData], done)
+	p := shamOS.FindProcess("limited")
+	if p.Segments[SegmentData].Limit == 0 || p.Segments[SegmentStack].Limit != 0 || p.Segments[SegmentHeap].Limit != 0 {
+		t.Errorf("segment limits %v, want code and data only", p.Segments)
+	}
+	if usage := shamOS.memoryUsage(p); usage > p.MemoryLimit {
+		t.Errorf("memory usage %d over the limit %d", usage, p.MemoryLimit)
+	}
+
+	// SegMem 只放得下一个进程的段，后来的进程要杀掉先来的才放得下
+	var total uint
+	for _, size := range sizes {
+		total += size
+	}
+	shamOS = newTestOS(FCFSScheduler{})
+	shamOS.MemoryModel = MemorySegmented
+	shamOS.SegMem = NewHeap(total+total/2, &FirstFit{})
+	shamOS.CreateProcess("first", 10, 1, done)
+	shamOS.CreateProcess("second", 10, 1, done)
+
+	if got := countEvents(shamOS.Tracer, EventOOMKill, ""); got != 1 {
+		t.Errorf("OOM kills: got %d, want 1", got)
+	}
+	for _, e := range shamOS.Tracer.Events {
+		if e.Type == EventOOMKill && (e.Pid != "first" || e.Data != fmt.Sprintf("%s=%d", OOMSegments, total)) {
+			t.Errorf("OOM killed %s (%s), want first for its segments", e.Pid, e.Data)
+		}
+	}
+	second := shamOS.FindProcess("second")
+	for seg, size := range sizes {
+		if second.Segments[seg].Limit != size {
+			t.Errorf("second: %s segment limit %d, want %d", segmentNames[seg], second.Segments[seg].Limit, size)
+		}
+	}
+}
+
+// runFork 父进程写 4 页，fork 之后子进程只改写第 0 页，父子进程再各自读回所有的页。
+// 返回运行报告，以及父、子进程读到的值。
+func runFork(t *testing.T, cow bool) (Report, map[string][]interface{}) {
+	shamOS := newTestOS(FCFSScheduler{})
+	shamOS.CopyOnWrite = cow
+
+	const pages = 4
+	seen := map[string][]interface{}{}
+
+	shamOS.CreateProcess("parent", 10, pages+3, func(contextual *Contextual) int {
+		pc := contextual.PC
+		switch {
+		case pc < pages:
+			contextual.InitVarPool()
+			contextual.SetVar("role", "parent")
+			contextual.Store(pc*DefaultPageSize, fmt.Sprintf("page%d", pc))
+		case pc == pages:
+			pid, ok := contextual.Fork()
+			if !ok {
+				t.Errorf("fork failed")
+				return StatusDone
+			}
+			if pid == "" {
+				contextual.SetVar("role", "child")
+			}
+		case pc == pages+1:
+			if contextual.GetVar("role") == "child" {
+				contextual.Store(0, "child")
+			}
+		default:
+			var values []interface{}
+			for page := uint(0); page < pages; page++ {
+				v, ok := contextual.Load(page * DefaultPageSize)
+				if !ok {
+					return StatusRunning // 缺页，重新执行
+				}
+				values = append(values, v)
+			}
+			seen[contextual.GetVar("role").(string)] = values
+			return StatusDone
+		}
+		return StatusRunning
+	})
+
+	shamOS.Boot()
+
+	return shamOS.Report(), seen
+}
+
+func TestFork(t *testing.T) {
+	// forkLatency 父进程在 fork 里阻塞了多久
+	forkLatency := map[bool]uint{}
+
+	for _, cow := range []bool{true, false} {
+		report, seen := runFork(t, cow)
+		forkLatency[cow] = report.Processes[0].Blocked
+		t.Logf("copy on write: %v, page copies: %d, fork latency: %d", cow, report.PageCopies, forkLatency[cow])
+
+		if got := fmt.Sprint(seen["parent"]); got != "[page0 page1 page2 page3]" {
+			t.Errorf("cow %v: parent sees %s", cow, got)
+		}
+		if got := fmt.Sprint(seen["child"]); got != "[child page1 page2 page3]" {
+			t.Errorf("cow %v: child sees %s", cow, got)
+		}
+
+		want := uint(4)
+		if cow {
+			want = 1 // 只有子进程写的那一页
+		}
+		if report.PageCopies != want {
+			t.Errorf("cow %v: page copies: got %d, want %d", cow, report.PageCopies, want)
+		}
+	}
+
+	if forkLatency[true] >= forkLatency[false] {
+		t.Errorf("fork latency: got %d with copy on write, %d without, want less with copy on write", forkLatency[true], forkLatency[false])
+	}
+}
+
+func TestForkHeap(t *testing.T) {
+	shamOS := newTestOS(FCFSScheduler{TimeSlice{Quantum: 1}})
+
+	seen := map[string]interface{}{}
+
+	// 句柄放在变量池里（fork 时复制），父子进程用同一个句柄，各写各的那份
+	shamOS.CreateProcess("processHeap", 10, 5, func(contextual *Contextual) int {
+		switch contextual.PC {
+		case 0:
+			contextual.InitVarPool()
+			handle, _ := contextual.Malloc(2)
+			contextual.HeapStore(handle, 0, "parent")
+			contextual.SetVar("handle", handle)
+		case 1:
+			pid, ok := contextual.Fork()
+			if !ok {
+				t.Errorf("fork failed")
+				return StatusDone
+			}
+			contextual.SetVar("child", pid == "")
+		case 2:
+			if contextual.GetVar("child").(bool) {
+				contextual.HeapStore(contextual.GetVar("handle").(Handle), 0, "child")
+			}
+		case 3:
+			v, ok := contextual.HeapLoad(contextual.GetVar("handle").(Handle), 0)
+			if !ok {
+				t.Errorf("%s: load through the inherited handle failed", contextual.Process.Id)
+			}
+			seen[fmt.Sprint(contextual.GetVar("child"))] = v
+		case 4:
+			if !contextual.Free(contextual.GetVar("handle").(Handle)) {
+				t.Errorf("%s: free through the inherited handle failed", contextual.Process.Id)
+			}
+		default:
+			return StatusDone
+		}
+		return StatusRunning
+	})
+
+	shamOS.Boot()
+
+	if seen["false"] != "parent" || seen["true"] != "child" {
+		t.Errorf("heap after fork: parent sees %v, child sees %v, want parent, child", seen["false"], seen["true"])
+	}
+	if n := len(shamOS.Heap.Blocks); n != 0 {
+		t.Errorf("heap blocks: got %d, want 0", n)
+	}
+}
+
+// TestHeapForkRollback 子进程的块放不下时 Heap.Fork 回滚，统计里不算已经复制了的块
+func TestHeapForkRollback(t *testing.T) {
+	heap := NewHeap(6, &FirstFit{})
+	heap.Alloc("parent", 2)
+	heap.Alloc("parent", 2)
+
+	if heap.Fork("parent", "child") {
+		t.Fatalf("fork 4 words into 2 free words: want failure")
+	}
+	stats := heap.Stats()
+	if stats.Allocs != 2 || stats.Allocated != 4 || stats.Free != 2 {
+		t.Errorf("after a failed fork: %d allocs, %d allocated, %d free, want 2, 4, 2", stats.Allocs, stats.Allocated, stats.Free)
+	}
+}
+
+func TestExec(t *testing.T) {
+	shamOS := newTestOS(FCFSScheduler{})
+
+	commands := [][]string{
+		{"echo", "hello", "world"},
+		{"missing"},
+		{"echo", "bye"},
+	}
+
+	// echo 把参数写到从 shell 继承来的 pipe 里，顺便报告 exec 之后的 PC、变量池和页表
+	shamOS.RegisterProgram("echo", Program{
+		TimeCost: 1,
+		Main: func(args []string) Runnable {
+			return func(contextual *Contextual) int {
+				fresh := contextual.InitVarPool()
+				pipe, ok := contextual.Process.Devices["sh_out"].(*Pipe)
+				if !ok {
+					t.Errorf("%s: lost the pipe after exec", contextual.Process.Id)
+					return StatusDone
+				}
+				pipe.Input() <- fmt.Sprintf("%s(%s) pc=%d fresh=%v pages=%d: %s",
+					contextual.Process.Id, contextual.Process.Program, contextual.PC, fresh,
+					len(contextual.Process.PageTable), strings.Join(args, " "))
+				return StatusDone
+			}
+		},
+	})
+
+	// sh 建一个 pipe，然后对每条命令 fork 一个子进程去 exec
+	shamOS.RegisterProgram("sh", Program{
+		TimeCost: uint(len(commands)) + 2,
+		Main: func(args []string) Runnable {
+			return func(contextual *Contextual) int {
+				pc := contextual.PC
+				switch {
+				case pc == 0:
+					ch := make(chan interface{}, 2)
+					ch <- "sh_out"
+					ch <- 8
+					contextual.OS.InterruptRequest(contextual.Process.Thread, NewPipeInterrupt, ch)
+				case pc == 1:
+					contextual.InitVarPool()
+					contextual.SetVar("prompt", "$")
+					contextual.Store(0, "sh") // 让子进程有页可以继承
+				case pc < uint(len(commands))+2:
+					cmd := commands[pc-2]
+					pid, ok := contextual.Fork()
+					if !ok {
+						t.Errorf("fork failed")
+						return StatusDone
+					}
+					if pid == "" && !contextual.Exec(cmd[0], cmd[1:]...) {
+						contextual.Process.Devices["sh_out"].Input() <- fmt.Sprintf("sh: %s: not found", cmd[0])
+						return StatusDone
+					}
+				default:
+					return StatusDone
+				}
+				return StatusRunning
+			}
+		},
+	})
+
+	if shamOS.Spawn("bad", 10, "missing", nil) {
+		t.Errorf("spawned a process running a missing program")
+	}
+	if !shamOS.Spawn("sh", 10, "sh", nil) {
+		t.Fatalf("spawn sh failed")
+	}
+
+	shamOS.Boot()
+
+	pipe := shamOS.Devs["sh_out"].(*Pipe)
+	var got []string
+	for pipe.Outputable() {
+		got = append(got, (<-pipe.Output()).(string))
+	}
+
+	want := []string{
+		"sh.1(echo) pc=0 fresh=true pages=0: hello world",
+		"sh: missing: not found",
+		"sh.3(echo) pc=0 fresh=true pages=0: bye",
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("output:\n got %q\nwant %q", got, want)
+	}
+	if n := countEvents(shamOS.Tracer, EventExec, ""); n != 2 {
+		t.Errorf("exec events: got %d, want 2", n)
+	}
+}
+
+func TestExecSignals(t *testing.T) {
+	shamOS := newTestOS(FCFSScheduler{})
+
+	var handlers int
+	var ignored, masked bool
+
+	shamOS.RegisterProgram("target", Program{
+		TimeCost: 1,
+		Main: func(args []string) Runnable {
+			return func(contextual *Contextual) int {
+				p := contextual.Process
+				handlers = len(p.SignalHandlers)
+				ignored, masked = p.IgnoredSignals.Has(SIGUSR2), p.SignalMask.Has(SIGTERM)
+				return StatusDone
+			}
+		},
+	})
+
+	// 处理程序是原来的程序里的代码，exec 之后要恢复默认动作；忽略的信号和屏蔽字保留
+	shamOS.CreateProcess("processExec", 10, 1, func(contextual *Contextual) int {
+		contextual.Signal(SIGUSR1, func(contextual *Contextual, sig Signal) {})
+		contextual.IgnoreSignal(SIGUSR2)
+		contextual.MaskSignals(SIGTERM)
+		contextual.Exec("target")
+		return StatusRunning
+	})
+
+	shamOS.Boot()
+
+	if handlers != 0 {
+		t.Errorf("signal handlers after exec: got %d, want 0", handlers)
+	}
+	if !ignored || !masked {
+		t.Errorf("after exec: SIGUSR2 ignored %v, SIGTERM masked %v, want both kept", ignored, masked)
+	}
+}
+
+func TestWait(t *testing.T) {
+	shamOS := newTestOS(FCFSScheduler{})
+
+	var waited []string
+	// worker 跑 n 条指令后以 code 退出
+	worker := func(n uint, code int) Runnable {
+		return func(contextual *Contextual) int {
+			if contextual.PC+1 < n {
+				return StatusRunning
+			}
+			return contextual.Exit(code)
+		}
+	}
+
+	shamOS.CreateProcess("parent", 10, 7, func(contextual *Contextual) int {
+		switch contextual.PC {
+		case 0:
+			contextual.CreateChild("quick", 10, 1, worker(1, 3))
+		case 1:
+			contextual.CreateChild("slow", 10, 5, worker(5, 7))
+		case 2:
+			contextual.CreateChild("orphan", 10, 20, worker(20, 9))
+		case 3:
+			code, ok := contextual.WaitPid("slow")
+			if !ok {
+				return StatusRunning // 阻塞了，slow 结束后重新执行
+			}
+			waited = append(waited, fmt.Sprintf("slow:%d", code))
+		case 4:
+			pid, code, ok := contextual.Wait()
+			if !ok {
+				return StatusRunning
+			}
+			waited = append(waited, fmt.Sprintf("%s:%d", pid, code))
+		case 5:
+			if _, ok := contextual.WaitPid("nobody"); ok {
+				t.Errorf("waited for a process that is not a child")
+			}
+			// 操作员接口创建的进程是 init 的子进程，在进程里调用也一样
+			contextual.OS.CreateProcess("stranger", 10, 1, worker(1, 0))
+			if _, ok := contextual.WaitPid("stranger"); ok {
+				t.Errorf("waited for a process created with CreateProcess")
+			}
+		default:
+			return contextual.Exit(0)
+		}
+		return StatusRunning
+	})
+
+	shamOS.Boot()
+
+	if got := fmt.Sprint(waited); got != "[slow:7 quick:3]" {
+		t.Errorf("waited: got %s, want [slow:7 quick:3]", got)
+	}
+
+	// quick 结束后一直是僵尸进程，直到 parent 回收它；orphan 结束时 parent 已经不在了，由 init 直接回收
+	zombies := map[string]bool{}
+	for _, e := range shamOS.Tracer.Events {
+		if e.Type == EventTransition && e.To == StatusName(StatusZombie) {
+			zombies[e.Pid] = true
+		}
+	}
+	if !zombies["quick"] || !zombies["slow"] || zombies["orphan"] || zombies["parent"] || zombies["stranger"] {
+		t.Errorf("zombies: got %v, want quick and slow", zombies)
+	}
+	if len(shamOS.ZombieProcs) != 0 {
+		t.Errorf("zombies left: %v", shamOS.ZombieProcs)
+	}
+
+	codes := map[string]int{}
+	for _, s := range shamOS.Report().Processes {
+		codes[s.Pid] = s.ExitCode
+	}
+	if fmt.Sprint(codes) != "map[orphan:9 parent:0 quick:3 slow:7 stranger:0]" {
+		t.Errorf("exit codes: got %v", codes)
+	}
+}
+
+func TestSignals(t *testing.T) {
+	shamOS := newTestOS(FCFSScheduler{TimeSlice{Quantum: 2}})
+
+	var handled []string
+
+	// worker 处理 SIGUSR1，忽略 SIGINT，前 10 条指令屏蔽 SIGTERM
+	shamOS.CreateProcess("worker", 10, 30, func(contextual *Contextual) int {
+		switch pc := contextual.PC; {
+		case pc == 0:
+			contextual.Signal(SIGUSR1, func(contextual *Contextual, sig Signal) {
+				handled = append(handled, fmt.Sprintf("worker:%v", sig))
+			})
+			contextual.IgnoreSignal(SIGINT)
+			contextual.MaskSignals(SIGTERM)
+			if contextual.IgnoreSignal(SIGKILL) || contextual.Signal(SIGSTOP, nil) {
+				t.Errorf("SIGKILL and SIGSTOP should not be caught")
+			}
+		case pc == 10:
+			contextual.UnmaskSignals(SIGTERM)
+		case pc >= 30:
+			return contextual.Exit(0)
+		}
+		return StatusRunning
+	})
+
+	// boss 给 worker 发信号，停掉它再让它继续；等 sleeper 停下后杀掉它
+	stage := 0
+	stopped := func(pid string) bool {
+		p := shamOS.FindProcess(pid)
+		return p != nil && p.Status == StatusStopped
+	}
+	shamOS.CreateProcess("boss", 10, 4, func(contextual *Contextual) int {
+		switch stage {
+		case 0:
+			for _, sig := range []Signal{SIGUSR1, SIGINT, SIGTERM, SIGSTOP} {
+				contextual.Kill("worker", sig)
+			}
+			stage = 1
+		case 1:
+			if !stopped("worker") {
+				return StatusReady
+			}
+			contextual.Kill("worker", SIGCONT)
+			stage = 2
+		case 2:
+			if !stopped("sleeper") {
+				return StatusReady
+			}
+			contextual.Kill("sleeper", SIGKILL)
+			return StatusDone
+		}
+		return StatusReady
+	})
+
+	// waiter 等它的子进程 sleeper；sleeper 把自己停下，永远不会自己结束
+	var sleeperCode int
+	shamOS.CreateProcess("waiter", 10, 3, func(contextual *Contextual) int {
+		switch contextual.PC {
+		case 0:
+			contextual.Signal(SIGCHLD, func(contextual *Contextual, sig Signal) {
+				handled = append(handled, fmt.Sprintf("waiter:%v", sig))
+			})
+			contextual.CreateChild("sleeper", 10, 100, func(contextual *Contextual) int {
+				if contextual.PC == 0 {
+					contextual.Kill(contextual.Process.Id, SIGSTOP)
+				}
+				return StatusRunning
+			})
+		case 1:
+			code, ok := contextual.WaitPid("sleeper")
+			if !ok {
+				return StatusRunning
+			}
+			sleeperCode = code
+		default:
+			return contextual.Exit(0)
+		}
+		return StatusRunning
+	})
+
+	shamOS.Boot()
+
+	if got := fmt.Sprint(handled); got != "[worker:SIGUSR1 waiter:SIGCHLD]" {
+		t.Errorf("handled: got %s", got)
+	}
+	if sleeperCode != 128+int(SIGKILL) {
+		t.Errorf("sleeper exit code: got %d, want %d", sleeperCode, 128+int(SIGKILL))
+	}
+
+	stats := map[string]ProcessStats{}
+	for _, s := range shamOS.Report().Processes {
+		stats[s.Pid] = s
+	}
+	if s := stats["worker"]; s.ExitReason != ExitSignaled || s.ExitCode != 128+int(SIGTERM) {
+		t.Errorf("worker: got reason %s, code %d, want terminated by SIGTERM", s.ExitReason, s.ExitCode)
+	}
+	var transitions []string
+	for _, e := range shamOS.Tracer.Events {
+		if e.Type == EventTransition && e.Pid == "worker" && (e.From == StatusName(StatusStopped) || e.To == StatusName(StatusStopped)) {
+			transitions = append(transitions, e.From+"->"+e.To)
+		}
+	}
+	if got := fmt.Sprint(transitions); got != "[running->stopped stopped->ready]" {
+		t.Errorf("worker transitions: got %s", got)
+	}
+	if s := stats["sleeper"]; s.ExitReason != ExitSignaled {
+		t.Errorf("sleeper: got reason %s, want %s", s.ExitReason, ExitSignaled)
+	}
+}
+
+func TestSuspend(t *testing.T) {
+	shamOS := newTestOS(FCFSScheduler{TimeSlice{Quantum: 2}})
+	shamOS.MaxActive = 2
+
+	status := func(pid string) int {
+		if p := shamOS.FindProcess(pid); p != nil {
+			return p.Status
+		}
+		return StatusDone
+	}
+
+	// a 写一页，然后等它的子进程 kid；a 被挂起时 kid 还没被接纳（活跃的进程满了）
+	var loaded interface{}
+	shamOS.CreateProcess("a", 10, 5, func(contextual *Contextual) int {
+		switch contextual.PC {
+		case 0:
+			if !contextual.Store(0, "a") {
+				return StatusRunning // 缺页，重新执行
+			}
+		case 1:
+			contextual.CreateChild("kid", 10, 1, func(contextual *Contextual) int {
+				return contextual.Exit(0)
+			})
+		case 2:
+			if _, ok := contextual.WaitPid("kid"); !ok {
+				return StatusRunning
+			}
+		case 3:
+			v, ok := contextual.Load(0)
+			if !ok {
+				return StatusRunning // 挂起时换出了，缺页换入
+			}
+			loaded = v
+		default:
+			return StatusDone
+		}
+		return StatusRunning
+	})
+
+	// ctl 等 a 阻塞后挂起它，等 a 变成就绪挂起后激活它
+	stage := 0
+	shamOS.CreateProcess("ctl", 10, 4, func(contextual *Contextual) int {
+		switch stage {
+		case 0:
+			if status("a") != StatusBlocked {
+				return StatusReady
+			}
+			if !contextual.Suspend("a") {
+				t.Errorf("suspend a failed")
+			}
+			if contextual.Suspend("a") {
+				t.Errorf("suspended a twice")
+			}
+			stage = 1
+		case 1:
+			if status("a") != StatusSuspendedReady {
+				return StatusReady
+			}
+			if !contextual.Resume("a") {
+				t.Errorf("resume a failed")
+			}
+			return StatusDone
+		}
+		return StatusReady
+	})
+
+	shamOS.CreateProcess("late", 10, 1, func(contextual *Contextual) int {
+		return StatusDone
+	})
+
+	if s := status("late"); s != StatusNew {
+		t.Errorf("late: got %s, want new", StatusName(s))
+	}
+
+	shamOS.Boot()
+
+	if loaded != "a" {
+		t.Errorf("a loaded %v after resume, want a", loaded)
+	}
+
+	var transitions []string
+	for _, e := range shamOS.Tracer.Events {
+		if e.Type == EventTransition && (strings.HasPrefix(e.From, "suspended") || strings.HasPrefix(e.To, "suspended") ||
+			e.From == StatusName(StatusNew)) {
+			transitions = append(transitions, e.Pid+":"+e.From+"->"+e.To)
+		}
+	}
+	want := "[a:new->ready ctl:new->ready a:blocked->suspended-blocked late:new->ready kid:new->ready " +
+		"a:suspended-blocked->suspended-ready a:suspended-ready->ready]"
+	if got := fmt.Sprint(transitions); got != want {
+		t.Errorf("transitions:\n got %s\nwant %s", got, want)
+	}
+
+	if swap := shamOS.Devs["swap"].(*Swap); swap.Outs == 0 || swap.Ins == 0 {
+		t.Errorf("swap: got %d outs, %d ins, want some", swap.Outs, swap.Ins)
+	}
+	for _, s := range shamOS.Report().Processes {
+		if s.Pid == "a" && s.Suspended == 0 {
+			t.Errorf("a: no time spent suspended")
+		}
+	}
+}
+
+func TestSuspendNoop(t *testing.T) {
+	shamOS := NewOS()
+
+	// 没有进程可以运行时 CPU 上跑的是 Noop：它不是进程，不能挂起
+	shamOS.Noop.Status = StatusRunning
+	shamOS.RunningProc = shamOS.Noop
+
+	if shamOS.SuspendProcess(NoopId) {
+		t.Errorf("suspend a running noop: want failure")
+	}
+	if shamOS.SuspendProcess("nobody") {
+		t.Errorf("suspend a process that does not exist: want failure")
+	}
+}
+
+// runThreads 在线程模型 model 下跑一个进程：主线程创建两个线程，各写一页，再 join 它们，
+// 最后读回两个线程写的值。另一个进程 other 和它抢 CPU。
+func runThreads(t *testing.T, model string) (report Report, loaded []interface{}, codes []int, events []Event) {
+	shamOS := newTestOS(FCFSScheduler{TimeSlice{Quantum: 3}})
+	shamOS.ThreadModel = model
+
+	// worker 把自己的线程 id 写到第 page 页，然后算两条指令，以 page 为退出码结束
+	worker := func(page uint) Runnable {
+		return func(contextual *Contextual) int {
+			switch contextual.PC {
+			case 0:
+				if !contextual.Store(page*DefaultPageSize, contextual.Tid()) {
+					return StatusRunning // 缺页，重新执行
+				}
+			case 1, 2:
+			default:
+				return contextual.ThreadExit(int(page))
+			}
+			return StatusRunning
+		}
+	}
+
+	var tids []string
+	shamOS.CreateProcess("main", 10, 6, func(contextual *Contextual) int {
+		switch pc := contextual.PC; {
+		case pc < 2:
+			tids = append(tids, contextual.ThreadCreate(4, worker(pc+1)))
+		case pc < 4:
+			code, ok := contextual.ThreadJoin(tids[pc-2])
+			if !ok {
+				return StatusRunning // 线程还没结束，结束后重新执行
+			}
+			codes = append(codes, code)
+		case pc == 4:
+			if _, ok := contextual.ThreadJoin(tids[0]); ok {
+				t.Errorf("%s: joined %s twice", model, tids[0])
+			}
+		case pc == 5:
+			for page := uint(1); page <= 2; page++ {
+				v, ok := contextual.Load(page * DefaultPageSize)
+				if !ok {
+					return StatusRunning
+				}
+				loaded = append(loaded, v)
+			}
+		default:
+			return contextual.Exit(0)
+		}
+		return StatusRunning
+	})
+	shamOS.CreateProcess("other", 10, 6, func(contextual *Contextual) int {
+		if contextual.PC >= 6 {
+			return StatusDone
+		}
+		return StatusRunning
+	})
+
+	shamOS.Boot()
+
+	return shamOS.Report(), loaded, codes, shamOS.Tracer.Events
+}
+
+func TestThreads(t *testing.T) {
+	for _, model := range []string{ThreadsKernel, ThreadsUser} {
+		report, loaded, codes, events := runThreads(t, model)
+
+		if got := fmt.Sprint(loaded); got != "[main.t1 main.t2]" {
+			t.Errorf("%s: main loaded %s, want the values stored by its threads", model, got)
+		}
+		if got := fmt.Sprint(codes); got != "[1 2]" {
+			t.Errorf("%s: joined codes %s, want [1 2]", model, got)
+		}
+
+		var pids []string
+		for _, s := range report.Processes {
+			pids = append(pids, s.Pid)
+		}
+		// faulted 因缺页被阻塞过的项
+		faulted := map[string]bool{}
+		for _, e := range events {
+			if e.Type == EventInterruptRaised && e.Interrupt == PageFaultInterrupt {
+				faulted[e.Pid] = true
+			}
+		}
+		t.Logf("%s: processes %v, page faults from %v", model, pids, faulted)
+
+		switch model {
+		case ThreadsKernel: // 线程在进程表里各占一项，缺页只阻塞那个线程
+			if got := fmt.Sprint(pids); got != "[main other main.t1 main.t2]" {
+				t.Errorf("%s: processes %s", model, got)
+			}
+			if got := fmt.Sprint(faulted); got != "map[main.t1:true main.t2:true]" {
+				t.Errorf("%s: page faults from %s, want each thread on its own", model, got)
+			}
+		case ThreadsUser: // 内核只看得到进程，线程缺页时整个进程被阻塞
+			if got := fmt.Sprint(pids); got != "[main other]" {
+				t.Errorf("%s: processes %s", model, got)
+			}
+			if got := fmt.Sprint(faulted); got != "map[main:true]" {
+				t.Errorf("%s: page faults from %s, want all from the process", model, got)
+			}
+		}
+	}
+}
+
+// TestThreadIO 1:1 模型下工作线程用 Contextual.InterruptRequest 做 IO，阻塞、唤醒的都是它自己
+func TestThreadIO(t *testing.T) {
+	shamOS := newTestOS(FCFSScheduler{TimeSlice{Quantum: 3}})
+	shamOS.ThreadModel = ThreadsKernel
+
+	var worker string
+	resumed := false
+	shamOS.CreateProcess("main", 10, 3, func(contextual *Contextual) int {
+		switch contextual.PC {
+		case 0:
+			worker = contextual.ThreadCreate(3, func(contextual *Contextual) int {
+				switch contextual.PC {
+				case 0:
+					ch := make(chan interface{}, 1)
+					ch <- "hello from " + contextual.Tid()
+					contextual.InterruptRequest(StdOutInterrupt, ch)
+				case 1:
+					resumed = true
+				default:
+					return contextual.ThreadExit(0)
+				}
+				return StatusRunning
+			})
+		case 1:
+			if _, ok := contextual.ThreadJoin(worker); !ok {
+				return StatusRunning
+			}
+		default:
+			return contextual.Exit(0)
+		}
+		return StatusRunning
+	})
+
+	shamOS.Boot()
+
+	if !resumed {
+		t.Errorf("%s did not run after its IO", worker)
+	}
+	var raised, written []string
+	for _, e := range shamOS.Tracer.Events {
+		if e.Type == EventInterruptRaised && e.Interrupt == StdOutInterrupt {
+			raised = append(raised, e.Pid)
+		}
+		if e.Type == EventDeviceIO && e.Device == "stdout" {
+			written = append(written, e.Pid+": "+e.Data)
+		}
+	}
+	if got := fmt.Sprint(raised); got != "[main.t1]" {
+		t.Errorf("StdOutInterrupt raised by %s, want [main.t1]", got)
+	}
+	if got := fmt.Sprint(written); got != "[main.t1: hello from main.t1]" {
+		t.Errorf("stdout got %s, want the worker's line", got)
+	}
+}
+
+// TestThreadAdmission 1:1 模型下新线程和新进程一样要经过接纳，活跃的数目不超过 MaxActive
+func TestThreadAdmission(t *testing.T) {
+	shamOS := newTestOS(FCFSScheduler{TimeSlice{Quantum: 1}})
+	shamOS.ThreadModel = ThreadsKernel
+	shamOS.MaxActive = 2
+
+	maxActive := uint(0)
+	count := func() {
+		shamOS.ProcsMutex.RLock()
+		if n := shamOS.active(); n > maxActive {
+			maxActive = n
+		}
+		shamOS.ProcsMutex.RUnlock()
+	}
+
+	var worker string
+	status := StatusDone
+	ran := false
+	shamOS.CreateProcess("main", 10, 4, func(contextual *Contextual) int {
+		count()
+		switch contextual.PC {
+		case 0:
+			worker = contextual.ThreadCreate(1, func(contextual *Contextual) int {
+				count()
+				ran = true
+				return contextual.ThreadExit(0)
+			})
+		case 1:
+			if p := shamOS.FindProcess(worker); p != nil { // 没有限制的话它可能已经跑完了
+				status = p.Status
+			}
+		case 2:
+			if _, ok := contextual.ThreadJoin(worker); !ok {
+				return StatusRunning
+			}
+		default:
+			return contextual.Exit(0)
+		}
+		return StatusRunning
+	})
+	shamOS.CreateProcess("other", 10, 3, func(contextual *Contextual) int {
+		count()
+		if contextual.PC >= 3 {
+			return StatusDone
+		}
+		return StatusRunning
+	})
+
+	shamOS.Boot()
+
+	if status != StatusNew {
+		t.Errorf("%s with two active processes: got status %s, want new", worker, StatusName(status))
+	}
+	if !ran {
+		t.Errorf("%s was never admitted", worker)
+	}
+	if maxActive > shamOS.MaxActive {
+		t.Errorf("%d active at most, want at most %d", maxActive, shamOS.MaxActive)
+	}
+}
+
+// TestThreadSignals 1:1 模型下信号由进程里接下来上 CPU 的线程递送：
+// 主线程阻塞在 ThreadJoin 上，别的线程给自己的进程发 SIGKILL，整个进程要在它的下一条指令之前结束。
+func TestThreadSignals(t *testing.T) {
+	shamOS := newTestOS(FCFSScheduler{TimeSlice{Quantum: 1}})
+	shamOS.ThreadModel = ThreadsKernel
+
+	killed, afterKill := false, 0
+	shamOS.CreateProcess("main", 10, 3, func(contextual *Contextual) int {
+		switch contextual.PC {
+		case 0:
+			contextual.ThreadCreate(6, func(contextual *Contextual) int {
+				switch {
+				case contextual.PC >= 5:
+					return contextual.ThreadExit(0)
+				case killed:
+					afterKill++
+				case contextual.Process.owner().Status == StatusBlocked: // 等主线程阻塞在 ThreadJoin 上再发
+					killed = contextual.Kill("main", SIGKILL)
+				}
+				return StatusRunning
+			})
+		case 1:
+			if _, ok := contextual.ThreadJoin("main.t1"); !ok {
+				return StatusRunning
+			}
+		default:
+			return contextual.Exit(0)
+		}
+		return StatusRunning
+	})
+
+	shamOS.Boot()
+
+	if !killed {
+		t.Fatal("main never blocked in ThreadJoin")
+	}
+	if afterKill != 0 {
+		t.Errorf("main.t1 ran %d instructions after SIGKILL, want 0", afterKill)
+	}
+	for _, s := range shamOS.Report().Processes {
+		if s.Pid == "main" && (s.ExitReason != ExitSignaled || s.ExitCode != 128+int(SIGKILL)) {
+			t.Errorf("main: got reason %s, code %d, want killed by SIGKILL", s.ExitReason, s.ExitCode)
+		}
+	}
+}
+
+// TestThreadSuspend 1:1 模型下挂起、激活进程时它所有的线程一起挂起、激活
+func TestThreadSuspend(t *testing.T) {
+	shamOS := newTestOS(FCFSScheduler{TimeSlice{Quantum: 1}})
+	shamOS.ThreadModel = ThreadsKernel
+
+	statuses := map[string]int{}
+	workerDone := false
+	shamOS.CreateProcess("main", 10, 3, func(contextual *Contextual) int {
+		switch contextual.PC {
+		case 0:
+			contextual.ThreadCreate(2, func(contextual *Contextual) int {
+				if contextual.PC >= 1 {
+					workerDone = true
+					return contextual.ThreadExit(0)
+				}
+				return StatusRunning
+			})
+		case 1:
+			if _, ok := contextual.ThreadJoin("main.t1"); !ok {
+				return StatusRunning
+			}
+		default:
+			return contextual.Exit(0)
+		}
+		return StatusRunning
+	})
+	// main 阻塞在 ThreadJoin 上、main.t1 就绪的时候挂起 main，再激活
+	suspended := false
+	shamOS.CreateProcess("op", 10, 4, func(contextual *Contextual) int {
+		main := shamOS.FindProcess("main")
+		switch {
+		case suspended:
+			if !shamOS.ResumeProcess("main") {
+				t.Error("resume main: failed")
+			}
+			return StatusDone
+		case main != nil && main.Status == StatusBlocked:
+			if !contextual.Suspend("main") {
+				t.Error("suspend main: failed")
+			}
+			for _, pid := range []string{"main", "main.t1"} {
+				if p := shamOS.FindProcess(pid); p != nil {
+					statuses[pid] = p.Status
+				}
+			}
+			suspended = true
+		}
+		return StatusRunning
+	})
+
+	shamOS.Boot()
+
+	if !suspended {
+		t.Fatal("main never blocked in ThreadJoin")
+	}
+	want := map[string]int{"main": StatusSuspendedBlocked, "main.t1": StatusSuspendedReady}
+	for pid, status := range want {
+		if statuses[pid] != status {
+			t.Errorf("%s after suspend: got %s, want %s", pid, StatusName(statuses[pid]), StatusName(status))
+		}
+	}
+	if !workerDone {
+		t.Error("main.t1 never finished after resume")
+	}
+}
+
+// TestSemaphores 生产者-消费者：有界缓冲区大小为 2，用计数信号量 empty、full 计空位和产品，二元信号量 mutex 互斥。
+func TestSemaphores(t *testing.T) {
+	shamOS := newTestOS(FCFSScheduler{TimeSlice{Quantum: 2}})
+
+	const size, items = 2, 6
+	var buffer, consumed []int
+	maxLen := 0
+
+	semget := func(contextual *Contextual) {
+		if !contextual.Semget("empty", size) || !contextual.Semget("full", 0) || !contextual.BinarySemget("mutex", 1) {
+			t.Errorf("%s: semget failed", contextual.Process.Id)
+		}
+	}
+
+	// 每个产品三条指令：P(empty)；P(mutex)；放入，V(mutex)，V(full)
+	shamOS.CreateProcess("producer", 10, 1+3*items, func(contextual *Contextual) int {
+		if contextual.PC == 0 {
+			semget(contextual)
+			return StatusRunning
+		}
+		i, step := (contextual.PC-1)/3, (contextual.PC-1)%3
+		switch {
+		case i >= items:
+			return StatusDone
+		case step == 0:
+			contextual.SemWait("empty")
+		case step == 1:
+			contextual.SemWait("mutex")
+		default:
+			buffer = append(buffer, int(i))
+			if len(buffer) > maxLen {
+				maxLen = len(buffer)
+			}
+			contextual.SemSignal("mutex")
+			contextual.SemSignal("full")
+		}
+		return StatusRunning
+	})
+
+	// 每个消费者取 items/2 个：P(full)；P(mutex)；取出，V(mutex)，V(empty)
+	consumer := func(contextual *Contextual) int {
+		if contextual.PC == 0 {
+			semget(contextual)
+			return StatusRunning
+		}
+		i, step := (contextual.PC-1)/3, (contextual.PC-1)%3
+		switch {
+		case i >= items/2:
+			return StatusDone
+		case step == 0:
+			contextual.SemWait("full")
+		case step == 1:
+			contextual.SemWait("mutex")
+		default:
+			consumed = append(consumed, buffer[0])
+			buffer = buffer[1:]
+			contextual.SemSignal("mutex")
+			contextual.SemSignal("empty")
+		}
+		return StatusRunning
+	}
+	shamOS.CreateProcess("consumer1", 10, 1+3*items/2, consumer)
+	shamOS.CreateProcess("consumer2", 10, 1+3*items/2, consumer)
+	shamOS.FindProcess("producer").Quantum = 8 // 生产得比消费快，缓冲区会满
+
+	shamOS.CreateProcess("misc", 10, 1, func(contextual *Contextual) int {
+		if contextual.SemWait("nothing") || contextual.SemSignal("nothing") {
+			t.Errorf("misc: waited or signaled a semaphore that does not exist")
+		}
+		if !contextual.BinarySemget("bin", 1) || !contextual.SemSignal("bin") || !contextual.SemSignal("bin") {
+			t.Errorf("misc: binary semaphore failed")
+		}
+		if contextual.Semget("bin", 1) {
+			t.Errorf("misc: got a binary semaphore as a counting one")
+		}
+		return StatusDone
+	})
+
+	shamOS.Boot()
+
+	if got := fmt.Sprint(consumed); got != "[0 1 2 3 4 5]" {
+		t.Errorf("consumed %s, want every item in order", got)
+	}
+	if maxLen > size {
+		t.Errorf("buffer grew to %d, want at most %d", maxLen, size)
+	}
+	if v := shamOS.Sems["bin"].Value; v != 1 {
+		t.Errorf("binary semaphore: got value %d, want 1", v)
+	}
+	for _, key := range []string{"empty", "full", "mutex"} {
+		if sem := shamOS.Sems[key]; len(sem.Waiting) > 0 {
+			t.Errorf("%s: %d still waiting", key, len(sem.Waiting))
+		}
+	}
+
+	blocked := map[string]bool{}
+	for _, e := range shamOS.Tracer.Events {
+		if e.Type == EventInterruptRaised && e.Interrupt == SemWaitInterrupt {
+			blocked[e.Pid] = true
+		}
+	}
+	t.Logf("blocked on semaphores: %v", blocked)
+	if !blocked["producer"] || !blocked["consumer1"] {
+		t.Errorf("blocked on semaphores: got %v, want the producer and consumers", blocked)
+	}
+}
+
+// TestSemWaiterKilled 等信号量时被杀掉的线程不会拿到信号量，哪怕之后又有进程用了同一个 pid
+func TestSemWaiterKilled(t *testing.T) {
+	shamOS := newTestOS(FCFSScheduler{TimeSlice{Quantum: 1}})
+
+	shamOS.CreateProcess("doomed", 10, 2, func(contextual *Contextual) int {
+		if contextual.PC == 0 {
+			if !contextual.Semget("s", 0) || !contextual.SemWait("s") {
+				t.Error("doomed: semaphore failed")
+			}
+			return StatusRunning
+		}
+		t.Error("doomed: got the semaphore after being killed")
+		return StatusDone
+	})
+	killed := false
+	shamOS.CreateProcess("op", 10, 4, func(contextual *Contextual) int {
+		doomed := shamOS.FindProcess("doomed")
+		switch {
+		case !killed && doomed != nil && doomed.Status == StatusBlocked:
+			killed = contextual.Kill("doomed", SIGKILL)
+			shamOS.CreateProcess("doomed", 10, 3, func(contextual *Contextual) int { // 同一个 pid 的新进程
+				if contextual.PC >= 2 {
+					return StatusDone
+				}
+				return StatusRunning
+			})
+		case killed:
+			contextual.SemSignal("s")
+			return StatusDone
+		}
+		return StatusRunning
+	})
+
+	shamOS.Boot()
+
+	if !killed {
+		t.Fatal("doomed never blocked on the semaphore")
+	}
+	if sem := shamOS.Sems["s"]; sem.Value != 1 || len(sem.Waiting) > 0 {
+		t.Errorf("semaphore: got value %d with %d waiting, want 1 with none", sem.Value, len(sem.Waiting))
+	}
+}
+
+// runMonitor 在唤醒语义 semantics 下用管程解生产者-消费者问题：缓冲区大小为 1，
+// 互斥锁 m 保护缓冲区，条件变量 notFull、notEmpty。返回消费的产品，和被唤醒后发现条件不成立的次数。
+func runMonitor(t *testing.T, semantics string) (consumed []int, stale int, events []Event) {
+	shamOS := newTestOS(FCFSScheduler{TimeSlice{Quantum: 2}})
+	shamOS.MonitorSemantics = semantics
+
+	const size, items = 1, 6
+	var buffer []int
+	waited := map[string]bool{} // 进程在 CondWait 上等过，还没检查条件
+
+	// monitor 返回每次进管程做一件事的程序，每次三条指令：Lock；等 ready() 成立后 do()，CondSignal(signal)；Unlock
+	monitor := func(n int, wait string, signal string, ready func() bool, do func(i int)) Runnable {
+		return func(contextual *Contextual) int {
+			pid := contextual.Process.Id
+			if contextual.PC == 0 {
+				if !contextual.Mutexget("m") || !contextual.Condget("notFull") || !contextual.Condget("notEmpty") {
+					t.Errorf("%s: %s: get monitor failed", semantics, pid)
+				}
+				return StatusRunning
+			}
+			i, step := int(contextual.PC-1)/3, (contextual.PC-1)%3
+			switch {
+			case i >= n:
+				return StatusDone
+			case step == 0:
+				contextual.Lock("m")
+			case step == 1:
+				if waited[pid] && !ready() {
+					stale += 1
+				}
+				waited[pid] = false
+				if !ready() {
+					if !contextual.CondWait(wait, "m") {
+						t.Errorf("%s: %s: CondWait failed", semantics, pid)
+					}
+					waited[pid] = true
+					return StatusRunning // 被唤醒后重新执行，重新检查条件
+				}
+				do(i)
+				contextual.CondSignal(signal)
+			default:
+				if !contextual.Unlock("m") {
+					t.Errorf("%s: %s: unlock failed", semantics, pid)
+				}
+			}
+			return StatusRunning
+		}
+	}
+
+	shamOS.CreateProcess("producer", 10, 1+3*items, monitor(items, "notFull", "notEmpty",
+		func() bool { return len(buffer) < size },
+		func(i int) { buffer = append(buffer, i) }))
+	consume := func(i int) {
+		consumed = append(consumed, buffer[0])
+		buffer = buffer[1:]
+	}
+	for _, pid := range []string{"consumer1", "consumer2"} {
+		shamOS.CreateProcess(pid, 10, 1+3*items/2, monitor(items/2, "notEmpty", "notFull",
+			func() bool { return len(buffer) > 0 }, consume))
+	}
+
+	shamOS.CreateProcess("misc", 10, 3, func(contextual *Contextual) int {
+		switch contextual.PC {
+		case 0:
+			contextual.Mutexget("own")
+			contextual.Condget("c")
+			if contextual.Lock("nothing") || contextual.Unlock("m") || contextual.CondWait("c", "own") {
+				t.Errorf("%s: misc: locked a missing mutex, unlocked or waited without holding it", semantics)
+			}
+			contextual.Lock("own")
+		case 1:
+			if contextual.Lock("own") {
+				t.Errorf("%s: misc: locked a mutex twice", semantics)
+			}
+			if !contextual.Unlock("own") || contextual.Unlock("own") {
+				t.Errorf("%s: misc: unlock failed, or unlocked twice", semantics)
+			}
+		default:
+			return StatusDone
+		}
+		return StatusRunning
+	})
+
+	shamOS.Boot()
+
+	for key, m := range shamOS.Mutexes {
+		if m.Owner != nil || len(m.Waiting) > 0 || len(m.urgent) > 0 {
+			t.Errorf("%s: mutex %s: owned by %s, %d waiting", semantics, key, ownerId(m), len(m.Waiting)+len(m.urgent))
+		}
+	}
+	return consumed, stale, shamOS.Tracer.Events
+}
+
+func TestMonitor(t *testing.T) {
+	for _, semantics := range []string{MonitorMesa, MonitorHoare} {
+		consumed, stale, events := runMonitor(t, semantics)
+
+		if got := fmt.Sprint(consumed); got != "[0 1 2 3 4 5]" {
+			t.Errorf("%s: consumed %s, want every item in order", semantics, got)
+		}
+
+		raised := map[string]int{}
+		for _, e := range events {
+			if e.Type == EventInterruptRaised {
+				raised[e.Interrupt] += 1
+			}
+		}
+		t.Logf("%s: %d stale wakeups, %d CondWait, %d Lock, %d Hoare CondSignal", semantics, stale,
+			raised[CondWaitInterrupt], raised[MutexInterrupt], raised[CondSignalInterrupt])
+
+		if raised[CondWaitInterrupt] == 0 {
+			t.Errorf("%s: nobody waited on a condition variable", semantics)
+		}
+		switch semantics {
+		case MonitorMesa: // 发信号的线程接着运行，被唤醒的线程拿到锁时条件可能又不成立了
+			if raised[CondSignalInterrupt] != 0 {
+				t.Errorf("%s: signaler blocked", semantics)
+			}
+			if stale == 0 {
+				t.Errorf("%s: no stale wakeups, want some", semantics)
+			}
+		case MonitorHoare: // 锁直接交给被唤醒的线程，条件一定成立
+			if raised[CondSignalInterrupt] == 0 {
+				t.Errorf("%s: signaler never handed the mutex over", semantics)
+			}
+			if stale != 0 {
+				t.Errorf("%s: %d stale wakeups, want none", semantics, stale)
+			}
+		}
+	}
+}
+
+// TestMutexOwnerExit 持有锁的进程没解锁就结束了，锁交给等着的进程；等锁时被杀掉的进程不会拿到锁
+func TestMutexOwnerExit(t *testing.T) {
+	shamOS := newTestOS(FCFSScheduler{TimeSlice{Quantum: 1}})
+
+	var owners []string
+	lock := func(contextual *Contextual) {
+		if contextual.Mutexget("m") && contextual.Lock("m") {
+			return
+		}
+		t.Errorf("%s: lock failed", contextual.Process.Id)
+	}
+	shamOS.CreateProcess("holder", 10, 3, func(contextual *Contextual) int {
+		switch contextual.PC {
+		case 0:
+			lock(contextual)
+		case 1:
+			contextual.Kill("doomed", SIGKILL)
+		default:
+			return contextual.Exit(1) // 没有 Unlock
+		}
+		return StatusRunning
+	})
+	waiter := func(contextual *Contextual) int {
+		switch contextual.PC {
+		case 0:
+			lock(contextual)
+		default:
+			owners = append(owners, contextual.Process.Id)
+			contextual.Unlock("m")
+			return StatusDone
+		}
+		return StatusRunning
+	}
+	shamOS.CreateProcess("doomed", 10, 2, waiter)
+	shamOS.CreateProcess("waiter", 10, 2, waiter)
+
+	shamOS.Boot()
+
+	if got := fmt.Sprint(owners); got != "[waiter]" {
+		t.Errorf("mutex went to %s, want [waiter]", got)
+	}
+	if m := shamOS.Mutexes["m"]; m.Owner != nil || len(m.Waiting) > 0 {
+		t.Errorf("mutex owned by %q with %d waiting, want it free", ownerId(m), len(m.Waiting))
+	}
+
+	// 线程没解锁就 ThreadExit 了，同一个进程里的主线程之后还能拿到锁。
+	// M:1 模型下线程结束不经过进程表，锁要在 ThreadExit 时就释放，主线程 Lock 时不用阻塞
+	shamOS = newTestOS(FCFSScheduler{TimeSlice{Quantum: 1}})
+	shamOS.ThreadModel = ThreadsUser
+	var worker string
+	relocked := false
+	shamOS.CreateProcess("main", 10, 4, func(contextual *Contextual) int {
+		switch contextual.PC {
+		case 0:
+			worker = contextual.ThreadCreate(2, func(contextual *Contextual) int {
+				if contextual.PC == 0 {
+					lock(contextual)
+					return StatusRunning
+				}
+				return contextual.ThreadExit(0) // 没有 Unlock
+			})
+		case 1:
+			if _, ok := contextual.ThreadJoin(worker); !ok {
+				return StatusRunning
+			}
+		case 2:
+			lock(contextual)
+		default:
+			relocked = contextual.Unlock("m")
+			return contextual.Exit(0)
+		}
+		return StatusRunning
+	})
+
+	shamOS.Boot()
+
+	if !relocked {
+		t.Errorf("main did not get the mutex left by %s", worker)
+	}
+	if n := countEvents(shamOS.Tracer, EventInterruptRaised, MutexInterrupt); n != 0 {
+		t.Errorf("main blocked %d times on a mutex whose owner had exited", n)
+	}
+}
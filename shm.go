@@ -0,0 +1,204 @@
+package sham
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"sync"
+)
+
+// SharedSegment 是共享内存段：一块可以被多个进程同时挂接、读写的内存，从 OS.SegMem 中分配。
+// 进程通过 Shmget 创建（或找到）一个段，Shmat 挂接后就能读写，用完 Shmdt 解除挂接。
+// 最后一个挂接的进程解除挂接时，段被销毁；没有进程挂接的段要用 Shmrm 删除，不然一直占着内存。
+// 段的大小算在每个挂接了它的进程的内存用量里（见 OS.memoryUsage），挂接时不能超过进程的内存配额。
+//
+// 共享内存本身不做任何同步：一次读写是原子的（一条指令），
+// 但「读出来、加一、写回去」如果跨了好几条指令，就可能被别的进程插进来——这正是竞争条件。
+type SharedSegment struct {
+	sync.Mutex
+
+	Key  string
+	Size uint
+	// Attached 挂接了这个段的进程
+	Attached map[string]bool
+
+	// handle 段在 OS.SegMem 中的内存块，属于 shmOwner(Key)
+	handle Handle
+}
+
+// shmOwner 是共享内存段 key 在 OS.SegMem 中的内存块的主人：段不属于任何一个进程
+func shmOwner(key string) string {
+	return "shm:" + key
+}
+
+// Attaches 返回挂接了这个段的进程数
+func (s *SharedSegment) Attaches() int {
+	s.Lock()
+	defer s.Unlock()
+	return len(s.Attached)
+}
+
+// Shmget 获取键为 key 的共享内存段，不存在就新建一个大小为 size 的段。
+// 段已经存在但比 size 小，要新建一个大小为 0 的段，或者 OS.SegMem 放不下时返回 false。
+func (os *OS) Shmget(thread *Thread, key string, size uint) bool {
+	pid := thread.contextual.Process.Id
+
+	os.ShmMutex.Lock()
+	defer os.ShmMutex.Unlock()
+
+	if seg, ok := os.Shm[key]; ok {
+		return seg.Size >= size
+	}
+	if size == 0 {
+		return false
+	}
+	handle, ok := os.SegMem.Alloc(shmOwner(key), size)
+	if !ok {
+		log.WithFields(log.Fields{"pid": pid, "key": key, "size": size}).Error("[OS] Shmget: out of memory")
+		return false
+	}
+
+	log.WithFields(log.Fields{
+		"pid":  pid,
+		"key":  key,
+		"size": size,
+	}).Info("[OS] Shmget: create a shared memory segment")
+
+	os.Shm[key] = &SharedSegment{
+		Key:      key,
+		Size:     size,
+		Attached: map[string]bool{},
+		handle:   handle,
+	}
+	os.Tracer.emit(Event{Type: EventShmCreated, Pid: pid, Data: fmt.Sprintf("key=%s size=%d", key, size)})
+	return true
+}
+
+// Shmat 把共享内存段 key 挂接到线程所在的进程。
+// 段不存在，或者挂接后进程的内存用量会超过它的内存配额时返回 false。
+func (os *OS) Shmat(thread *Thread, key string) bool {
+	proc := thread.contextual.Process
+
+	os.ShmMutex.Lock()
+	defer os.ShmMutex.Unlock()
+
+	seg, ok := os.Shm[key]
+	if !ok {
+		log.WithFields(log.Fields{"pid": proc.Id, "key": key}).Warn("[OS] Shmat: no such segment")
+		return false
+	}
+	if proc.Shm[key] == seg {
+		return true
+	}
+	if proc.MemoryLimit > 0 && os.memoryUsage(proc)+seg.Size > proc.MemoryLimit {
+		log.WithFields(log.Fields{
+			"pid":   proc.Id,
+			"key":   key,
+			"limit": proc.MemoryLimit,
+		}).Warn("[OS] Shmat: memory limit exceeded")
+		return false
+	}
+
+	os.attach(proc, seg)
+	log.WithFields(log.Fields{"pid": proc.Id, "key": key}).Info("[OS] Shmat")
+	return true
+}
+
+// attach 把共享内存段 seg 挂接到进程 p。调用时要持有 os.ShmMutex。
+func (os *OS) attach(p *Process, seg *SharedSegment) {
+	seg.Lock()
+	seg.Attached[p.Id] = true
+	seg.Unlock()
+	p.Shm[seg.Key] = seg
+}
+
+// Shmrm 删除共享内存段 key：之后 Shmget 同一个 key 会新建一个段。
+// 没有进程挂接的段马上销毁，否则等最后一个挂接的进程解除挂接时销毁。没有这个段时返回 false。
+func (os *OS) Shmrm(thread *Thread, key string) bool {
+	pid := thread.contextual.Process.Id
+
+	os.ShmMutex.Lock()
+	defer os.ShmMutex.Unlock()
+
+	seg, ok := os.Shm[key]
+	if !ok {
+		log.WithFields(log.Fields{"pid": pid, "key": key}).Warn("[OS] Shmrm: no such segment")
+		return false
+	}
+	delete(os.Shm, key)
+
+	seg.Lock()
+	attached := len(seg.Attached)
+	seg.Unlock()
+
+	log.WithFields(log.Fields{"pid": pid, "key": key, "attached": attached}).Info("[OS] Shmrm")
+	if attached == 0 {
+		os.destroySegment(pid, seg)
+	}
+	return true
+}
+
+// Shmdt 解除线程所在进程对共享内存段 key 的挂接，最后一个进程解除挂接时销毁这个段。
+// 没有挂接这个段时返回 false。
+func (os *OS) Shmdt(thread *Thread, key string) bool {
+	return os.shmdt(thread.contextual.Process, key)
+}
+
+// shmdt 解除进程 p 对共享内存段 key 的挂接
+func (os *OS) shmdt(p *Process, key string) bool {
+	os.ShmMutex.Lock()
+	defer os.ShmMutex.Unlock()
+
+	seg, ok := p.Shm[key]
+	if !ok {
+		return false
+	}
+	delete(p.Shm, key)
+
+	seg.Lock()
+	delete(seg.Attached, p.Id)
+	last := len(seg.Attached) == 0
+	seg.Unlock()
+
+	log.WithFields(log.Fields{"pid": p.Id, "key": key, "destroy": last}).Info("[OS] Shmdt")
+
+	if last {
+		if os.Shm[key] == seg { // 已经被 Shmrm 删除了的话，key 可能对应着一个新的段
+			delete(os.Shm, key)
+		}
+		os.destroySegment(p.Id, seg)
+	}
+	return true
+}
+
+// destroySegment 销毁共享内存段 seg，释放它在 OS.SegMem 中的内存。pid 是引起销毁的进程。调用时要持有 os.ShmMutex。
+func (os *OS) destroySegment(pid string, seg *SharedSegment) {
+	os.SegMem.Free(shmOwner(seg.Key), seg.handle)
+	os.Tracer.emit(Event{Type: EventShmDestroyed, Pid: pid, Data: fmt.Sprintf("key=%s", seg.Key)})
+}
+
+// shmUsage 返回进程 p 挂接的共享内存段的总大小（字）
+func (os *OS) shmUsage(p *Process) (n uint) {
+	for _, seg := range p.Shm {
+		n += seg.Size
+	}
+	return n
+}
+
+// ReadShared 读取线程所在进程挂接的共享内存段 key 中第 offset 个字。
+// 没有挂接这个段或者越界时返回 nil, false。
+func (os *OS) ReadShared(thread *Thread, key string, offset uint) (interface{}, bool) {
+	seg, ok := thread.contextual.Process.Shm[key]
+	if !ok {
+		return nil, false
+	}
+	return os.SegMem.Load(shmOwner(key), seg.handle, offset)
+}
+
+// WriteShared 把 value 写到线程所在进程挂接的共享内存段 key 中第 offset 个字
+func (os *OS) WriteShared(thread *Thread, key string, offset uint, value interface{}) bool {
+	seg, ok := thread.contextual.Process.Shm[key]
+	if !ok {
+		return false
+	}
+	return os.SegMem.Store(shmOwner(key), seg.handle, offset, value)
+}
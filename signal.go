@@ -0,0 +1,293 @@
+package sham
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+)
+
+// Signal 信号：发给进程的异步通知，编号和 Linux 的一样
+type Signal int
+
+// 支持的信号
+const (
+	SIGHUP  Signal = 1
+	SIGINT  Signal = 2
+	SIGKILL Signal = 9
+	SIGUSR1 Signal = 10
+	SIGUSR2 Signal = 12
+	SIGTERM Signal = 15
+	SIGCHLD Signal = 17
+	SIGCONT Signal = 18
+	SIGSTOP Signal = 19
+
+	// SignalCount 信号编号的上界
+	SignalCount Signal = 32
+)
+
+// signalNames 是信号的名字
+var signalNames = map[Signal]string{
+	SIGHUP:  "SIGHUP",
+	SIGINT:  "SIGINT",
+	SIGKILL: "SIGKILL",
+	SIGUSR1: "SIGUSR1",
+	SIGUSR2: "SIGUSR2",
+	SIGTERM: "SIGTERM",
+	SIGCHLD: "SIGCHLD",
+	SIGCONT: "SIGCONT",
+	SIGSTOP: "SIGSTOP",
+}
+
+// String 返回信号的名字，如 SIGKILL 的名字是 "SIGKILL"
+func (s Signal) String() string {
+	if name, ok := signalNames[s]; ok {
+		return name
+	}
+	return fmt.Sprintf("signal(%d)", int(s))
+}
+
+// catchable SIGKILL 和 SIGSTOP 不能被捕获、忽略或者屏蔽
+func (s Signal) catchable() bool {
+	return s != SIGKILL && s != SIGSTOP
+}
+
+// SignalAction 是信号的默认动作
+type SignalAction int
+
+// 信号的默认动作
+const (
+	// ActionTerminate 结束进程，退出码为 128 + 信号编号
+	ActionTerminate SignalAction = iota
+	// ActionIgnore 什么也不做
+	ActionIgnore
+	// ActionStop 停止进程（StatusStopped），直到收到 SIGCONT
+	ActionStop
+	// ActionContinue 让停止的进程继续运行
+	ActionContinue
+)
+
+// defaultActions 信号的默认动作，不在表里的是 ActionTerminate
+var defaultActions = map[Signal]SignalAction{
+	SIGCHLD: ActionIgnore,
+	SIGCONT: ActionContinue,
+	SIGSTOP: ActionStop,
+}
+
+// DefaultAction 返回信号 sig 的默认动作
+func DefaultAction(sig Signal) SignalAction {
+	if a, ok := defaultActions[sig]; ok {
+		return a
+	}
+	return ActionTerminate
+}
+
+// SignalSet 是信号的集合，用作进程的未决信号和信号屏蔽字
+type SignalSet uint64
+
+// Has 集合中有没有信号 sig
+func (s SignalSet) Has(sig Signal) bool {
+	return s&(1<<uint(sig)) != 0
+}
+
+// Add 返回加上了信号 sig 的集合
+func (s SignalSet) Add(sig Signal) SignalSet {
+	return s | 1<<uint(sig)
+}
+
+// Del 返回去掉了信号 sig 的集合
+func (s SignalSet) Del(sig Signal) SignalSet {
+	return s &^ (1 << uint(sig))
+}
+
+// SignalHandler 信号处理程序：进程在下一条指令之前，在自己的上下文里运行它。
+// 处理程序是这条指令的一部分，所以不要在里面发起会阻塞进程的系统调用（如 IO、Wait）。
+type SignalHandler func(contextual *Contextual, sig Signal)
+
+// SendSignal 给进程 pid 发送信号 sig，供操作员在进程外使用（进程里用系统调用 Kill）。
+// 信号先挂在进程的未决信号上，等进程下一次运行（下一条指令之前）再递送，见 deliverSignals。
+// 信号发给整个进程（pid 是线程 id 的话发给它所在的进程），由进程下一个上 CPU 的内核线程递送（1:1 模型下可以是任何一个线程）。例外的是：
+//   - SIGKILL 发给没有线程在运行的进程（就绪、阻塞、停止）时立即杀掉它（杀不掉的话照常挂起，下一条指令之前递送）；
+//   - SIGCONT 立即让停止的进程回到就绪队列（同时丢掉未决的 SIGSTOP），信号本身照常递送。
+//
+// 没有这个进程时返回 false。
+func (os *OS) SendSignal(pid string, sig Signal) bool {
+	if sig <= 0 || sig >= SignalCount {
+		log.WithFields(log.Fields{"pid": pid, "signal": int(sig)}).Warn("[OS] SendSignal: invalid signal")
+		return false
+	}
+
+	os.ProcsMutex.Lock()
+	defer os.ProcsMutex.Unlock()
+
+	p := os.lookup(pid)
+	if p == nil {
+		log.WithFields(log.Fields{"pid": pid, "signal": sig}).Warn("[OS] SendSignal: no such process")
+		return false
+	}
+	p = p.owner()
+	// 判断能不能立即杀掉和杀掉它要在同一次持有锁的时候做，不然中间 p 可能上了 CPU
+	if os.raiseSignal(p, sig) && !os.terminate(p, ExitSignaled, 128+int(SIGKILL)) {
+		p.PendingSignals = p.PendingSignals.Add(SIGKILL) // 杀不掉就照常挂起，不能把 SIGKILL 弄丢
+	}
+	return true
+}
+
+// Kill 系统调用：线程所在的进程给进程 pid 发送信号 sig，见 SendSignal
+func (os *OS) Kill(thread *Thread, pid string, sig Signal) bool {
+	log.WithFields(log.Fields{
+		"from":   thread.contextual.Process.Id,
+		"to":     pid,
+		"signal": sig,
+	}).Info("[OS] Kill")
+	return os.SendSignal(pid, sig)
+}
+
+// SetSignalHandler 系统调用：线程所在的进程注册信号 sig 的处理程序，handler 为 nil 时恢复默认动作。
+// SIGKILL、SIGSTOP 不能被捕获，返回 false。
+func (os *OS) SetSignalHandler(thread *Thread, sig Signal, handler SignalHandler) bool {
+	if !sig.catchable() {
+		return false
+	}
+
+	os.ProcsMutex.Lock()
+	defer os.ProcsMutex.Unlock()
+
+	p := thread.contextual.Process
+	p.IgnoredSignals = p.IgnoredSignals.Del(sig)
+	if handler == nil {
+		delete(p.SignalHandlers, sig)
+		return true
+	}
+	if p.SignalHandlers == nil {
+		p.SignalHandlers = map[Signal]SignalHandler{}
+	}
+	p.SignalHandlers[sig] = handler
+	return true
+}
+
+// IgnoreSignal 系统调用：线程所在的进程忽略信号 sig。SIGKILL、SIGSTOP 不能被忽略，返回 false。
+func (os *OS) IgnoreSignal(thread *Thread, sig Signal) bool {
+	if !sig.catchable() {
+		return false
+	}
+
+	os.ProcsMutex.Lock()
+	defer os.ProcsMutex.Unlock()
+
+	p := thread.contextual.Process
+	delete(p.SignalHandlers, sig)
+	p.IgnoredSignals = p.IgnoredSignals.Add(sig)
+	return true
+}
+
+// MaskSignals 系统调用：线程所在的进程屏蔽信号 sigs。SIGKILL、SIGSTOP 不能被屏蔽，跳过。
+func (os *OS) MaskSignals(thread *Thread, sigs []Signal) {
+	os.ProcsMutex.Lock()
+	defer os.ProcsMutex.Unlock()
+
+	p := thread.contextual.Process
+	for _, sig := range sigs {
+		if sig.catchable() {
+			p.SignalMask = p.SignalMask.Add(sig)
+		}
+	}
+}
+
+// UnmaskSignals 系统调用：线程所在的进程解除对信号 sigs 的屏蔽
+func (os *OS) UnmaskSignals(thread *Thread, sigs []Signal) {
+	os.ProcsMutex.Lock()
+	defer os.ProcsMutex.Unlock()
+
+	p := thread.contextual.Process
+	for _, sig := range sigs {
+		p.SignalMask = p.SignalMask.Del(sig)
+	}
+}
+
+// raiseSignal 把信号 sig 挂到进程 p 的未决信号上，返回是不是要立即杀掉 p（见 SendSignal）。
+// 调用时要持有 os.ProcsMutex。
+func (os *OS) raiseSignal(p *Process, sig Signal) (kill bool) {
+	log.WithFields(log.Fields{"pid": p.Id, "signal": sig}).Info("[OS] signal raised")
+	os.Tracer.emit(Event{Type: EventSignalSent, Pid: p.Id, Data: sig.String()})
+
+	if sig == SIGKILL && !os.onCPU(p) {
+		return true
+	}
+
+	p.PendingSignals = p.PendingSignals.Add(sig)
+	if sig == SIGCONT {
+		p.PendingSignals = p.PendingSignals.Del(SIGSTOP)
+		for _, task := range tasks(p) { // 1:1 模型下进程的线程是一起停下的，见 stopTasks
+			if task.Status == StatusStopped {
+				os.stoppedToReady(task.Id)
+			}
+		}
+	}
+	return false
+}
+
+// stopTasks 进程 p 被信号停止了：1:1 模型下它在就绪队列里的别的线程也停下，SIGCONT 时一起回到就绪队列。
+// 阻塞着的线程等的事件发生后照常回到就绪队列。调用时要持有 os.ProcsMutex。
+func (os *OS) stopTasks(p *Process) {
+	for _, task := range tasks(p) {
+		if task.Status != StatusReady {
+			continue
+		}
+		log.WithFields(log.Fields{"pid": p.Id, "tid": task.Id}).Info("[OS] thread stops with its process")
+		os.ReadyProcs = withoutProcess(os.ReadyProcs, task)
+		os.StoppedProcs = append(os.StoppedProcs, task)
+		task.Status = StatusStopped
+		os.Metrics.leave(task, StatusReady, os.Clock.Now())
+		os.traceTransition(task, StatusReady, StatusStopped)
+	}
+}
+
+// deliverSignals 在线程 thread 的下一条指令之前递送它所在进程未决的、没被屏蔽的信号，按编号从小到大：
+// 进程注册了处理程序的，运行处理程序；忽略了的，丢掉；否则执行默认动作。
+// 返回进程接下来的状态：StatusRunning 照常运行这条指令，StatusDone 被信号结束，StatusStopped 被信号停止。
+// 1:1 模型下递送的可能不是主线程：它返回 StatusDone 的话整个进程跟着结束（见 RunningToDone），
+// 返回 StatusStopped 的话进程的线程都停下（见 RunningToStopped）。
+func (os *OS) deliverSignals(thread *Thread) int {
+	c := thread.contextual
+	p := c.Process
+
+	for {
+		os.ProcsMutex.Lock()
+		sig := Signal(0)
+		for s := Signal(1); s < SignalCount; s++ {
+			if p.PendingSignals.Has(s) && !(s.catchable() && p.SignalMask.Has(s)) {
+				sig = s
+				break
+			}
+		}
+		if sig == 0 {
+			os.ProcsMutex.Unlock()
+			return StatusRunning
+		}
+		p.PendingSignals = p.PendingSignals.Del(sig)
+		handler := p.SignalHandlers[sig]
+		ignored := p.IgnoredSignals.Has(sig)
+		os.ProcsMutex.Unlock()
+
+		log.WithFields(log.Fields{"pid": p.Id, "signal": sig}).Info("[OS] deliver signal")
+		os.Tracer.emit(Event{Type: EventSignalDelivered, Pid: p.Id, Data: sig.String()})
+
+		if sig.catchable() && handler != nil {
+			handler(c, sig)
+			continue
+		}
+		if sig.catchable() && ignored {
+			continue
+		}
+		switch DefaultAction(sig) {
+		case ActionTerminate:
+			p.ExitReason = ExitSignaled
+			p.ExitCode = 128 + int(sig)
+			if task := thread.task; task != p { // 1:1 模型下别的线程递送的，记在线程上，它结束时进程跟着结束
+				task.ExitReason, task.ExitCode = p.ExitReason, p.ExitCode
+			}
+			return StatusDone
+		case ActionStop:
+			return StatusStopped
+		}
+	}
+}
@@ -0,0 +1,199 @@
+package sham
+
+import (
+	log "github.com/sirupsen/logrus"
+	"sort"
+)
+
+// SuspendProcess 挂起进程 pid（中程调度）：把它换出内存，让出位置给别的进程，供操作员在进程外使用。
+//   - 就绪的进程变为就绪挂起（StatusSuspendedReady），阻塞的变为阻塞挂起（StatusSuspendedBlocked），
+//     阻塞挂起的进程等的事件发生后变为就绪挂起；
+//   - 正在运行的进程在这条指令完成后变为就绪挂起；
+//   - 进程在物理内存中的页都换出到交换区（没有交换区的话留在内存里），再运行时按需换入；
+//   - 挂起的进程不算活跃的进程，可能因此接纳新的进程（见 MaxActive）；
+//   - 1:1 模型下进程的线程在进程表里各占一项，都一起挂起（pid 是线程 id 的话挂起的也是整个进程）。
+//
+// 没有这个进程，或者它不能被挂起（新建、停止、已经挂起的）时返回 false。
+func (os *OS) SuspendProcess(pid string) bool {
+	os.ProcsMutex.Lock()
+	p := os.lookup(pid)
+	if p != nil && p.idle { // Noop 不是进程，不能挂起（在 CPU 上时也不行）
+		os.ProcsMutex.Unlock()
+		log.Warn("[OS] SuspendProcess: cannot suspend noop")
+		return false
+	}
+	running, ok := false, false
+	if p != nil {
+		p = p.owner()
+		for _, task := range tasks(p) {
+			if task.Status == StatusRunning {
+				running = true
+			} else if os.suspend(task) {
+				ok = true
+			}
+		}
+	}
+	os.ProcsMutex.Unlock()
+
+	if running {
+		log.WithField("process", p.Id).Info("[OS] SuspendProcess: suspend after this instruction")
+		os.CPU.Cancel(StatusSuspendedReady) // 调度器收到后调用 RunningToSuspended，换出进程的页
+		return true
+	}
+	if !ok {
+		log.WithField("pid", pid).Warn("[OS] SuspendProcess: no such process, or it cannot be suspended")
+		return false
+	}
+	os.swapOutProcess(p)
+
+	os.ProcsMutex.Lock()
+	os.admit()
+	os.ProcsMutex.Unlock()
+	return true
+}
+
+// suspend 把就绪或阻塞的进程 p 挂起，不能挂起时返回 false。调用时要持有 os.ProcsMutex。
+func (os *OS) suspend(p *Process) bool {
+	if p.idle {
+		return false
+	}
+
+	var to int
+	switch p.Status {
+	case StatusReady:
+		os.ReadyProcs = withoutProcess(os.ReadyProcs, p)
+		os.SuspendedReadyProcs = append(os.SuspendedReadyProcs, p)
+		to = StatusSuspendedReady
+	case StatusBlocked:
+		os.BlockedProcs = withoutProcess(os.BlockedProcs, p)
+		os.SuspendedBlockedProcs = append(os.SuspendedBlockedProcs, p)
+		to = StatusSuspendedBlocked
+	default:
+		return false
+	}
+
+	log.WithField("process", p.Id).Info("[OS] SuspendProcess")
+	os.Metrics.leave(p, p.Status, os.Clock.Now())
+	os.traceTransition(p, p.Status, to)
+	p.Status = to
+	return true
+}
+
+// ResumeProcess 激活挂起的进程 pid：就绪挂起的回到就绪队列，阻塞挂起的回到阻塞队列。
+// 换出的页不会立即换入，进程访问的时候再缺页换入。供操作员在进程外使用。
+// 激活不受 MaxActive 的限制：要不要激活是中程调度（操作员）决定的。1:1 模型下进程的线程一起激活。
+// 没有这个挂起的进程时返回 false。
+func (os *OS) ResumeProcess(pid string) bool {
+	os.ProcsMutex.Lock()
+	defer os.ProcsMutex.Unlock()
+
+	p := os.lookup(pid)
+	if p == nil {
+		log.WithField("pid", pid).Warn("[OS] ResumeProcess: no such process")
+		return false
+	}
+
+	resumed := false
+	for _, task := range tasks(p.owner()) {
+		if os.resume(task) {
+			resumed = true
+		}
+	}
+	if !resumed {
+		log.WithFields(log.Fields{
+			"pid":    pid,
+			"status": StatusName(p.Status),
+		}).Warn("[OS] ResumeProcess: process is not suspended")
+	}
+	return resumed
+}
+
+// resume 激活挂起的进程（或者 1:1 模型下的线程）p，没有挂起时返回 false。调用时要持有 os.ProcsMutex。
+func (os *OS) resume(p *Process) bool {
+	var to int
+	switch p.Status {
+	case StatusSuspendedReady:
+		os.SuspendedReadyProcs = withoutProcess(os.SuspendedReadyProcs, p)
+		os.ReadyProcs = append(os.ReadyProcs, p)
+		to = StatusReady
+	case StatusSuspendedBlocked:
+		os.SuspendedBlockedProcs = withoutProcess(os.SuspendedBlockedProcs, p)
+		os.BlockedProcs = append(os.BlockedProcs, p)
+		to = StatusBlocked
+	default:
+		return false
+	}
+
+	log.WithField("process", p.Id).Info("[OS] ResumeProcess")
+	os.Metrics.leave(p, p.Status, os.Clock.Now())
+	os.traceTransition(p, p.Status, to)
+	p.Status = to
+	return true
+}
+
+// Suspend 系统调用：挂起进程 pid，可以是自己。见 SuspendProcess
+func (os *OS) Suspend(thread *Thread, pid string) bool {
+	log.WithFields(log.Fields{"from": thread.contextual.Process.Id, "pid": pid}).Info("[OS] Suspend")
+	return os.SuspendProcess(pid)
+}
+
+// Resume 系统调用：激活挂起的进程 pid。见 ResumeProcess
+func (os *OS) Resume(thread *Thread, pid string) bool {
+	log.WithFields(log.Fields{"from": thread.contextual.Process.Id, "pid": pid}).Info("[OS] Resume")
+	return os.ResumeProcess(pid)
+}
+
+// admit 长程调度：按创建的先后把新建的进程接纳进就绪队列，直到活跃的进程数达到 os.MaxActive。
+// 进程创建、结束、挂起时调用。调用时要持有 os.ProcsMutex。
+func (os *OS) admit() {
+	for len(os.NewProcs) > 0 && (os.MaxActive == 0 || os.active() < os.MaxActive) {
+		p := os.NewProcs[0]
+		os.NewProcs = os.NewProcs[1:]
+
+		log.WithField("process", p.Id).Info("[OS] admit")
+		p.Status = StatusReady
+		os.Metrics.leave(p, StatusNew, os.Clock.Now())
+		os.traceTransition(p, StatusNew, StatusReady)
+		os.ReadyProcs = append(os.ReadyProcs, p)
+	}
+}
+
+// active 返回活跃的进程数：就绪、运行、阻塞和停止的进程，不算 Noop。
+// 1:1 模型下线程在进程表里各占一项（见 ThreadCreate），也各算一个
+func (os *OS) active() uint {
+	n := uint(0)
+	for _, list := range [][]*Process{os.ReadyProcs, os.BlockedProcs, os.StoppedProcs} {
+		for _, p := range list {
+			if !p.idle {
+				n += 1
+			}
+		}
+	}
+	if os.RunningProc != nil && os.RunningProc.Status == StatusRunning && !os.RunningProc.idle {
+		n += 1
+	}
+	return n
+}
+
+// swapOutProcess 把进程 p 在物理内存中的页都换出到交换区。没有交换区时什么也不做。
+// 和缺页时的换出不同，挂起的进程不会等换出完成，所以不计换出的时间。
+// 换出时要查进程表，所以调用时不能持有 os.ProcsMutex。
+func (os *OS) swapOutProcess(p *Process) {
+	if os.swap() == nil {
+		return
+	}
+	var pages []uint
+	for page, pte := range p.PageTable {
+		if pte.Present {
+			pages = append(pages, page)
+		}
+	}
+	sort.Slice(pages, func(i, j int) bool { return pages[i] < pages[j] })
+
+	for _, page := range pages {
+		if pte := p.PageTable[page]; pte.Present { // 可能和前面的页共用页框，已经一起换出了
+			os.evict(pte.Frame)
+		}
+	}
+	log.WithFields(log.Fields{"pid": p.Id, "pages": len(pages)}).Info("[OS] swap out suspended process")
+}
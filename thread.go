@@ -0,0 +1,284 @@
+package sham
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+)
+
+// 线程模型：进程里的多个线程怎么映射到内核调度的实体上
+const (
+	// ThreadsKernel 内核级线程（1:1）：每个线程在进程表里各占一项，由调度器像进程一样调度。
+	// 一个线程阻塞（IO、缺页、ThreadJoin 等）时，同一个进程的别的线程照样可以运行。
+	ThreadsKernel = "1:1"
+	// ThreadsUser 用户级线程（M:1）：内核只看得到进程，由进程里的用户级线程调度程序在线程之间切换（见 userScheduler）。
+	// 切换不经过内核，但一个线程阻塞时整个进程都被阻塞。
+	ThreadsUser = "M:1"
+)
+
+// newThread 新建进程 p 的线程 tid，它映射到进程 p 上
+func (os *OS) newThread(p *Process, tid string, timeCost uint, runnable Runnable) *Thread {
+	t := &Thread{
+		Id:            tid,
+		runnable:      runnable,
+		remainingTime: timeCost,
+		task:          p,
+	}
+	t.contextual = &Contextual{
+		Process: p,
+		thread:  t,
+		OS:      os,
+	}
+	return t
+}
+
+// ThreadCreate 在线程所在的进程里创建一个运行 runnable 的线程，预计运行时间为 timeCost，返回线程 id。
+// 新线程和进程里的别的线程共用变量池、内存、堆、设备和共享内存段，有自己的 PC，从第 0 条指令开始运行。
+//   - 1:1 模型下，新线程在进程表里占一项（pid 就是线程 id，优先级、时间片和进程的一样），
+//     和新进程一样先进入新建状态，由 admit 接纳进就绪队列，同样受 os.MaxActive 限制；
+//   - M:1 模型下，新线程只加到进程里，由进程的用户级线程调度程序来跑，进程的预计剩余时间加上 timeCost。
+func (os *OS) ThreadCreate(thread *Thread, timeCost uint, runnable Runnable) string {
+	p := thread.contextual.Process
+
+	os.ProcsMutex.Lock()
+	defer os.ProcsMutex.Unlock()
+
+	p.threadSeq += 1
+	tid := fmt.Sprintf("%s.t%d", p.Id, p.threadSeq)
+	t := os.newThread(p, tid, timeCost, runnable)
+	p.Threads = append(p.Threads, t)
+
+	log.WithFields(log.Fields{
+		"pid":   p.Id,
+		"tid":   tid,
+		"model": os.ThreadModel,
+	}).Info("[OS] ThreadCreate")
+
+	if os.ThreadModel == ThreadsUser {
+		p.Thread.remainingTime += timeCost
+		return tid
+	}
+
+	task := &Process{
+		Id:         tid,
+		Precedence: p.Precedence,
+		Quantum:    p.Quantum,
+		Thread:     t,
+		Program:    p.Program,
+		Status:     StatusNew,
+		seq:        os.procSeq,
+	}
+	os.procSeq += 1
+	t.task = task
+
+	os.NewProcs = append(os.NewProcs, task)
+	os.Metrics.arrive(task, os.Clock.Now())
+	os.Tracer.emit(Event{Type: EventThreadCreated, Pid: tid, Data: p.Id})
+	os.admit()
+
+	return tid
+}
+
+// ThreadJoin 等同一个进程里的线程 tid 结束，返回它的退出码，并回收它（之后就不能再 join 它了）。
+// 线程已经结束的话立即返回；否则当前线程等它结束，这条指令会重新执行（和 WaitPid 一样）：
+// 1:1 模型下当前线程发出 JoinInterrupt 阻塞，M:1 模型下用户级线程调度程序换别的线程来跑，进程不会阻塞。
+// 没有这个线程（或者 tid 是自己）时返回 false，不会等。
+func (os *OS) ThreadJoin(thread *Thread, tid string) (code int, ok bool) {
+	p := thread.contextual.Process
+
+	os.ProcsMutex.Lock()
+	target := findThread(p, tid)
+	if target != nil && target.exited {
+		p.Threads = withoutThread(p.Threads, target)
+	}
+	os.ProcsMutex.Unlock()
+
+	if target == nil || target == thread {
+		log.WithFields(log.Fields{"tid": thread.Id, "join": tid}).Warn("[OS] ThreadJoin: no such thread")
+		return 0, false
+	}
+	if target.exited {
+		log.WithFields(log.Fields{
+			"tid":  thread.Id,
+			"join": tid,
+			"code": target.exitCode,
+		}).Info("[OS] ThreadJoin: thread joined")
+		return target.exitCode, true
+	}
+
+	thread.contextual.restart = true
+	if os.ThreadModel == ThreadsUser {
+		thread.joining = target
+		target.joiners = append(target.joiners, thread)
+		return 0, false
+	}
+
+	ch := make(chan interface{}, 1)
+	ch <- tid
+	os.InterruptRequest(thread, JoinInterrupt, ch)
+	return 0, false
+}
+
+// ThreadExit 结束线程，退出码为 code，返回 StatusDone（用法见 Contextual.ThreadExit）。
+// 主线程结束时整个进程结束，code 也是进程的退出码。
+func (os *OS) ThreadExit(thread *Thread, code int) int {
+	p := thread.contextual.Process
+	thread.exitCode = code
+	if len(p.Threads) > 0 && thread == p.Threads[0] {
+		p.ExitCode = code
+	}
+
+	log.WithFields(log.Fields{"tid": thread.Id, "code": code}).Info("[OS] ThreadExit")
+	return StatusDone
+}
+
+// threadDone 1:1 模型下线程（不是主线程）task 运行结束了：线程结束，进程里别的线程接着跑。
+// 返回 task 现在的状态 StatusDone。调用时要持有 os.ProcsMutex。
+func (os *OS) threadDone(task *Process) int {
+	task.Status = StatusDone
+	os.traceTransition(task, StatusRunning, StatusDone)
+	os.threadExited(task.Thread)
+	return StatusDone
+}
+
+// threadExited 线程 t 结束了：记下来等别的线程 ThreadJoin，唤醒正在等它的线程，释放它还持有的互斥锁。调用时要持有 os.ProcsMutex。
+func (os *OS) threadExited(t *Thread) {
+	log.WithFields(log.Fields{"tid": t.Id, "code": t.exitCode}).Info("[OS] thread exited")
+
+	t.exited = true
+	for _, j := range t.joiners {
+		j.joining = nil
+		if os.ThreadModel != ThreadsUser {
+			os.blockedToReady(j.task.Id)
+		}
+	}
+	t.joiners = nil
+	os.releaseMutexes()
+}
+
+// endThreads 进程 p 结束了，它的线程也都结束：1:1 模型下还没结束的线程从进程表里删掉。调用时要持有 os.ProcsMutex。
+func (os *OS) endThreads(p *Process) {
+	for _, t := range p.Threads {
+		task := t.task
+		if t.exited || task == p {
+			t.exited = true
+			continue
+		}
+		t.exited = true
+
+		from, ok := os.dequeue(task)
+		if !ok {
+			continue
+		}
+		log.WithFields(log.Fields{"pid": p.Id, "tid": t.Id}).Info("[OS] thread ends with its process")
+
+		task.Status = StatusDone
+		task.ExitReason, task.ExitCode = p.ExitReason, p.ExitCode
+		os.Metrics.kill(task, from, os.Clock.Now())
+		os.Metrics.exit(task, os.Clock.Now())
+		os.traceTransition(task, from, StatusDone)
+	}
+}
+
+// userScheduler 返回 M:1 模型下进程 p 的内核线程跑的 Runnable：用户级线程调度程序。
+// 它每次跑当前线程的一条指令；当前线程让出 CPU（返回 StatusReady）、等别的线程（ThreadJoin）或者结束时，
+// 按创建的顺序换下一个能跑的线程，都不经过内核（没有别的线程能跑时才真的让出 CPU）。
+// 线程发起的中断（IO、缺页等）让整个进程阻塞，主线程结束时整个进程结束。
+func (os *OS) userScheduler(p *Process) Runnable {
+	var current *Thread
+	return func(contextual *Contextual) int {
+		if current == nil || current.exited || current.joining != nil {
+			current = nextUserThread(p, current)
+		}
+		if current == nil {
+			log.WithField("pid", p.Id).Error("[OS] user threads: every thread is waiting")
+			return StatusReady
+		}
+
+		t := current
+		status := t.runnable(t.contextual)
+		contextual.restart = t.contextual.restart // 线程的指令没完成，进程的这条指令也不算完成
+		t.contextual.advance()
+
+		switch status {
+		case StatusRunning:
+		case StatusReady: // 用户级的 yield
+			next := nextUserThread(p, t)
+			if next == t {
+				return StatusReady
+			}
+			current = next
+		case StatusDone:
+			if t == p.Threads[0] {
+				return StatusDone
+			}
+			os.ProcsMutex.Lock()
+			os.threadExited(t)
+			os.ProcsMutex.Unlock()
+		default:
+			return status
+		}
+		return StatusRunning
+	}
+}
+
+// nextUserThread 按创建的顺序，找进程 p 里 after 之后（转一圈，最后是 after 自己）
+// 第一个能跑的（没结束，也没在等别的线程）线程，没有的话返回 nil
+func nextUserThread(p *Process, after *Thread) *Thread {
+	start := 0
+	for i, t := range p.Threads {
+		if t == after {
+			start = i + 1
+		}
+	}
+	for i := range p.Threads {
+		t := p.Threads[(start+i)%len(p.Threads)]
+		if !t.exited && t.joining == nil {
+			return t
+		}
+	}
+	return nil
+}
+
+// owner 返回 p 所在的进程：1:1 模型下线程在进程表里的那一项（见 ThreadCreate）返回它所在的进程，进程返回自己
+func (p *Process) owner() *Process {
+	if p.Thread != nil && p.Thread.contextual != nil && p.Thread.contextual.Process != nil {
+		return p.Thread.contextual.Process
+	}
+	return p
+}
+
+// tasks 返回进程 p 在进程表里的各项：进程自己，以及 1:1 模型下还没结束的别的线程
+func tasks(p *Process) []*Process {
+	ts := []*Process{p}
+	for _, t := range p.Threads {
+		if t.task != p && !t.exited {
+			ts = append(ts, t.task)
+		}
+	}
+	return ts
+}
+
+// onCPU 进程 p 有没有线程正在 CPU 上运行。调用时要持有 os.ProcsMutex。
+func (os *OS) onCPU(p *Process) bool {
+	return os.RunningProc != nil && os.RunningProc.Status == StatusRunning && os.RunningProc.owner() == p
+}
+
+// findThread 在进程 p 里找线程 tid，没有的话返回 nil
+func findThread(p *Process, tid string) *Thread {
+	for _, t := range p.Threads {
+		if t.Id == tid {
+			return t
+		}
+	}
+	return nil
+}
+
+// withoutThread 从 threads 中删掉 t
+func withoutThread(threads []*Thread, t *Thread) []*Thread {
+	for i, q := range threads {
+		if q == t {
+			return append(threads[:i:i], threads[i+1:]...)
+		}
+	}
+	return threads
+}
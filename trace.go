@@ -0,0 +1,205 @@
+package sham
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+)
+
+// 事件的类型
+const (
+	EventProcessCreated   = "ProcessCreated"
+	EventTransition       = "Transition"
+	EventInterruptRaised  = "InterruptRaised"
+	EventInterruptHandled = "InterruptHandled"
+	EventDeviceIO         = "DeviceIO"
+	EventPipeCreated      = "PipeCreated"
+	EventPipeDestroyed    = "PipeDestroyed"
+	EventClockTick        = "ClockTick"
+	EventCPUSwitch        = "CPUSwitch"
+	EventPageEvicted      = "PageEvicted"
+	EventHeapAlloc        = "HeapAlloc"
+	EventHeapFree         = "HeapFree"
+	EventOOMKill          = "OOMKill"
+	EventShmCreated       = "ShmCreated"
+	EventShmDestroyed     = "ShmDestroyed"
+	EventExec             = "Exec"
+	EventSignalSent       = "SignalSent"
+	EventSignalDelivered  = "SignalDelivered"
+	EventThreadCreated    = "ThreadCreated"
+	EventSemCreated       = "SemCreated"
+	EventMutexCreated     = "MutexCreated"
+	EventCondCreated      = "CondCreated"
+)
+
+// Event 是模拟运行中发生的一个事件，由 OS、CPU 和中断处理程序发出。
+// 不同类型的事件用到的字段不同，用不到的留空。
+type Event struct {
+	// Seq 事件的序号，从 0 开始
+	Seq uint `json:"seq"`
+	// Time 事件发生的时刻（os.Clock.Now()）
+	Time uint   `json:"time"`
+	Type string `json:"type"`
+	Pid  string `json:"pid,omitempty"`
+
+	// From、To 是状态转换前后的状态名，见 StatusName
+	From string `json:"from,omitempty"`
+	To   string `json:"to,omitempty"`
+
+	Interrupt string `json:"interrupt,omitempty"`
+	Device    string `json:"device,omitempty"`
+	// Data 是事件附带的数据，如 IO 的内容
+	Data string `json:"data,omitempty"`
+}
+
+// Tracer 记录事件流，可以导出成 JSON Lines
+type Tracer struct {
+	sync.Mutex
+	Events []Event
+
+	// now 获取当前时刻
+	now func() uint
+}
+
+// NewTracer 新建一个 Tracer，用 now 获取事件发生的时刻
+func NewTracer(now func() uint) *Tracer {
+	return &Tracer{now: now}
+}
+
+// emit 记录一个事件，填上序号和时刻。t 为 nil 时什么也不做。
+func (t *Tracer) emit(e Event) {
+	if t == nil {
+		return
+	}
+	t.Lock()
+	defer t.Unlock()
+
+	e.Seq = uint(len(t.Events))
+	if t.now != nil {
+		e.Time = t.now()
+	}
+	t.Events = append(t.Events, e)
+}
+
+// WriteJSONL 把事件流以 JSON Lines 格式（每行一个 JSON 对象）写到 w
+func (t *Tracer) WriteJSONL(w io.Writer) error {
+	t.Lock()
+	defer t.Unlock()
+
+	enc := json.NewEncoder(w)
+	for _, e := range t.Events {
+		if err := enc.Encode(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReadTrace 从 r 读取 JSON Lines 格式的事件流
+func ReadTrace(r io.Reader) ([]Event, error) {
+	var events []Event
+
+	dec := json.NewDecoder(r)
+	for {
+		var e Event
+		err := dec.Decode(&e)
+		if err == io.EOF {
+			return events, nil
+		}
+		if err != nil {
+			return events, err
+		}
+		events = append(events, e)
+	}
+}
+
+// ProcessTable 是重放出来的某一时刻的进程表
+type ProcessTable struct {
+	Running string
+	Ready   []string
+	Blocked []string
+	Done    []string
+	Zombie  []string
+	Stopped []string
+	New     []string
+
+	SuspendedReady   []string
+	SuspendedBlocked []string
+}
+
+// Replay 重放事件流，用于事后分析
+type Replay struct {
+	Events []Event
+}
+
+// NewReplay 用事件流新建一个 Replay
+func NewReplay(events []Event) *Replay {
+	return &Replay{Events: events}
+}
+
+// At 重建 tick 时刻（这一时刻的事件都发生过之后）的进程表
+func (r *Replay) At(tick uint) ProcessTable {
+	var table ProcessTable
+
+	for _, e := range r.Events {
+		if e.Time > tick {
+			break
+		}
+
+		switch e.Type {
+		case EventProcessCreated:
+			table.New = append(table.New, e.Pid)
+		case EventThreadCreated: // 1:1 模型下的线程直接进入就绪队列
+			table.Ready = append(table.Ready, e.Pid)
+		case EventTransition:
+			switch e.From {
+			case StatusName(StatusReady):
+				table.Ready = without(table.Ready, e.Pid)
+			case StatusName(StatusBlocked):
+				table.Blocked = without(table.Blocked, e.Pid)
+			case StatusName(StatusRunning):
+				table.Running = ""
+			case StatusName(StatusZombie):
+				table.Zombie = without(table.Zombie, e.Pid)
+			case StatusName(StatusStopped):
+				table.Stopped = without(table.Stopped, e.Pid)
+			case StatusName(StatusNew):
+				table.New = without(table.New, e.Pid)
+			case StatusName(StatusSuspendedReady):
+				table.SuspendedReady = without(table.SuspendedReady, e.Pid)
+			case StatusName(StatusSuspendedBlocked):
+				table.SuspendedBlocked = without(table.SuspendedBlocked, e.Pid)
+			}
+			switch e.To {
+			case StatusName(StatusReady):
+				table.Ready = append(table.Ready, e.Pid)
+			case StatusName(StatusBlocked):
+				table.Blocked = append(table.Blocked, e.Pid)
+			case StatusName(StatusRunning):
+				table.Running = e.Pid
+			case StatusName(StatusDone):
+				table.Done = append(table.Done, e.Pid)
+			case StatusName(StatusZombie):
+				table.Zombie = append(table.Zombie, e.Pid)
+			case StatusName(StatusStopped):
+				table.Stopped = append(table.Stopped, e.Pid)
+			case StatusName(StatusSuspendedReady):
+				table.SuspendedReady = append(table.SuspendedReady, e.Pid)
+			case StatusName(StatusSuspendedBlocked):
+				table.SuspendedBlocked = append(table.SuspendedBlocked, e.Pid)
+			}
+		}
+	}
+
+	return table
+}
+
+// without 从 pids 中删掉第一个 pid
+func without(pids []string, pid string) []string {
+	for i, p := range pids {
+		if p == pid {
+			return append(pids[:i:i], pids[i+1:]...)
+		}
+	}
+	return pids
+}
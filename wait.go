@@ -0,0 +1,134 @@
+package sham
+
+import (
+	log "github.com/sirupsen/logrus"
+)
+
+// InitPid 是 init 进程的 pid：操作员在进程外创建的进程，以及孤儿进程，都是它的子进程。
+// 模拟里没有真的 init 进程，它的子进程一结束就被回收，不会变成僵尸进程。
+const InitPid = "init"
+
+// WaitPid 等线程所在进程的子进程 pid 结束（pid 为 "" 时等任意一个子进程），返回子进程的 pid 和退出码。
+// 有已经结束的（僵尸）子进程时回收它并立即返回；
+// 否则发出 WaitInterrupt 阻塞当前进程，等子进程结束后再唤醒，这条指令会重新执行（和缺页一样）。
+// 没有这样的子进程时返回 false，不会阻塞。
+func (os *OS) WaitPid(thread *Thread, pid string) (child string, code int, ok bool) {
+	proc := thread.contextual.Process
+
+	os.ProcsMutex.Lock()
+	zombie, exists := os.findChild(proc.Id, pid)
+	if zombie != nil {
+		os.reap(zombie)
+	}
+	os.ProcsMutex.Unlock()
+
+	if zombie != nil {
+		log.WithFields(log.Fields{
+			"pid":   proc.Id,
+			"child": zombie.Id,
+			"code":  zombie.ExitCode,
+		}).Info("[OS] Wait: child reaped")
+		return zombie.Id, zombie.ExitCode, true
+	}
+	if !exists {
+		log.WithFields(log.Fields{"pid": proc.Id, "child": pid}).Warn("[OS] Wait: no such child")
+		return "", 0, false
+	}
+
+	ch := make(chan interface{}, 1)
+	ch <- pid
+	os.InterruptRequest(thread, WaitInterrupt, ch)
+	thread.contextual.restart = true
+	return "", 0, false
+}
+
+// findChild 在进程表里找进程 parent 的子进程 pid（为 "" 时是任意一个子进程），
+// 返回其中已经结束的一个（没有的话为 nil），以及有没有这样的子进程。调用时要持有 os.ProcsMutex。
+func (os *OS) findChild(parent string, pid string) (zombie *Process, exists bool) {
+	for _, p := range os.ZombieProcs {
+		if p.Parent == parent && (pid == "" || p.Id == pid) {
+			return p, true
+		}
+	}
+	for _, p := range os.liveProcs() {
+		if p.Parent == parent && (pid == "" || p.Id == pid) {
+			return nil, true
+		}
+	}
+	return nil, false
+}
+
+// liveProcs 返回进程表里所有还没结束的进程（包括新建的、挂起的）。调用时要持有 os.ProcsMutex。
+func (os *OS) liveProcs() []*Process {
+	var procs []*Process
+	for _, list := range [][]*Process{
+		os.ReadyProcs, os.BlockedProcs, os.StoppedProcs,
+		os.NewProcs, os.SuspendedReadyProcs, os.SuspendedBlockedProcs,
+	} {
+		procs = append(procs, list...)
+	}
+	if os.RunningProc != nil && os.RunningProc.Status == StatusRunning { // 离开 CPU 后 RunningProc 可能还指着它
+		procs = append(procs, os.RunningProc)
+	}
+	return procs
+}
+
+// reap 回收僵尸进程 p：从进程表里彻底删除。调用时要持有 os.ProcsMutex。
+func (os *OS) reap(p *Process) {
+	os.ZombieProcs = withoutProcess(os.ZombieProcs, p)
+	p.Status = StatusDone
+	os.traceTransition(p, StatusZombie, StatusDone)
+}
+
+// exited 进程 p 结束了（已经从就绪、阻塞队列里删除，回收了资源），from 是它结束前的状态：
+// 父进程还在的话 p 变成僵尸进程，等父进程 Wait（父进程正在 Wait 它的话唤醒父进程），并给父进程发 SIGCHLD，否则直接结束。
+// p 的线程随之结束，它们持有的互斥锁被释放，子进程都过继给 init，其中的僵尸进程随即被回收。p 不再活跃，可能因此接纳新的进程。
+// 返回 p 现在的状态（StatusZombie｜StatusDone）。调用时要持有 os.ProcsMutex。
+func (os *OS) exited(p *Process, from int) int {
+	for _, t := range tasks(p) {
+		delete(os.waiting, t.Id)
+	}
+	os.endThreads(p)
+	os.releaseMutexes()
+
+	var parent *Process
+	for _, q := range os.liveProcs() {
+		if q.Id == p.Parent && q != p {
+			parent = q
+		}
+	}
+
+	if parent == nil {
+		p.Status = StatusDone
+	} else {
+		p.Status = StatusZombie
+		os.ZombieProcs = append(os.ZombieProcs, p)
+	}
+	os.traceTransition(p, from, p.Status)
+
+	if parent != nil {
+		for _, t := range tasks(parent) { // 可能是父进程的某个线程在 Wait
+			if want, ok := os.waiting[t.Id]; ok && (want == "" || want == p.Id) {
+				delete(os.waiting, t.Id)
+				os.blockedToReady(t.Id)
+				break
+			}
+		}
+		os.raiseSignal(parent, SIGCHLD)
+	}
+
+	for _, q := range append(os.liveProcs(), os.ZombieProcs...) {
+		if q.Parent != p.Id {
+			continue
+		}
+		log.WithFields(log.Fields{"pid": q.Id, "parent": p.Id}).Info("[OS] orphan adopted by init")
+		q.Parent = InitPid
+		if q.Status == StatusZombie {
+			os.reap(q)
+		}
+	}
+
+	os.admit()
+
+	return p.Status
+}